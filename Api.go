@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"teProj/cryptoManager"
+)
+
+type QuoteResponse struct {
+	FromAsset      string         `json:"fromAsset"`
+	ToAsset        string         `json:"toAsset"`
+	Amount         string         `json:"amount"`
+	Rate           float64        `json:"rate"`
+	Fee            float64        `json:"fee"`
+	AmountAfterFee string         `json:"amountAfterFee"`
+	Expires        int64          `json:"expires"`
+	Token          string         `json:"token"`
+	Fiat           *FiatValuation `json:"fiat,omitempty"`
+}
+
+type OrderResponse struct {
+	OrderID           string                    `json:"orderID"`
+	Status            string                    `json:"status"`
+	FromAsset         string                    `json:"fromAsset"`
+	ToAsset           string                    `json:"toAsset"`
+	SendAmount        string                    `json:"sendAmount"`
+	ReceiveAmount     string                    `json:"receiveAmount"`
+	ExchangeRate      float64                   `json:"exchangeRate"`
+	FeeRate           float64                   `json:"feeRate"`
+	FromAddress       string                    `json:"fromAddress"`
+	ToAddress         string                    `json:"toAddress"`
+	FromTxid          string                    `json:"fromTxid"`
+	ToTxids           []string                  `json:"toTxids"`
+	ExpirationTime    int64                     `json:"expirationTime"`
+	ErrorMessage      string                    `json:"errorMessage,omitempty"`
+	CreationValuation map[string]*FiatValuation `json:"creationValuation"`
+	PayoutValuation   map[string]*FiatValuation `json:"payoutValuation,omitempty"`
+	RefundTxids       []string                  `json:"refundTxids,omitempty"`
+	// ToOutputs names batched payouts as txid:vout.
+	ToOutputs []string `json:"toOutputs,omitempty"`
+	// Proofs holds payment proofs of payouts and refunds by txid.
+	Proofs map[string]*cryptoManager.PaymentProof `json:"proofs,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func quoteAPI(w http.ResponseWriter, r *http.Request) {
+	fromID, _ := strconv.Atoi(r.URL.Query().Get("fromId"))
+	toID, _ := strconv.Atoi(r.URL.Query().Get("toId"))
+	amount, err := parseCryptoValue(r.URL.Query().Get("amount"), fromID)
+	if err != nil && r.URL.Query().Get("amount") != "" {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	if fromID <= 0 || toID <= 0 || amount.Sign() <= 0 {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "fromId, toId and amount are required"})
+		return
+	}
+
+	quote, token, err := IssueQuote(store, fromID, toID, amount)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{Error: err.Error()})
+		return
+	}
+	amountAfterFee, err := quote.Apply(store, amount)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{Error: err.Error()})
+		return
+	}
+
+	response := QuoteResponse{
+		FromAsset:      store.assetNames[fromID],
+		ToAsset:        store.assetNames[toID],
+		Amount:         formatCryptoValue(amount, fromID),
+		Rate:           quote.Rate,
+		Fee:            quote.Fee,
+		AmountAfterFee: formatCryptoValue(amountAfterFee, toID),
+		Expires:        quote.Expires,
+		Token:          token,
+	}
+	if fiatCode := r.URL.Query().Get("fiat"); IsKnownFiat(fiatCode) {
+		response.Fiat, _ = ValueInFiat(store, fromID, toID, amount, amountAfterFee, quote.Fee, fiatCode)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func orderAPI(w http.ResponseWriter, r *http.Request) {
+	orderID := r.URL.Query().Get("orderID")
+
+	sessionsMutex.Lock()
+	session, ok := Sessions[orderID]
+	sessionsMutex.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "order not found"})
+		return
+	}
+
+	response := OrderResponse{
+		OrderID:           session.OrderID,
+		Status:            session.Status,
+		FromAsset:         session.FromCurrencySign,
+		ToAsset:           session.ToCurrencySign,
+		SendAmount:        formatCryptoValue(session.SendAmount, session.FromCurrencyID),
+		ReceiveAmount:     formatCryptoValue(session.ReceiveAmount, session.ToCurrencyID),
+		ExchangeRate:      session.ExchangeRate,
+		FeeRate:           session.FeeRate,
+		FromAddress:       session.FromAddress,
+		ToAddress:         session.ToAddress,
+		FromTxid:          session.FromTransaction.Txid,
+		ExpirationTime:    session.ExpirationTime,
+		ErrorMessage:      session.ErrorMessage,
+		CreationValuation: session.CreationValuation,
+		PayoutValuation:   session.PayoutValuation,
+	}
+	for _, tx := range session.ToTransactions {
+		response.ToTxids = append(response.ToTxids, tx.Txid)
+		if tx.OutputIndex != nil {
+			response.ToOutputs = append(response.ToOutputs, fmt.Sprintf("%s:%d", tx.Txid, *tx.OutputIndex))
+		}
+		if tx.Proof != nil {
+			if response.Proofs == nil {
+				response.Proofs = make(map[string]*cryptoManager.PaymentProof)
+			}
+			response.Proofs[tx.Txid] = tx.Proof
+		}
+	}
+	for _, tx := range session.Refunds {
+		response.RefundTxids = append(response.RefundTxids, tx.Txid)
+		if tx.Proof != nil {
+			if response.Proofs == nil {
+				response.Proofs = make(map[string]*cryptoManager.PaymentProof)
+			}
+			response.Proofs[tx.Txid] = tx.Proof
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+const defaultOperatorListen = "127.0.0.1:8081"
+
+type OperatorPayout struct {
+	OrderID string   `json:"orderID"`
+	PSBT    string   `json:"psbt"`
+	Txids   []string `json:"txids,omitempty"`
+}
+
+// operatorPayoutAPI exports the PSBT of an order awaiting signature on GET
+// and imports the signed PSBT on POST. It takes the operator token as a
+// bearer token and is disabled without one. It is served by
+// serveOperatorAPI, never on the public port.
+func operatorPayoutAPI(w http.ResponseWriter, r *http.Request) {
+	token := config.Operator.Token
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, apiError{Error: "unauthorized"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		orderID := r.URL.Query().Get("orderID")
+		psbt, err := ExportPayout(orderID)
+		if err != nil {
+			writeJSON(w, http.StatusConflict, apiError{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, OperatorPayout{OrderID: orderID, PSBT: psbt})
+	case http.MethodPost:
+		var request OperatorPayout
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body"})
+			return
+		}
+		txids, err := ImportSignedPayout(request.OrderID, request.PSBT)
+		if err != nil {
+			writeJSON(w, http.StatusConflict, apiError{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, OperatorPayout{OrderID: request.OrderID, Txids: txids})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "use GET to export or POST to import"})
+	}
+}
@@ -21,19 +21,88 @@ type CryptoCurrency struct {
 	AssetSign            string `json:"assetSign"`
 	Precision            int    `json:"precision"`
 	ConfirmationsNeeded  int    `json:"confirmationsNeeded"`
+	// FixedPrice pins the USD price of the asset instead of using the feed.
+	FixedPrice float64 `json:"fixedPrice,omitempty"`
+	// Peg prices the asset as a multiple of another supported asset.
+	Peg     *PricePeg     `json:"peg,omitempty"`
+	Handler HandlerConfig `json:"handler"`
+	// Reserve keeps the hot wallet between a target and a ceiling.
+	Reserve *ReservePolicy `json:"reserve,omitempty"`
+}
+
+// HandlerConfig names a registered cryptoManager handler type and carries
+// its settings, which are decoded by the handler itself.
+type HandlerConfig struct {
+	Type     string          `json:"type"`
+	Settings json.RawMessage `json:"settings"`
+}
+
+type PricePeg struct {
+	AssetID    int     `json:"assetID"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+type Route struct {
+	Pair struct {
+		IDFrom int `json:"idFrom"`
+		IDTo   int `json:"idTo"`
+	} `json:"pair"`
+	//Note to self change fee from absolute value to %
+	Fee       float64 `json:"fee"`
+	MinAmount float64 `json:"minAmount"`
+	// FixedRate is a negotiated rate (units of IDTo per unit of IDFrom, before
+	// fee) used instead of the USD cross rate.
+	FixedRate float64 `json:"fixedRate,omitempty"`
+}
+
+type FiatCurrency struct {
+	Code                 string `json:"code"`
+	Sign                 string `json:"sign"`
+	CoinmarketcapAssetID int    `json:"coinmarketcapAssetID"`
 }
 
 type Config struct {
 	SupportedCryptos []CryptoCurrency `json:"supportedCryptos"`
-	Routes           []struct {
-		Pair struct {
-			IDFrom int `json:"idFrom"`
-			IDTo   int `json:"idTo"`
-		} `json:"pair"`
-		//Note to self change fee from absolute value to %
-		Fee       float64 `json:"fee"`
-		MinAmount float64 `json:"minAmount"`
-	} `json:"routes"`
+	FiatCurrencies   []FiatCurrency   `json:"fiatCurrencies"`
+	DefaultFiat      string           `json:"defaultFiat"`
+	Routes           []Route          `json:"routes"`
+	PriceFeed        struct {
+		Source      string  `json:"source"`
+		CaptureFile string  `json:"captureFile"`
+		ReplayFile  string  `json:"replayFile"`
+		ReplaySpeed float64 `json:"replaySpeed"`
+		ReplayLoop  bool    `json:"replayLoop"`
+		MockFile    string  `json:"mockFile"`
+	} `json:"priceFeed"`
+	// CrossRateCheck compares direct pair rates with the USD cross rate.
+	// Only the mock feed supplies pair rates so far, with other feeds there
+	// is nothing to compare and no route is suspended.
+	CrossRateCheck struct {
+		Enabled            bool    `json:"enabled"`
+		MaxDivergence      float64 `json:"maxDivergence"`
+		IntervalSeconds    int     `json:"intervalSeconds"`
+		MaxPriceAgeSeconds int     `json:"maxPriceAgeSeconds"`
+	} `json:"crossRateCheck"`
+	Quotes struct {
+		ValiditySeconds int64   `json:"validitySeconds"`
+		MaxDeviation    float64 `json:"maxDeviation"`
+		SigningKey      string  `json:"signingKey"`
+	} `json:"quotes"`
+	Sweep struct {
+		IntervalSeconds int `json:"intervalSeconds"`
+	} `json:"sweep"`
+	Reserve struct {
+		IntervalSeconds int `json:"intervalSeconds"`
+	} `json:"reserve"`
+	// Operator.Token enables the operator API for bearers of the token. It
+	// is served on Listen, a loopback address unless CertFile and KeyFile
+	// are given for TLS.
+	Operator struct {
+		Token    string `json:"token"`
+		Listen   string `json:"listen"`
+		CertFile string `json:"certFile"`
+		KeyFile  string `json:"keyFile"`
+	} `json:"operator"`
 }
 
 var config *Config
@@ -51,36 +120,27 @@ func loadConfig(path string) (*Config, error) {
 	if err := json.NewDecoder(file).Decode(&config); err != nil {
 		return nil, err
 	}
+	signingKey, err := cryptoManager.ResolveSecret(config.Quotes.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("quote signing key: %v", err)
+	}
+	if signingKey == "" {
+		return nil, fmt.Errorf("quote signing key missing")
+	}
+	config.Quotes.SigningKey = signingKey
+	token, err := cryptoManager.ResolveSecret(config.Operator.Token)
+	if err != nil {
+		LogError("Operator API disabled: %s", err.Error())
+	}
+	config.Operator.Token = token
 	handlers = make(map[int64]cryptoManager.CryptoHandler)
 	for _, crypto := range config.SupportedCryptos {
-		switch crypto.AssetName {
-		case "Bitcoin":
-			handler, err := cryptoManager.NewBtcHandler()
-			if err != nil {
-				continue
-			}
-			handlers[int64(crypto.InternalAssetID)] = handler
-		case "Litecoin":
-			handler, err := cryptoManager.NewLtcHandler()
-			if err != nil {
-				continue
-			}
-			handlers[int64(crypto.InternalAssetID)] = handler
-		case "Monero":
-			handler, err := cryptoManager.NewXmrHandler()
-			if err != nil {
-				continue
-			}
-			handlers[int64(crypto.InternalAssetID)] = handler
-		case "Ethereum":
-			handler, err := cryptoManager.NewEthHandler()
-			if err != nil {
-				continue
-			}
-			handlers[int64(crypto.InternalAssetID)] = handler
-		default:
+		handler, err := cryptoManager.NewHandler(crypto.Handler.Type, crypto.Handler.Settings)
+		if err != nil {
+			LogError("Unable to start %s handler: %s", crypto.AssetName, err.Error())
 			continue
 		}
+		handlers[int64(crypto.InternalAssetID)] = handler
 	}
 
 	return &config, nil
@@ -116,6 +176,9 @@ func cacheAssets(config *Config) error {
 	}
 
 	for _, crypto := range config.SupportedCryptos {
+		if crypto.CoinmarketcapAssetID <= 0 {
+			continue
+		}
 		filePath := filepath.Join(cacheDir, fmt.Sprintf("%d.png", crypto.InternalAssetID))
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			log.Printf("Downloading logo for %s...", crypto.AssetName)
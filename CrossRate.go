@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+const defaultCrossRateInterval = 30
+const defaultMaxPriceAge = 120
+const defaultMaxDivergence = 0.02
+
+type RouteCheck struct {
+	FromID       int
+	ToID         int
+	Direct       float64
+	Triangulated float64
+	Divergence   float64
+	// Problem says why the route is suspended and is empty while it is
+	// available.
+	Problem string
+}
+
+// TriangulatedRate is the pair rate implied by the USD prices of both assets,
+// ignoring any fixed rate configured for the route.
+func TriangulatedRate(store *PriceStore, fromID, toID int) (float64, error) {
+	fromPrice, ok := store.Get(fromID)
+	if !ok {
+		return 0, fmt.Errorf("price not available for %s", store.assetNames[fromID])
+	}
+
+	toPrice, ok := store.Get(toID)
+	if !ok || toPrice == 0 {
+		return 0, fmt.Errorf("price not available for %s", store.assetNames[toID])
+	}
+	return fromPrice / toPrice, nil
+}
+
+// stalePrice reports the first of the assets whose live USD price is older
+// than maxAge.
+func stalePrice(store *PriceStore, maxAge time.Duration, assetIDs ...int) string {
+	for _, assetID := range assetIDs {
+		updated, live := store.PriceUpdated(assetID)
+		if !live || time.Since(updated) <= maxAge {
+			continue
+		}
+		if updated.IsZero() {
+			return fmt.Sprintf("no price received for %s", store.assetNames[assetID])
+		}
+		return fmt.Sprintf("price of %s not updated for %v", store.assetNames[assetID], time.Since(updated).Round(time.Second))
+	}
+	return ""
+}
+
+// CheckCrossRates suspends the routes priced from a USD price older than
+// maxAge, and those whose direct rate from the price source diverges from
+// the triangulated rate by more than maxDivergence. Direct rates older than
+// maxAge are not compared. Routes with a fixed rate depend on neither and
+// are not checked.
+func CheckCrossRates(store *PriceStore, maxDivergence float64, maxAge time.Duration) []RouteCheck {
+	var checks []RouteCheck
+	for _, route := range config.Routes {
+		fromID, toID := route.Pair.IDFrom, route.Pair.IDTo
+		if _, ok := store.GetFixedRate(fromID, toID); ok {
+			continue
+		}
+		check := RouteCheck{
+			FromID:  fromID,
+			ToID:    toID,
+			Problem: stalePrice(store, maxAge, fromID, toID),
+		}
+		if check.Problem == "" {
+			triangulated, err := TriangulatedRate(store, fromID, toID)
+			if err != nil {
+				check.Problem = err.Error()
+			} else {
+				check.Triangulated = triangulated
+			}
+		}
+		direct, updated, ok := store.GetPair(fromID, toID)
+		if check.Problem == "" && ok && direct != 0 && time.Since(updated) <= maxAge {
+			check.Direct = direct
+			check.Divergence = math.Abs(check.Triangulated-direct) / direct
+			if check.Divergence > maxDivergence {
+				check.Problem = fmt.Sprintf("direct rate %g, triangulated rate %g, divergence %.2f%%", direct, check.Triangulated, check.Divergence*100)
+			}
+		}
+		checks = append(checks, check)
+
+		wasAvailable := store.RouteAvailable(fromID, toID)
+		suspended := check.Problem != ""
+		store.SetRouteSuspended(fromID, toID, suspended)
+		if suspended && wasAvailable {
+			LogAlert("Route %s to %s suspended: %s", store.assetNames[fromID], store.assetNames[toID], check.Problem)
+		} else if !suspended && !wasAvailable {
+			LogActivity("Route %s to %s resumed", store.assetNames[fromID], store.assetNames[toID])
+		}
+	}
+	return checks
+}
+
+func RunCrossRateChecker(ctx context.Context) {
+	settings := config.CrossRateCheck
+	if !settings.Enabled {
+		return
+	}
+	interval := time.Duration(settings.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultCrossRateInterval * time.Second
+	}
+	maxAge := time.Duration(settings.MaxPriceAgeSeconds) * time.Second
+	if maxAge <= 0 {
+		maxAge = defaultMaxPriceAge * time.Second
+	}
+	maxDivergence := settings.MaxDivergence
+	if maxDivergence <= 0 {
+		maxDivergence = defaultMaxDivergence
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			CheckCrossRates(store, maxDivergence, maxAge)
+		}
+	}
+}
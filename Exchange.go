@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -17,6 +18,21 @@ import (
 
 var sessionsMutex sync.RWMutex
 
+// orders tracks the running ExchangeBackend goroutines so shutdown can wait
+// for them.
+var orders sync.WaitGroup
+
+var pollInterval = 5 * time.Second
+
+// depositGracePeriod is how long a deposit that left the chain may take to
+// reappear, or the node may fail to report on it, before the order is
+// handed to the operator.
+const depositGracePeriod = 30 * time.Minute
+
+// maxRebroadcasts is how often a payout missing from the chain is sent again
+// before the order is handed to the operator.
+const maxRebroadcasts = 3
+
 var Sessions map[string]*ExchangeSession
 
 var blankTransaction = cryptoManager.CryptoTransaction{Txid: "nil"}
@@ -31,12 +47,14 @@ type ExchangeSession struct {
 	FromCurrencyID    int
 	ToCurrencyID      int
 	FeeRate           float64
-	SendAmount        float64
-	ReceiveAmount     float64
+	SendAmount        cryptoManager.Amount
+	ReceiveAmount     cryptoManager.Amount
 	ToAddress         string
 	FromAddress       string
+	FromAddressIndex  uint32
 	RefundAddress     string
 	ToTransactions    []cryptoManager.CryptoTransaction
+	Refunds           []cryptoManager.CryptoTransaction
 	FromTransaction   cryptoManager.CryptoTransaction
 	ToConfirmations   int
 	FromConfirmations int
@@ -44,6 +62,17 @@ type ExchangeSession struct {
 	ErrorMessage      string
 	ExpirationTime    int64
 	CollectionTime    int64
+	Quote             *Quote
+	FiatCurrency      string
+	CreationValuation map[string]*FiatValuation
+	PayoutValuation   map[string]*FiatValuation
+	// UnsignedPayout is the PSBT of a payout or refund signed offline,
+	// signer is the handler it is imported with while one is awaited.
+	UnsignedPayout string
+	signer         cryptoManager.OfflineSigner
+	signedPayout   chan []string
+	cancel         context.CancelFunc
+	refunding      bool
 }
 
 func CollectGarbage() {
@@ -86,7 +115,7 @@ func FormatExpirationTime(expirationTime int64) string {
 	return fmt.Sprintf("%02d:%02d", minutes, seconds)
 }
 
-func MakeSession(fromID int, toID int, fromAmount, toAmount float64, toAddress, refundAddress string) (string, error) {
+func MakeSession(ctx context.Context, fromID int, toID int, fromAmount, toAmount cryptoManager.Amount, toAddress, refundAddress, quoteToken, fiatCode string) (string, error) {
 	buffer := make([]byte, 8)
 	_, err := rand.Read(buffer)
 	if err != nil {
@@ -148,18 +177,34 @@ func MakeSession(fromID int, toID int, fromAmount, toAmount float64, toAddress,
 		return "", fmt.Errorf("invalid address")
 	}
 
+	if validator, ok := toHandler.(cryptoManager.AddressValidator); ok {
+		if err := validator.ValidateAddress(toAddress); err != nil {
+			return "", fmt.Errorf("invalid %s receiving address: %v", toCurrencySign, err)
+		}
+	}
+
+	if validator, ok := fromHandler.(cryptoManager.AddressValidator); ok {
+		if err := validator.ValidateAddress(refundAddress); err != nil {
+			return "", fmt.Errorf("invalid %s refund address: %v", fromCurrencySign, err)
+		}
+	}
+
 	fee, ok := store.conversionFees[fmt.Sprintf("%d-%d", fromID, toID)]
 	if !ok {
 		return "", fmt.Errorf("route unavailable")
 	}
 
+	if !store.RouteAvailable(fromID, toID) {
+		return "", fmt.Errorf("route temporarily unavailable")
+	}
+
 	minAmount, ok := store.minAmounts[fmt.Sprintf("%d-%d", fromID, toID)]
 	if !ok {
 		return "", fmt.Errorf("route unavailable")
 	}
 
-	if fromAmount < minAmount {
-		return "", fmt.Errorf("minimum amount %f %s", fromAmount, fromCurrencySign)
+	if fromAmount.Cmp(minAmount) < 0 {
+		return "", fmt.Errorf("minimum amount %s %s", formatCryptoValue(minAmount, fromID), fromCurrencySign)
 	}
 
 	exchangeRate, err := ConvertWithoutFee(store, fromID, toID, 1)
@@ -174,16 +219,51 @@ func MakeSession(fromID int, toID int, fromAmount, toAmount float64, toAddress,
 		return "", fmt.Errorf("unable to calculate to amount")
 	}
 
-	bal, err := toHandler.CheckBalance()
+	var quote *Quote
+	if quoteToken != "" {
+		quote, err = ParseQuote(quoteToken)
+		if err != nil {
+			return "", err
+		}
+		if err = CheckQuote(store, quote, fromID, toID, fromAmount); err != nil {
+			return "", err
+		}
+		exchangeRate = quote.Rate
+		tA, err = quote.Apply(store, fromAmount)
+		if err != nil {
+			return "", fmt.Errorf("unable to calculate to amount")
+		}
+		toAmount = tA
+	}
+
+	if checker, ok := toHandler.(cryptoManager.InvoiceChecker); ok {
+		if err := checker.CheckInvoice(ctx, toAddress, toAmount); err != nil {
+			return "", err
+		}
+	}
+
+	if checker, ok := fromHandler.(cryptoManager.InvoiceChecker); ok {
+		if err := checker.CheckInvoice(ctx, refundAddress, fromAmount); err != nil {
+			return "", fmt.Errorf("refund %v", err)
+		}
+	}
+
+	bal, err := toHandler.CheckBalance(ctx)
 
 	if err != nil {
 		return "", fmt.Errorf("unable to calculate balance")
 	}
 
-	if tA > bal {
+	if tA.Cmp(bal) > 0 {
 		return "", fmt.Errorf("asking amount is higher then resources in the reserve")
 	}
 
+	if quote != nil {
+		if err := claimQuote(quoteToken, quote); err != nil {
+			return "", err
+		}
+	}
+
 	session := ExchangeSession{
 		OrderID:           orderID,
 		Status:            "CREATED",
@@ -206,6 +286,12 @@ func MakeSession(fromID int, toID int, fromAmount, toAmount float64, toAddress,
 		ExchangeRate:      exchangeRate,
 		CollectionTime:    -1,
 		ExpirationTime:    time.Now().Add(15 * time.Minute).Unix(),
+		Quote:             quote,
+		CreationValuation: ValueOrderInFiat(store, fromID, toID, fromAmount, tA, fee),
+		signedPayout:      make(chan []string, 1),
+	}
+	if IsKnownFiat(fiatCode) {
+		session.FiatCurrency = fiatCode
 	}
 	sessionsMutex.Lock()
 	Sessions[orderID] = &session
@@ -234,18 +320,364 @@ func EncryptInternalMessage(err error) string {
 	return " Internal Error: " + base64.StdEncoding.EncodeToString(ciphertext)
 }
 
-func ExchangeBackend(session *ExchangeSession) error {
+// StartOrder runs the order in the background under a context derived from
+// the application context, so it can be cancelled on its own or with
+// everything else at shutdown.
+func StartOrder(orderID string) {
+	sessionsMutex.Lock()
+	session, ok := Sessions[orderID]
+	if !ok {
+		sessionsMutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(appContext)
+	session.cancel = cancel
+	sessionsMutex.Unlock()
+
+	orders.Add(1)
+	go func() {
+		defer orders.Done()
+		defer cancel()
+		runOrder(ctx, session)
+	}()
+}
+
+func runOrder(ctx context.Context, session *ExchangeSession) {
+	err := ExchangeBackend(ctx, session)
+	if err == nil || session.FromTransaction.Txid == "nil" {
+		return
+	}
+	if session.Status == "AWAITING OPERATOR" {
+		// Either the deposit is in doubt or a payout was sent, a refund
+		// could pay twice.
+		return
+	}
+	if ctx.Err() != nil {
+		// The deposit is left for the operator, refunding from a cancelled
+		// context could race a payout that is already on its way.
+		LogAlert("Order %s interrupted after receiving funds, settle manually, %#v", session.OrderID, *session)
+		return
+	}
+	//Careful here
+	refundAddress := cryptoManager.CryptoAddress{
+		Address:   session.RefundAddress,
+		StartTime: 0,
+	}
+	// The deposit stays reserved from the reserve sweeps until the refund
+	// is mined, or for good when it fails and is left to the operator.
+	sessionsMutex.Lock()
+	session.refunding = true
+	sessionsMutex.Unlock()
+	var send []string
+	if signer, ok := session.FromCurrency.(cryptoManager.OfflineSigner); ok && signer.OfflineSigning() {
+		status := session.Status
+		send, err = awaitSignature(appContext, session, signer, session.RefundAddress, session.FromTransaction.Amount)
+		session.Status = status
+		if err != nil && appContext.Err() != nil {
+			LogAlert("Refund of order %s left unsigned at shutdown, settle manually, %#v", session.OrderID, *session)
+			return
+		}
+	} else if refunder, ok := session.FromCurrency.(cryptoManager.Refunder); ok {
+		deposit := cryptoManager.CryptoAddress{Address: session.FromAddress, Index: session.FromAddressIndex}
+		send, err = refunder.Refund(appContext, deposit, refundAddress, session.FromTransaction.Amount)
+	} else {
+		send, err = session.FromCurrency.Send(appContext, refundAddress, session.FromTransaction.Amount)
+	}
+	if err != nil {
+		LogError("Refund failed with error: %s, %#v", err.Error(), *session)
+		return
+	}
+	LogActivity("Refund succeeded [%v], %#v", send, *session)
+	var refunds []cryptoManager.CryptoTransaction
+	for _, txid := range send {
+		transaction, err := session.FromCurrency.GetTransactionDetails(appContext, txid)
+		if err != nil {
+			transaction = &cryptoManager.CryptoTransaction{Txid: txid}
+		}
+		attachPaymentProof(appContext, session.FromCurrency, transaction, session.RefundAddress, session)
+		refunds = append(refunds, *transaction)
+	}
+	// Followed until mined, the reserve check holds the deposit back until
+	// then.
+	for {
+		sessionsMutex.Lock()
+		session.Refunds = refunds
+		sessionsMutex.Unlock()
+		if mined(refunds) || waitPoll(appContext) != nil {
+			return
+		}
+		refreshed := make([]cryptoManager.CryptoTransaction, len(refunds))
+		for i, refund := range refunds {
+			refreshed[i] = refund
+			transaction, err := session.FromCurrency.GetTransactionDetails(appContext, refund.Txid)
+			if err != nil {
+				continue
+			}
+			transaction.Proof = refund.Proof
+			refreshed[i] = *transaction
+		}
+		refunds = refreshed
+	}
+}
+
+// CancelOrder stops a running order.
+func CancelOrder(orderID string) error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	session, ok := Sessions[orderID]
+	if !ok {
+		return fmt.Errorf("order not found")
+	}
+	if session.cancel == nil || session.Status == "SUCCESS" || session.Status == "TRANSLATION FAILED" || session.Status == "AWAITING OPERATOR" {
+		return fmt.Errorf("order is not running")
+	}
+	if session.Status == "EXCHANGING" || session.Status == "CONFIRMING OUTPUT" {
+		return fmt.Errorf("payout already sent")
+	}
+	session.cancel()
+	return nil
+}
+
+// ExportPayout returns the unsigned PSBT of an order awaiting signature.
+func ExportPayout(orderID string) (string, error) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	session, ok := Sessions[orderID]
+	if !ok {
+		return "", fmt.Errorf("order not found")
+	}
+	if session.Status != "AWAITING SIGNATURE" || session.signer == nil {
+		return "", fmt.Errorf("order is not awaiting a signature")
+	}
+	return session.UnsignedPayout, nil
+}
+
+// signatureMutex keeps an order from giving up on its signature while a
+// signed PSBT of it is being broadcast.
+var signatureMutex sync.Mutex
+
+// awaitSignature prepares a PSBT paying amount to address and waits until
+// it is signed and imported. Once ctx is done the PSBT is no longer
+// accepted and its inputs are released.
+func awaitSignature(ctx context.Context, session *ExchangeSession, signer cryptoManager.OfflineSigner, address string, amount cryptoManager.Amount) ([]string, error) {
+	psbt, err := signer.PreparePayout(context.WithoutCancel(ctx), cryptoManager.CryptoAddress{
+		Address:   address,
+		StartTime: 0,
+	}, amount)
+	if err != nil {
+		return nil, err
+	}
+	sessionsMutex.Lock()
+	session.UnsignedPayout = psbt
+	session.signer = signer
+	session.Status = "AWAITING SIGNATURE"
+	sessionsMutex.Unlock()
+	LogAlert("Transfer of %s for order %s awaits an offline signature, export it with exportpsbt %s, %#v", address, session.OrderID, session.OrderID, *session)
+	select {
+	case txids := <-session.signedPayout:
+		return txids, nil
+	case <-ctx.Done():
+	}
+	signatureMutex.Lock()
+	defer signatureMutex.Unlock()
+	select {
+	case txids := <-session.signedPayout:
+		// Imported while the order was stopping.
+		return txids, nil
+	default:
+	}
+	sessionsMutex.Lock()
+	session.signer = nil
+	sessionsMutex.Unlock()
+	if err := signer.ReleasePayout(context.WithoutCancel(ctx), psbt); err != nil {
+		LogError("Unable to release the inputs of the PSBT of order %s: %s, %#v", session.OrderID, err.Error(), *session)
+	}
+	return nil, ctx.Err()
+}
+
+// ImportSignedPayout broadcasts the signed PSBT of an order awaiting
+// signature and lets the order continue with the payout or refund. It is
+// refused once the order stopped waiting.
+func ImportSignedPayout(orderID, signed string) ([]string, error) {
+	signatureMutex.Lock()
+	defer signatureMutex.Unlock()
+	sessionsMutex.Lock()
+	session, ok := Sessions[orderID]
+	if !ok {
+		sessionsMutex.Unlock()
+		return nil, fmt.Errorf("order not found")
+	}
+	signer := session.signer
+	if session.Status != "AWAITING SIGNATURE" || signer == nil {
+		sessionsMutex.Unlock()
+		return nil, fmt.Errorf("order is not awaiting a signature")
+	}
+	unsigned := session.UnsignedPayout
+	sessionsMutex.Unlock()
+
+	txids, err := signer.FinalizePayout(appContext, unsigned, signed)
+	if err != nil {
+		return nil, err
+	}
+	LogActivity("Signed PSBT of order %s broadcast [%v], %#v", orderID, txids, *session)
+	sessionsMutex.Lock()
+	session.signer = nil
+	sessionsMutex.Unlock()
+	session.signedPayout <- txids
+	return txids, nil
+}
+
+// CancelUnfundedOrders cancels every order that has not received a deposit
+// yet and returns how many were cancelled.
+func CancelUnfundedOrders() int {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	count := 0
+	for _, session := range Sessions {
+		if session.cancel == nil {
+			continue
+		}
+		if session.Status == "CREATED" || session.Status == "AWAITING INPUT" {
+			session.cancel()
+			count++
+		}
+	}
+	return count
+}
+
+// attachPaymentProof adds a payment proof to transactions of handlers that
+// make private payments. A missing proof is logged, it does not fail the
+// payment.
+func attachPaymentProof(ctx context.Context, handler cryptoManager.CryptoHandler, transaction *cryptoManager.CryptoTransaction, address string, session *ExchangeSession) {
+	prover, ok := handler.(cryptoManager.ProofProvider)
+	if !ok {
+		return
+	}
+	proof, err := prover.PaymentProof(ctx, transaction.Txid, cryptoManager.CryptoAddress{Address: address})
+	if err != nil {
+		LogError("Unable to create payment proof for %s: %s, %#v", transaction.Txid, err.Error(), *session)
+		return
+	}
+	transaction.Proof = proof
+}
+
+// bumpStuckPayouts replaces payouts unconfirmed for longer than the
+// handler allows. toTxid and transactions are updated in place with the
+// replacements; a failed bump is logged and retried after another wait.
+func bumpStuckPayouts(ctx context.Context, bumper cryptoManager.FeeBumper, session *ExchangeSession, toTxid []string, transactions []cryptoManager.CryptoTransaction, sentAt []time.Time, proofs map[string]*cryptoManager.PaymentProof) {
+	bumpAfter := bumper.BumpAfter()
+	if bumpAfter <= 0 {
+		return
+	}
+	for i, transaction := range transactions {
+		if transaction.Confirmations > 0 || time.Since(sentAt[i]) < bumpAfter {
+			continue
+		}
+		replacement, err := bumper.BumpFee(context.WithoutCancel(ctx), toTxid[i])
+		sentAt[i] = time.Now()
+		if err != nil {
+			LogError("Unable to bump fee of payout %s: %s, %#v", toTxid[i], err.Error(), *session)
+			continue
+		}
+		LogActivity("Payout %s replaced by %s with a higher fee, %#v", toTxid[i], replacement, *session)
+		proofs[replacement] = proofs[toTxid[i]]
+		toTxid[i] = replacement
+		transactions[i].Txid = replacement
+		transactions[i].Confirmations = 0
+	}
+}
+
+func waitPoll(ctx context.Context) error {
+	if !sleepScaled(ctx, pollInterval, 1) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func orderInterrupted(session *ExchangeSession, err error) error {
+	if session.Status == "EXCHANGING" || session.Status == "CONFIRMING OUTPUT" {
+		// The payout is out, the customer may already be paid.
+		return awaitOperator(session, fmt.Errorf("interrupted after the payout was sent: %v", err))
+	}
+	LogError("Order interrupted: %s, %#v", err.Error(), *session)
+	session.Status = "TRANSLATION FAILED"
+	if appContext.Err() != nil {
+		session.ErrorMessage = "Service shut down before the order completed."
+	} else {
+		session.ErrorMessage = "Order cancelled."
+	}
+	return err
+}
+
+// awaitOperator stops an order that can neither complete nor be refunded
+// safely, such as one whose payout was sent and then conflicted. The order
+// is kept until the operator settles it.
+func awaitOperator(session *ExchangeSession, err error) error {
+	LogAlert("Order %s needs the operator: %s, %#v", session.OrderID, err.Error(), *session)
+	session.Status = "AWAITING OPERATOR"
+	session.ErrorMessage = "The order needs a manual review by the operator." + EncryptInternalMessage(err)
+	session.CollectionTime = -1
+	return err
+}
+
+// payoutDetails fetches a payout, retrying errors a few times. A payout
+// missing from the chain is rebroadcast when the handler can, one that is
+// conflicted or stays missing is handed to the operator.
+func payoutDetails(ctx context.Context, session *ExchangeSession, txid string, rebroadcasts map[string]int) (*cryptoManager.CryptoTransaction, error) {
+	var transaction *cryptoManager.CryptoTransaction
+	var err error
+	for i := 0; i < 3; i++ {
+		transaction, err = session.ToCurrency.GetTransactionDetails(ctx, txid)
+		if err == nil {
+			break
+		}
+		if err := waitPoll(ctx); err != nil {
+			return nil, orderInterrupted(session, err)
+		}
+	}
+	if err != nil {
+		return nil, awaitOperator(session, fmt.Errorf("unable to fetch payout %s: %v", txid, err))
+	}
+	switch transaction.Status {
+	case cryptoManager.TxConflicted:
+		return nil, awaitOperator(session, fmt.Errorf("payout %s conflicted", txid))
+	case cryptoManager.TxNotFound:
+		rebroadcaster, ok := session.ToCurrency.(cryptoManager.Rebroadcaster)
+		if !ok || rebroadcasts[txid] >= maxRebroadcasts {
+			return nil, awaitOperator(session, fmt.Errorf("payout %s not found", txid))
+		}
+		rebroadcasts[txid]++
+		if err := rebroadcaster.Rebroadcast(context.WithoutCancel(ctx), txid); err != nil {
+			LogError("Unable to rebroadcast payout %s: %s, %#v", txid, err.Error(), *session)
+		} else {
+			LogActivity("Payout %s was missing and has been rebroadcast, %#v", txid, *session)
+		}
+	}
+	return transaction, nil
+}
+
+func ExchangeBackend(ctx context.Context, session *ExchangeSession) error {
 	LogActivity("New Order Created, %#v ", *session)
-	address, err := session.FromCurrency.GenerateNewAddress()
+	var address cryptoManager.CryptoAddress
+	var err error
+	if issuer, ok := session.FromCurrency.(cryptoManager.InvoiceIssuer); ok {
+		address, err = issuer.NewInvoice(ctx, session.SendAmount, "Order "+session.OrderID)
+	} else {
+		address, err = session.FromCurrency.GenerateNewAddress(ctx)
+	}
+	if ctx.Err() != nil {
+		return orderInterrupted(session, ctx.Err())
+	}
 	if err != nil {
 		LogError("Order failed with error: %s, %#v", err.Error(), *session)
 		session.Status = "TRANSLATION FAILED"
 		session.ErrorMessage = "Unable to generate new address." + EncryptInternalMessage(err)
 		return err
 	}
-	LogActivity("Address successfully created %s awaiting input, %#v", address, *session)
+	LogActivity("Address successfully created %s awaiting input, %#v", address.Address, *session)
 	session.Status = "AWAITING INPUT"
 	session.FromAddress = address.Address
+	session.FromAddressIndex = address.Index
 
 	var fromTransaction cryptoManager.CryptoTransaction
 	for {
@@ -256,86 +688,157 @@ func ExchangeBackend(session *ExchangeSession) error {
 			return fmt.Errorf("transaction Expired")
 		}
 
-		transaction, err := session.FromCurrency.GetAddressTransaction(address)
+		transaction, err := session.FromCurrency.GetAddressTransaction(ctx, address)
 
 		if err != nil && !strings.Contains(err.Error(), "no transactions found") {
-
+			if err := waitPoll(ctx); err != nil {
+				return orderInterrupted(session, err)
+			}
 			continue
-
 		}
 		if transaction != nil {
 			fromTransaction = *transaction
 			break
 		}
-		receiveAmount, err := Convert(store, session.FromCurrencyID, session.ToCurrencyID, session.SendAmount)
-		if err == nil {
-			session.ReceiveAmount = receiveAmount
-		}
+		if session.Quote == nil {
+			receiveAmount, err := Convert(store, session.FromCurrencyID, session.ToCurrencyID, session.SendAmount)
+			if err == nil {
+				session.ReceiveAmount = receiveAmount
+			}
 
-		exchangeRate, err := ConvertWithoutFee(store, session.FromCurrencyID, session.ToCurrencyID, 1)
+			exchangeRate, err := ConvertWithoutFee(store, session.FromCurrencyID, session.ToCurrencyID, 1)
 
-		if err == nil {
-			session.ReceiveAmount = exchangeRate
+			if err == nil {
+				session.ExchangeRate = exchangeRate
+			}
 		}
 
-		time.Sleep(5 * time.Second)
+		if err := waitPoll(ctx); err != nil {
+			return orderInterrupted(session, err)
+		}
 	}
-	LogActivity("Received %f %s at address %s confirming input, %#v", fromTransaction.Amount, session.FromCurrencySign, address, *session)
+	LogActivity("Received %s %s at address %s confirming input, %#v", formatCryptoValue(fromTransaction.Amount, session.FromCurrencyID), session.FromCurrencySign, address.Address, *session)
 	session.Status = "CONFIRMING INPUT"
 	session.FromTransaction = fromTransaction
-	session.ReceiveAmount = fromTransaction.Amount
-	sendAmount, err := Convert(store, session.FromCurrencyID, session.ToCurrencyID, fromTransaction.Amount)
+	session.SendAmount = fromTransaction.Amount
+	var receiveAmount cryptoManager.Amount
+	if session.Quote != nil {
+		receiveAmount, err = session.Quote.Price(store, fromTransaction.Amount, time.Now())
+	} else {
+		receiveAmount, err = Convert(store, session.FromCurrencyID, session.ToCurrencyID, fromTransaction.Amount)
+	}
 	if err != nil {
 		LogError("Order failed with error: %s, %#v", err.Error(), *session)
 		session.Status = "TRANSLATION FAILED"
 		session.ErrorMessage = "Unable to calculate amount to send." + EncryptInternalMessage(err)
 		return err
 	}
-	session.SendAmount = sendAmount
+	session.ReceiveAmount = receiveAmount
 	currentConfirm := session.FromTransaction.Confirmations
+	var missingSince, failingSince time.Time
 	for int(currentConfirm) < session.FromConfirmations {
-		time.Sleep(5 * time.Second)
-		transaction, err := session.FromCurrency.GetTransactionDetails(session.FromTransaction.Txid)
+		if err := waitPoll(ctx); err != nil {
+			return orderInterrupted(session, err)
+		}
+		transaction, err := session.FromCurrency.GetTransactionDetails(ctx, session.FromTransaction.Txid)
 		if err != nil {
+			if ctx.Err() != nil {
+				return orderInterrupted(session, ctx.Err())
+			}
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+				LogError("Unable to check deposit %s: %s, %#v", session.FromTransaction.Txid, err.Error(), *session)
+			}
+			if time.Since(failingSince) > depositGracePeriod {
+				return awaitOperator(session, fmt.Errorf("unable to check deposit %s for %v: %v", session.FromTransaction.Txid, depositGracePeriod, err))
+			}
+			continue
+		}
+		failingSince = time.Time{}
+		if transaction.Status == cryptoManager.TxNotFound || transaction.Status == cryptoManager.TxConflicted {
+			// The deposit was reorganized out or double spent. The sender
+			// may pay again, or the same payment may come back under a new
+			// txid, e.g. after a fee bump.
+			if missingSince.IsZero() {
+				missingSince = time.Now()
+				LogError("Deposit %s is %s, waiting for it to reappear, %#v", session.FromTransaction.Txid, transaction.Status, *session)
+			}
+			redetected, err := session.FromCurrency.GetAddressTransaction(ctx, address)
+			if err == nil && redetected != nil && redetected.Txid != session.FromTransaction.Txid {
+				if redetected.Amount.Cmp(session.FromTransaction.Amount) != 0 {
+					return awaitOperator(session, fmt.Errorf("deposit %s replaced by %s with a different amount", session.FromTransaction.Txid, redetected.Txid))
+				}
+				LogActivity("Deposit %s replaced by %s, %#v", session.FromTransaction.Txid, redetected.Txid, *session)
+				missingSince = time.Time{}
+				currentConfirm = redetected.Confirmations
+				session.FromTransaction = *redetected
+				continue
+			}
+			if time.Since(missingSince) > depositGracePeriod {
+				return awaitOperator(session, fmt.Errorf("deposit %s %s for %v", session.FromTransaction.Txid, transaction.Status, depositGracePeriod))
+			}
 			continue
 		}
+		missingSince = time.Time{}
 		currentConfirm = transaction.Confirmations
 		session.FromTransaction = *transaction
 	}
 	LogActivity("Incoming transaction %s confirmed %d times, exchanging, %#v", session.FromTransaction.Txid, session.FromConfirmations, *session)
-	session.Status = "EXCHANGING"
-	toTxid, err := session.ToCurrency.Send(cryptoManager.CryptoAddress{
-		Address:   session.ToAddress,
-		StartTime: 0,
-	}, session.SendAmount)
-	if err != nil {
-		LogError("Order failed with error: %s, %#v", err.Error(), *session)
-		session.Status = "TRANSLATION FAILED"
-		session.ErrorMessage = "Unable to exchange funds." + EncryptInternalMessage(err)
-		return err
+	if ctx.Err() != nil {
+		return orderInterrupted(session, ctx.Err())
 	}
-	time.Sleep(5 * time.Second)
-	var transactions []cryptoManager.CryptoTransaction
-	for _, tTxid := range toTxid {
-		var transaction *cryptoManager.CryptoTransaction
-		for i := 0; i < 3; i++ {
-			transaction, err = session.ToCurrency.GetTransactionDetails(tTxid)
-			if err == nil {
-				break
-			}
-			time.Sleep(5 * time.Second)
+	session.Status = "EXCHANGING"
+	var toTxid []string
+	if signer, ok := session.ToCurrency.(cryptoManager.OfflineSigner); ok && signer.OfflineSigning() {
+		// No refund once the PSBT is out, it may still be signed and sent.
+		toTxid, err = awaitSignature(ctx, session, signer, session.ToAddress, session.ReceiveAmount)
+		if err != nil && ctx.Err() != nil {
+			return orderInterrupted(session, ctx.Err())
 		}
 		if err != nil {
 			LogError("Order failed with error: %s, %#v", err.Error(), *session)
 			session.Status = "TRANSLATION FAILED"
-			session.ErrorMessage = "Unable to fetch output transaction details." + EncryptInternalMessage(err)
+			session.ErrorMessage = "Unable to exchange funds." + EncryptInternalMessage(err)
 			return err
 		}
+		session.Status = "EXCHANGING"
+	} else {
+		// Once started the payout is not interrupted, a half sent payout is
+		// worse than a late shutdown.
+		toTxid, err = session.ToCurrency.Send(context.WithoutCancel(ctx), cryptoManager.CryptoAddress{
+			Address:   session.ToAddress,
+			StartTime: 0,
+		}, session.ReceiveAmount)
+		if err != nil {
+			LogError("Order failed with error: %s, %#v", err.Error(), *session)
+			session.Status = "TRANSLATION FAILED"
+			session.ErrorMessage = "Unable to exchange funds." + EncryptInternalMessage(err)
+			return err
+		}
+	}
+	session.PayoutValuation = ValueOrderInFiat(store, session.FromCurrencyID, session.ToCurrencyID, session.SendAmount, session.ReceiveAmount, session.FeeRate/100)
+	if err := waitPoll(ctx); err != nil {
+		return orderInterrupted(session, err)
+	}
+	var transactions []cryptoManager.CryptoTransaction
+	proofs := make(map[string]*cryptoManager.PaymentProof)
+	rebroadcasts := make(map[string]int)
+	for _, tTxid := range toTxid {
+		transaction, err := payoutDetails(ctx, session, tTxid, rebroadcasts)
+		if err != nil {
+			return err
+		}
+		attachPaymentProof(ctx, session.ToCurrency, transaction, session.ToAddress, session)
+		proofs[tTxid] = transaction.Proof
 		transactions = append(transactions, *transaction)
 	}
 	LogActivity("Funds exchanged successfully output transactions [%v], %#v ", toTxid, *session)
 	session.Status = "CONFIRMING OUTPUT"
 	session.ToTransactions = transactions
+	sentAt := make([]time.Time, len(toTxid))
+	for i := range sentAt {
+		sentAt[i] = time.Now()
+	}
 	var currentConfirms []int64
 	for _, transaction := range transactions {
 		currentConfirms = append(currentConfirms, transaction.Confirmations)
@@ -351,28 +854,24 @@ func ExchangeBackend(session *ExchangeSession) error {
 		areAllConfirmed = true
 		transactions = make([]cryptoManager.CryptoTransaction, 0)
 		for _, tTxid := range toTxid {
-			var transaction *cryptoManager.CryptoTransaction
-			for i := 0; i < 3; i++ {
-				transaction, err = session.ToCurrency.GetTransactionDetails(tTxid)
-				if err == nil {
-					break
-				}
-				time.Sleep(5 * time.Second)
-			}
+			transaction, err := payoutDetails(ctx, session, tTxid, rebroadcasts)
 			if err != nil {
-				LogError("Order failed with error: %s, %#v", err.Error(), *session)
-				session.Status = "TRANSLATION FAILED"
-				session.ErrorMessage = "Unable to fetch output transaction details." + EncryptInternalMessage(err)
 				return err
 			}
+			transaction.Proof = proofs[tTxid]
 			transactions = append(transactions, *transaction)
 		}
+		if bumper, ok := session.ToCurrency.(cryptoManager.FeeBumper); ok {
+			bumpStuckPayouts(ctx, bumper, session, toTxid, transactions, sentAt, proofs)
+		}
 		session.ToTransactions = transactions
 		currentConfirms = make([]int64, 0)
 		for _, transaction := range transactions {
 			currentConfirms = append(currentConfirms, transaction.Confirmations)
 		}
-		time.Sleep(5 * time.Second)
+		if err := waitPoll(ctx); err != nil {
+			return orderInterrupted(session, err)
+		}
 	}
 	LogActivity("Order completed successfully, %#v", *session)
 	session.Status = "SUCCESS"
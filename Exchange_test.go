@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"teProj/cryptoManager"
+	"testing"
+	"time"
+)
+
+const (
+	testFromID = 1
+	testToID   = 2
+)
+
+// setupExchange configures two simulated chains, priced at 100 and 10 USD,
+// and a route between them with a fee of 25%, all exact in binary. Blocks
+// are only mined on request.
+func setupExchange(t *testing.T) (*cryptoManager.SimHandler, *cryptoManager.SimHandler) {
+	t.Helper()
+	config = &Config{
+		SupportedCryptos: []CryptoCurrency{
+			{InternalAssetID: testFromID, AssetName: "From", AssetSign: "FRM", AddressRegex: ".+", Precision: 8, ConfirmationsNeeded: 1, FixedPrice: 100},
+			{InternalAssetID: testToID, AssetName: "To", AssetSign: "TO", AddressRegex: ".+", Precision: 8, ConfirmationsNeeded: 1, FixedPrice: 10},
+		},
+	}
+	route := Route{Fee: 0.25, MinAmount: 0.1}
+	route.Pair.IDFrom = testFromID
+	route.Pair.IDTo = testToID
+	config.Routes = []Route{route}
+	store = NewPriceStore(config)
+
+	from, err := cryptoManager.NewSimHandler(cryptoManager.SimSettings{Sign: "FRM", Precision: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := cryptoManager.NewSimHandler(cryptoManager.SimSettings{Sign: "TO", Precision: 8, Balance: "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlers = map[int64]cryptoManager.CryptoHandler{testFromID: from, testToID: to}
+	Sessions = make(map[string]*ExchangeSession)
+
+	interval := pollInterval
+	pollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { pollInterval = interval })
+	return from, to
+}
+
+func testAmount(t *testing.T, value string) cryptoManager.Amount {
+	t.Helper()
+	amount, err := cryptoManager.ParseAmount(value, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return amount
+}
+
+// startTestOrder opens an order for amount and runs it, refund included.
+// The returned channel is closed once the order is done.
+func startTestOrder(t *testing.T, amount cryptoManager.Amount) (*ExchangeSession, chan struct{}) {
+	t.Helper()
+	toAmount, err := Convert(store, testFromID, testToID, amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orderID, err := MakeSession(context.Background(), testFromID, testToID, amount, toAmount, "payout-address", "refund-address", "", "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Sessions[orderID]
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runOrder(ctx, session)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return session, done
+}
+
+func waitStatus(t *testing.T, session *ExchangeSession, status string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sessionsMutex.RLock()
+		current := session.Status
+		sessionsMutex.RUnlock()
+		if current == status {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("order still %s, expected %s", session.Status, status)
+}
+
+func waitDone(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("order did not finish")
+	}
+}
+
+// payOrder deposits amount to the order and confirms it.
+func payOrder(t *testing.T, from *cryptoManager.SimHandler, session *ExchangeSession, amount cryptoManager.Amount) {
+	t.Helper()
+	waitStatus(t, session, "AWAITING INPUT")
+	from.Deposit(session.FromAddress, amount)
+	from.Mine(1)
+}
+
+func TestExchangeSuccess(t *testing.T) {
+	from, to := setupExchange(t)
+	session, done := startTestOrder(t, testAmount(t, "1"))
+
+	payOrder(t, from, session, testAmount(t, "1"))
+	waitStatus(t, session, "CONFIRMING OUTPUT")
+	to.Mine(1)
+	waitDone(t, done)
+
+	if session.Status != "SUCCESS" {
+		t.Fatalf("status %s: %s", session.Status, session.ErrorMessage)
+	}
+	// 1 FRM is worth 10 TO, less the fee of 25%.
+	expected := testAmount(t, "7.5")
+	if session.ReceiveAmount.Cmp(expected) != 0 {
+		t.Fatalf("receive amount %s", session.ReceiveAmount.Format(8))
+	}
+	if len(session.ToTransactions) != 1 || session.ToTransactions[0].Amount.Cmp(expected) != 0 {
+		t.Fatalf("payouts %+v", session.ToTransactions)
+	}
+	if balance, _ := to.CheckBalance(context.Background()); balance.Cmp(testAmount(t, "92.5")) != 0 {
+		t.Fatalf("balance after payout %s", balance.Format(8))
+	}
+	if len(session.Refunds) != 0 {
+		t.Fatalf("refunds %+v", session.Refunds)
+	}
+}
+
+func TestExchangeExpired(t *testing.T) {
+	_, to := setupExchange(t)
+	toAmount, err := Convert(store, testFromID, testToID, testAmount(t, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orderID, err := MakeSession(context.Background(), testFromID, testToID, testAmount(t, "1"), toAmount, "payout-address", "refund-address", "", "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Sessions[orderID]
+	session.ExpirationTime = time.Now().Add(-time.Second).Unix()
+	runOrder(context.Background(), session)
+
+	if session.Status != "TRANSLATION FAILED" || session.ErrorMessage != "Transaction Expired" {
+		t.Fatalf("status %s: %s", session.Status, session.ErrorMessage)
+	}
+	if session.FromTransaction.Txid != "nil" || len(session.Refunds) != 0 {
+		t.Fatalf("expired order has a deposit %+v or refunds %+v", session.FromTransaction, session.Refunds)
+	}
+	if balance, _ := to.CheckBalance(context.Background()); balance.Cmp(testAmount(t, "100")) != 0 {
+		t.Fatalf("balance after expiry %s", balance.Format(8))
+	}
+}
+
+func TestExchangeUnderpaid(t *testing.T) {
+	from, to := setupExchange(t)
+	session, done := startTestOrder(t, testAmount(t, "1"))
+
+	// Half the amount is paid, the payout is priced from what arrived.
+	payOrder(t, from, session, testAmount(t, "0.5"))
+	waitStatus(t, session, "CONFIRMING OUTPUT")
+	to.Mine(1)
+	waitDone(t, done)
+
+	if session.Status != "SUCCESS" {
+		t.Fatalf("status %s: %s", session.Status, session.ErrorMessage)
+	}
+	expected := testAmount(t, "3.75")
+	if session.SendAmount.Cmp(testAmount(t, "0.5")) != 0 || session.ReceiveAmount.Cmp(expected) != 0 {
+		t.Fatalf("send amount %s receive amount %s", session.SendAmount.Format(8), session.ReceiveAmount.Format(8))
+	}
+	if len(session.ToTransactions) != 1 || session.ToTransactions[0].Amount.Cmp(expected) != 0 {
+		t.Fatalf("payouts %+v", session.ToTransactions)
+	}
+}
+
+func TestExchangePayoutFailureRefund(t *testing.T) {
+	from, to := setupExchange(t)
+	to.FailNext("Send", 1)
+	session, done := startTestOrder(t, testAmount(t, "1"))
+
+	payOrder(t, from, session, testAmount(t, "1"))
+	waitStatus(t, session, "TRANSLATION FAILED")
+	// The refund is followed until it is mined.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(refundsOf(session)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	from.Mine(1)
+	waitDone(t, done)
+
+	refunds := refundsOf(session)
+	if len(refunds) != 1 || refunds[0].Amount.Cmp(testAmount(t, "1")) != 0 || refunds[0].Confirmations < 1 {
+		t.Fatalf("refunds %+v", refunds)
+	}
+	if session.Status != "TRANSLATION FAILED" {
+		t.Fatalf("status %s", session.Status)
+	}
+	if len(session.ToTransactions) != 1 || session.ToTransactions[0].Txid != "nil" {
+		t.Fatalf("payouts %+v", session.ToTransactions)
+	}
+	if balance, _ := to.CheckBalance(context.Background()); balance.Cmp(testAmount(t, "100")) != 0 {
+		t.Fatalf("balance after failed payout %s", balance.Format(8))
+	}
+	if balance, _ := from.CheckBalance(context.Background()); balance.Sign() != 0 {
+		t.Fatalf("deposit left after refund %s", balance.Format(8))
+	}
+}
+
+func refundsOf(session *ExchangeSession) []cryptoManager.CryptoTransaction {
+	sessionsMutex.RLock()
+	defer sessionsMutex.RUnlock()
+	return session.Refunds
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"teProj/cryptoManager"
+	"time"
+)
+
+type FiatValuation struct {
+	Currency     string  `json:"currency"`
+	Sign         string  `json:"sign"`
+	Time         int64   `json:"time"`
+	SendValue    float64 `json:"sendValue"`
+	ReceiveValue float64 `json:"receiveValue"`
+	FeeValue     float64 `json:"feeValue"`
+}
+
+// FiatCodes lists every fiat currency prices can be shown in, USD first.
+func FiatCodes() []string {
+	codes := []string{"USD"}
+	for _, fiat := range config.FiatCurrencies {
+		if fiat.Code != "USD" {
+			codes = append(codes, fiat.Code)
+		}
+	}
+	return codes
+}
+
+func IsKnownFiat(code string) bool {
+	for _, known := range FiatCodes() {
+		if known == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ValueInFiat prices both legs of an exchange in the given fiat currency. The
+// fee is valued on the sending side, before it is taken.
+func ValueInFiat(store *PriceStore, fromID, toID int, sendAmount, receiveAmount cryptoManager.Amount, fee float64, code string) (*FiatValuation, error) {
+	sendValue, err := ConvertToFiat(store, fromID, sendAmount, code)
+	if err != nil {
+		return nil, err
+	}
+	receiveValue, err := ConvertToFiat(store, toID, receiveAmount, code)
+	if err != nil {
+		return nil, err
+	}
+	return &FiatValuation{
+		Currency:     code,
+		Sign:         store.FiatSign(code),
+		Time:         time.Now().Unix(),
+		SendValue:    sendValue,
+		ReceiveValue: receiveValue,
+		FeeValue:     sendValue * fee,
+	}, nil
+}
+
+// ValueOrderInFiat values the exchange in every known fiat currency, skipping
+// the ones the price feed has not delivered yet.
+func ValueOrderInFiat(store *PriceStore, fromID, toID int, sendAmount, receiveAmount cryptoManager.Amount, fee float64) map[string]*FiatValuation {
+	valuations := make(map[string]*FiatValuation)
+	for _, code := range FiatCodes() {
+		valuation, err := ValueInFiat(store, fromID, toID, sendAmount, receiveAmount, fee, code)
+		if err != nil {
+			continue
+		}
+		valuations[code] = valuation
+	}
+	return valuations
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	FeedSourceLive   = "live"
+	FeedSourceReplay = "replay"
+	FeedSourceMock   = "mock"
+)
+
+type feedRecord struct {
+	Offset  int64  `json:"t"`
+	Message string `json:"msg"`
+}
+
+// FeedRecorder appends raw price feed messages to a file, one JSON record
+// per line, stamped with milliseconds since the recording started.
+type FeedRecorder struct {
+	sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	started time.Time
+}
+
+func NewFeedRecorder(path string) (*FeedRecorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %v", err)
+	}
+	return &FeedRecorder{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		started: time.Now(),
+	}, nil
+}
+
+func (r *FeedRecorder) Record(message []byte) {
+	r.Lock()
+	defer r.Unlock()
+	err := r.encoder.Encode(feedRecord{
+		Offset:  time.Since(r.started).Milliseconds(),
+		Message: string(message),
+	})
+	if err != nil {
+		LogError("Failed to record price feed message: %s", err.Error())
+	}
+}
+
+func (r *FeedRecorder) Close() error {
+	return r.file.Close()
+}
+
+// sleepScaled waits for d divided by speed, returning false if ctx ends first.
+func sleepScaled(ctx context.Context, d time.Duration, speed float64) bool {
+	if speed > 0 {
+		d = time.Duration(float64(d) / speed)
+	}
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// ReplayFeed feeds messages captured by FeedRecorder back into the price
+// store, keeping their original spacing divided by speed. A speed of zero
+// replays as fast as possible.
+func ReplayFeed(ctx context.Context, path string, speed float64, loop bool) error {
+	for {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open replay file: %v", err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		var last int64
+		for scanner.Scan() {
+			var record feedRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue
+			}
+			if !sleepScaled(ctx, time.Duration(record.Offset-last)*time.Millisecond, speed) {
+				file.Close()
+				return ctx.Err()
+			}
+			last = record.Offset
+			handleFeedMessage([]byte(record.Message))
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read replay file: %v", err)
+		}
+		if !loop {
+			return nil
+		}
+	}
+}
+
+type PricePoint struct {
+	At    int64   `json:"at"`
+	Price float64 `json:"price"`
+}
+
+type PricePath []PricePoint
+
+type MockAssetPath struct {
+	CoinmarketcapAssetID int       `json:"coinmarketcapAssetID"`
+	Path                 PricePath `json:"path"`
+}
+
+// MockPairPath scripts a direct rate between two internal assets, for
+// exercising the cross rate check.
+type MockPairPath struct {
+	IDFrom int       `json:"idFrom"`
+	IDTo   int       `json:"idTo"`
+	Path   PricePath `json:"path"`
+}
+
+// MockFeedScript describes scripted price paths. Points are given in
+// milliseconds from the start of the script and prices are interpolated
+// linearly between them, holding the last price once the path ends.
+type MockFeedScript struct {
+	IntervalMs int64           `json:"intervalMs"`
+	DurationMs int64           `json:"durationMs"`
+	Speed      float64         `json:"speed"`
+	Loop       bool            `json:"loop"`
+	Assets     []MockAssetPath `json:"assets"`
+	Pairs      []MockPairPath  `json:"pairs"`
+}
+
+func LoadMockFeedScript(path string) (*MockFeedScript, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var script MockFeedScript
+	if err := json.NewDecoder(file).Decode(&script); err != nil {
+		return nil, err
+	}
+	if script.IntervalMs <= 0 {
+		script.IntervalMs = 1000
+	}
+	if script.DurationMs <= 0 {
+		paths := make([]PricePath, 0, len(script.Assets)+len(script.Pairs))
+		for _, asset := range script.Assets {
+			paths = append(paths, asset.Path)
+		}
+		for _, pair := range script.Pairs {
+			paths = append(paths, pair.Path)
+		}
+		for _, path := range paths {
+			if n := len(path); n > 0 && path[n-1].At > script.DurationMs {
+				script.DurationMs = path[n-1].At
+			}
+		}
+	}
+	return &script, nil
+}
+
+func (p PricePath) PriceAt(at int64) (float64, bool) {
+	if len(p) == 0 {
+		return 0, false
+	}
+	if at <= p[0].At {
+		return p[0].Price, true
+	}
+	for i := 1; i < len(p); i++ {
+		prev, next := p[i-1], p[i]
+		if at > next.At {
+			continue
+		}
+		if next.At == prev.At {
+			return next.Price, true
+		}
+		progress := float64(at-prev.At) / float64(next.At-prev.At)
+		return prev.Price + (next.Price-prev.Price)*progress, true
+	}
+	return p[len(p)-1].Price, true
+}
+
+// RunMockFeed steps through the script one interval at a time, so the same
+// script always produces the same sequence of prices.
+func RunMockFeed(ctx context.Context, script *MockFeedScript) error {
+	interval := time.Duration(script.IntervalMs) * time.Millisecond
+	for {
+		for at := int64(0); at <= script.DurationMs; at += script.IntervalMs {
+			for _, asset := range script.Assets {
+				if price, ok := asset.Path.PriceAt(at); ok {
+					store.Update(asset.CoinmarketcapAssetID, price)
+				}
+			}
+			for _, pair := range script.Pairs {
+				if rate, ok := pair.Path.PriceAt(at); ok {
+					store.UpdatePair(pair.IDFrom, pair.IDTo, rate)
+				}
+			}
+			if !sleepScaled(ctx, interval, script.Speed) {
+				return ctx.Err()
+			}
+		}
+		if !script.Loop {
+			return nil
+		}
+	}
+}
+
+// StartPriceFeed runs the price source selected in the config until ctx is
+// cancelled or a finite source runs out.
+func StartPriceFeed(ctx context.Context) {
+	feed := config.PriceFeed
+	switch feed.Source {
+	case FeedSourceReplay:
+		LogActivity("Replaying price feed from %s at %gx", feed.ReplayFile, feed.ReplaySpeed)
+		if err := ReplayFeed(ctx, feed.ReplayFile, feed.ReplaySpeed, feed.ReplayLoop); err != nil && ctx.Err() == nil {
+			LogError("Price feed replay failed: %s", err.Error())
+		}
+	case FeedSourceMock:
+		script, err := LoadMockFeedScript(feed.MockFile)
+		if err != nil {
+			LogError("Failed to load mock price feed: %s", err.Error())
+			return
+		}
+		LogActivity("Running mock price feed from %s", feed.MockFile)
+		if err := RunMockFeed(ctx, script); err != nil && ctx.Err() == nil {
+			LogError("Mock price feed failed: %s", err.Error())
+		}
+	default:
+		var capture *FeedRecorder
+		if feed.CaptureFile != "" {
+			var err error
+			capture, err = NewFeedRecorder(feed.CaptureFile)
+			if err != nil {
+				LogError("Price feed capture disabled: %s", err.Error())
+			} else {
+				defer capture.Close()
+			}
+		}
+		ConnectWebSocket(ctx, capture)
+	}
+}
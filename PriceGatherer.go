@@ -5,21 +5,34 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"math/big"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"teProj/cryptoManager"
 	"time"
 )
 
 type PriceStore struct {
 	sync.RWMutex
 	prices         map[int]float64
+	priceUpdated   map[int]time.Time
 	cmcToInternal  map[int]int
 	internalToCmc  map[int]int
 	assetNames     map[int]string
+	precisions     map[int]int
 	conversionFees map[string]float64
-	minAmounts     map[string]float64
+	minAmounts     map[string]cryptoManager.Amount
+	fiatPrices     map[string]float64
+	cmcToFiat      map[int]string
+	fiatSigns      map[string]string
+	fixedPrices    map[int]float64
+	pegs           map[int]PricePeg
+	fixedRates     map[string]float64
+	pairRates      map[string]float64
+	pairUpdated    map[string]time.Time
+	suspended      map[string]bool
 }
 
 var store *PriceStore
@@ -27,23 +40,50 @@ var store *PriceStore
 func NewPriceStore(config *Config) *PriceStore {
 	store := &PriceStore{
 		prices:         make(map[int]float64),
+		priceUpdated:   make(map[int]time.Time),
 		cmcToInternal:  make(map[int]int),
 		internalToCmc:  make(map[int]int),
 		assetNames:     make(map[int]string),
+		precisions:     make(map[int]int),
 		conversionFees: make(map[string]float64),
-		minAmounts:     make(map[string]float64),
+		minAmounts:     make(map[string]cryptoManager.Amount),
+		fiatPrices:     map[string]float64{"USD": 1},
+		cmcToFiat:      make(map[int]string),
+		fiatSigns:      map[string]string{"USD": "$"},
+		fixedPrices:    make(map[int]float64),
+		pegs:           make(map[int]PricePeg),
+		fixedRates:     make(map[string]float64),
+		pairRates:      make(map[string]float64),
+		pairUpdated:    make(map[string]time.Time),
+		suspended:      make(map[string]bool),
 	}
 
 	for _, crypto := range config.SupportedCryptos {
 		store.cmcToInternal[crypto.CoinmarketcapAssetID] = crypto.InternalAssetID
 		store.internalToCmc[crypto.InternalAssetID] = crypto.CoinmarketcapAssetID
 		store.assetNames[crypto.InternalAssetID] = crypto.AssetName
+		store.precisions[crypto.InternalAssetID] = crypto.Precision
+		if crypto.FixedPrice > 0 {
+			store.fixedPrices[crypto.InternalAssetID] = crypto.FixedPrice
+		} else if crypto.Peg != nil {
+			store.pegs[crypto.InternalAssetID] = *crypto.Peg
+		}
+	}
+
+	for _, fiat := range config.FiatCurrencies {
+		store.fiatSigns[fiat.Code] = fiat.Sign
+		if fiat.Code != "USD" {
+			store.cmcToFiat[fiat.CoinmarketcapAssetID] = fiat.Code
+		}
 	}
 
 	for _, route := range config.Routes {
 		key := fmt.Sprintf("%d-%d", route.Pair.IDFrom, route.Pair.IDTo)
 		store.conversionFees[key] = route.Fee
-		store.minAmounts[key] = route.MinAmount
+		store.minAmounts[key] = cryptoManager.AmountFromFloat(route.MinAmount, store.precisions[route.Pair.IDFrom])
+		if route.FixedRate > 0 {
+			store.fixedRates[key] = route.FixedRate
+		}
 	}
 
 	return store
@@ -54,16 +94,127 @@ func (ps *PriceStore) Update(cmcID int, price float64) {
 	defer ps.Unlock()
 	if internalID, exists := ps.cmcToInternal[cmcID]; exists {
 		ps.prices[internalID] = price
+		ps.priceUpdated[internalID] = time.Now()
+	}
+	if code, exists := ps.cmcToFiat[cmcID]; exists {
+		ps.fiatPrices[code] = price
+	}
+}
+
+// maxPegDepth bounds how many pegs are followed, so a peg cycle in the
+// config fails instead of recursing forever.
+const maxPegDepth = 8
+
+func (ps *PriceStore) resolve(internalID, depth int) (float64, bool) {
+	if price, ok := ps.fixedPrices[internalID]; ok {
+		return price, true
+	}
+	if peg, ok := ps.pegs[internalID]; ok {
+		if depth >= maxPegDepth {
+			return 0, false
+		}
+		price, ok := ps.resolve(peg.AssetID, depth+1)
+		return price * peg.Multiplier, ok
 	}
+	price, ok := ps.prices[internalID]
+	return price, ok
 }
 
+// Get returns the USD price of the asset, resolving fixed prices and pegs
+// before falling back to the live feed.
 func (ps *PriceStore) Get(internalID int) (float64, bool) {
 	ps.RLock()
 	defer ps.RUnlock()
-	price, ok := ps.prices[internalID]
+	return ps.resolve(internalID, 0)
+}
+
+// PriceUpdated returns when the live price behind the asset was last
+// updated, following pegs. Fixed prices never go stale and report ok false.
+func (ps *PriceStore) PriceUpdated(internalID int) (time.Time, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+	for depth := 0; depth < maxPegDepth; depth++ {
+		if _, ok := ps.fixedPrices[internalID]; ok {
+			return time.Time{}, false
+		}
+		peg, ok := ps.pegs[internalID]
+		if !ok {
+			return ps.priceUpdated[internalID], true
+		}
+		internalID = peg.AssetID
+	}
+	return time.Time{}, true
+}
+
+// UpdatePair records a direct quote for a pair from a source that provides
+// one, used only to cross-check the USD triangulated rate.
+func (ps *PriceStore) UpdatePair(fromID, toID int, rate float64) {
+	ps.Lock()
+	defer ps.Unlock()
+	key := fmt.Sprintf("%d-%d", fromID, toID)
+	ps.pairRates[key] = rate
+	ps.pairUpdated[key] = time.Now()
+}
+
+// GetPair returns the direct quote for a pair and when it was received.
+func (ps *PriceStore) GetPair(fromID, toID int) (float64, time.Time, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+	key := fmt.Sprintf("%d-%d", fromID, toID)
+	rate, ok := ps.pairRates[key]
+	return rate, ps.pairUpdated[key], ok
+}
+
+func (ps *PriceStore) SetRouteSuspended(fromID, toID int, suspended bool) {
+	ps.Lock()
+	defer ps.Unlock()
+	key := fmt.Sprintf("%d-%d", fromID, toID)
+	if suspended {
+		ps.suspended[key] = true
+	} else {
+		delete(ps.suspended, key)
+	}
+}
+
+// RouteAvailable reports whether the route exists and has not been suspended
+// by the cross rate check.
+func (ps *PriceStore) RouteAvailable(fromID, toID int) bool {
+	ps.RLock()
+	defer ps.RUnlock()
+	key := fmt.Sprintf("%d-%d", fromID, toID)
+	_, ok := ps.conversionFees[key]
+	return ok && !ps.suspended[key]
+}
+
+func (ps *PriceStore) GetFixedRate(fromID, toID int) (float64, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+	rate, ok := ps.fixedRates[fmt.Sprintf("%d-%d", fromID, toID)]
+	return rate, ok
+}
+
+// GetFiat returns the USD price of one unit of the fiat currency.
+func (ps *PriceStore) GetFiat(code string) (float64, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+	price, ok := ps.fiatPrices[code]
 	return price, ok
 }
 
+func (ps *PriceStore) FiatSign(code string) string {
+	ps.RLock()
+	defer ps.RUnlock()
+	return ps.fiatSigns[code]
+}
+
+// Precision returns the number of decimals of the asset's atomic unit.
+func (ps *PriceStore) Precision(internalID int) (int, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+	precision, ok := ps.precisions[internalID]
+	return precision, ok
+}
+
 func (ps *PriceStore) GetFee(fromID, toID int) (float64, bool) {
 	ps.RLock()
 	defer ps.RUnlock()
@@ -71,7 +222,24 @@ func (ps *PriceStore) GetFee(fromID, toID int) (float64, bool) {
 	return fee, ok
 }
 
-func ConnectWebSocket(ctx context.Context) {
+func handleFeedMessage(message []byte) {
+	var response struct {
+		Data struct {
+			ID int     `json:"id"`
+			P  float64 `json:"p"`
+		} `json:"d"`
+	}
+
+	if err := json.Unmarshal(message, &response); err != nil {
+		//log.Println("JSON parse error:", err)
+		return
+	}
+
+	store.Update(response.Data.ID, response.Data.P)
+	//log.Printf("Updated price for %d: $%.2f", response.Data.ID, response.Data.P)
+}
+
+func ConnectWebSocket(ctx context.Context, capture *FeedRecorder) {
 	var conn *websocket.Conn
 	var err error
 	dialer := websocket.DefaultDialer
@@ -89,8 +257,16 @@ func ConnectWebSocket(ctx context.Context) {
 
 	var cmcIDs []string
 	for _, crypto := range config.SupportedCryptos {
+		if crypto.CoinmarketcapAssetID <= 0 {
+			continue
+		}
 		cmcIDs = append(cmcIDs, strconv.Itoa(crypto.CoinmarketcapAssetID))
 	}
+	for _, fiat := range config.FiatCurrencies {
+		if fiat.Code != "USD" {
+			cmcIDs = append(cmcIDs, strconv.Itoa(fiat.CoinmarketcapAssetID))
+		}
+	}
 	subscriptionIDs := strings.Join(cmcIDs, ",")
 
 marker:
@@ -127,50 +303,69 @@ marker:
 					//log.Println("Read error:", err)
 					goto marker
 				}
-
-				var response struct {
-					Data struct {
-						ID int     `json:"id"`
-						P  float64 `json:"p"`
-					} `json:"d"`
-				}
-
-				if err := json.Unmarshal(message, &response); err != nil {
-					//log.Println("JSON parse error:", err)
-					continue
+				if capture != nil {
+					capture.Record(message)
 				}
-
-				store.Update(response.Data.ID, response.Data.P)
-				//log.Printf("Updated price for %d: $%.2f", response.Data.ID, response.Data.P)
+				handleFeedMessage(message)
 			}
 
 		}
 	}
 }
 
-func Convert(store *PriceStore, fromID, toID int, amount float64) (float64, error) {
-	fromPrice, ok := store.Get(fromID)
+// ConvertAtRate converts amount at rate, given in whole units of toID per
+// whole unit of fromID, rounding down to the nearest atomic unit of toID.
+func ConvertAtRate(store *PriceStore, fromID, toID int, amount cryptoManager.Amount, rate *big.Rat) (cryptoManager.Amount, error) {
+	fromPrecision, ok := store.Precision(fromID)
 	if !ok {
-		return 0, fmt.Errorf("price not available for %s", store.assetNames[fromID])
+		return cryptoManager.Amount{}, fmt.Errorf("unknown asset %d", fromID)
 	}
-
-	toPrice, ok := store.Get(toID)
+	toPrecision, ok := store.Precision(toID)
 	if !ok {
-		return 0, fmt.Errorf("price not available for %s", store.assetNames[toID])
+		return cryptoManager.Amount{}, fmt.Errorf("unknown asset %d", toID)
+	}
+	return amount.Rescale(fromPrecision, toPrecision).MulRat(rate), nil
+}
+
+func ratFromFloat(value float64) *big.Rat {
+	rat := new(big.Rat)
+	if rat.SetFloat64(value) == nil {
+		return new(big.Rat)
 	}
+	return rat
+}
 
+func Convert(store *PriceStore, fromID, toID int, amount cryptoManager.Amount) (cryptoManager.Amount, error) {
 	fee, ok := store.GetFee(fromID, toID)
 	if !ok {
-		return 0, fmt.Errorf("conversion fee not found for %s to %s",
+		return cryptoManager.Amount{}, fmt.Errorf("conversion fee not found for %s to %s",
 			store.assetNames[fromID], store.assetNames[toID])
 	}
+	afterFee := ratFromFloat(1 - fee)
 
-	usdValue := amount * fromPrice
-	usdValueAfterFee := usdValue * (1 - fee)
-	return usdValueAfterFee / toPrice, nil
+	if rate, ok := store.GetFixedRate(fromID, toID); ok {
+		return ConvertAtRate(store, fromID, toID, amount, afterFee.Mul(afterFee, ratFromFloat(rate)))
+	}
+
+	fromPrice, ok := store.Get(fromID)
+	if !ok {
+		return cryptoManager.Amount{}, fmt.Errorf("price not available for %s", store.assetNames[fromID])
+	}
+
+	toPrice, ok := store.Get(toID)
+	if !ok || toPrice == 0 {
+		return cryptoManager.Amount{}, fmt.Errorf("price not available for %s", store.assetNames[toID])
+	}
+
+	rate := new(big.Rat).Quo(ratFromFloat(fromPrice), ratFromFloat(toPrice))
+	return ConvertAtRate(store, fromID, toID, amount, rate.Mul(rate, afterFee))
 }
 
 func ConvertWithoutFee(store *PriceStore, fromID, toID int, amount float64) (float64, error) {
+	if rate, ok := store.GetFixedRate(fromID, toID); ok {
+		return amount * rate, nil
+	}
+
 	fromPrice, ok := store.Get(fromID)
 	if !ok {
 		return 0, fmt.Errorf("price not available for %s", store.assetNames[fromID])
@@ -183,3 +378,16 @@ func ConvertWithoutFee(store *PriceStore, fromID, toID int, amount float64) (flo
 	usdValue := amount * fromPrice
 	return usdValue / toPrice, nil
 }
+
+func ConvertToFiat(store *PriceStore, assetID int, amount cryptoManager.Amount, code string) (float64, error) {
+	price, ok := store.Get(assetID)
+	if !ok {
+		return 0, fmt.Errorf("price not available for %s", store.assetNames[assetID])
+	}
+
+	fiatPrice, ok := store.GetFiat(code)
+	if !ok || fiatPrice == 0 {
+		return 0, fmt.Errorf("price not available for %s", code)
+	}
+	return amount.Float64(store.precisions[assetID]) * price / fiatPrice, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"teProj/cryptoManager"
+	"time"
+)
+
+const defaultQuoteValidity = 60
+const defaultQuoteDeviation = 0.01
+
+var (
+	usedQuotes      = make(map[string]int64)
+	usedQuotesMutex sync.Mutex
+)
+
+type Quote struct {
+	FromID  int                  `json:"from"`
+	ToID    int                  `json:"to"`
+	Amount  cryptoManager.Amount `json:"amount"`
+	Rate    float64              `json:"rate"`
+	Fee     float64              `json:"fee"`
+	Expires int64                `json:"exp"`
+}
+
+func quoteValidity() time.Duration {
+	if config.Quotes.ValiditySeconds <= 0 {
+		return defaultQuoteValidity * time.Second
+	}
+	return time.Duration(config.Quotes.ValiditySeconds) * time.Second
+}
+
+func quoteMaxDeviation() float64 {
+	if config.Quotes.MaxDeviation <= 0 {
+		return defaultQuoteDeviation
+	}
+	return config.Quotes.MaxDeviation
+}
+
+func signQuote(payload string) string {
+	mac := hmac.New(sha256.New, []byte(config.Quotes.SigningKey))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueQuote prices amount on the given route at the current rate and returns
+// the quote together with a signed token the customer can hand back to
+// MakeSession to lock that rate in.
+func IssueQuote(store *PriceStore, fromID, toID int, amount cryptoManager.Amount) (*Quote, string, error) {
+	fee, ok := store.GetFee(fromID, toID)
+	if !ok || !store.RouteAvailable(fromID, toID) {
+		return nil, "", fmt.Errorf("route unavailable")
+	}
+	rate, err := ConvertWithoutFee(store, fromID, toID, 1)
+	if err != nil {
+		return nil, "", err
+	}
+	quote := &Quote{
+		FromID:  fromID,
+		ToID:    toID,
+		Amount:  amount,
+		Rate:    rate,
+		Fee:     fee,
+		Expires: time.Now().Add(quoteValidity()).Unix(),
+	}
+	body, err := json.Marshal(quote)
+	if err != nil {
+		return nil, "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(body)
+	return quote, payload + "." + signQuote(payload), nil
+}
+
+// ParseQuote checks the token signature and expiry and returns the quote it
+// carries.
+func ParseQuote(token string) (*Quote, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, fmt.Errorf("malformed quote")
+	}
+	if !hmac.Equal([]byte(signature), []byte(signQuote(payload))) {
+		return nil, fmt.Errorf("invalid quote signature")
+	}
+	body, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed quote")
+	}
+	var quote Quote
+	if err := json.Unmarshal(body, &quote); err != nil {
+		return nil, fmt.Errorf("malformed quote")
+	}
+	if time.Now().Unix() > quote.Expires {
+		return nil, fmt.Errorf("quote expired")
+	}
+	return &quote, nil
+}
+
+// CheckQuote verifies that the quote was issued for this order and that the
+// live rate has not moved further than the configured deviation since.
+func CheckQuote(store *PriceStore, quote *Quote, fromID, toID int, amount cryptoManager.Amount) error {
+	if quote.FromID != fromID || quote.ToID != toID || quote.Amount.Cmp(amount) != 0 {
+		return fmt.Errorf("quote does not match order")
+	}
+	return quote.checkDeviation(store)
+}
+
+func (q *Quote) checkDeviation(store *PriceStore) error {
+	liveRate, err := ConvertWithoutFee(store, q.FromID, q.ToID, 1)
+	if err != nil {
+		return err
+	}
+	if math.Abs(liveRate-q.Rate)/q.Rate > quoteMaxDeviation() {
+		return fmt.Errorf("price moved since quote, please recalculate")
+	}
+	return nil
+}
+
+// Apply converts amount at the quoted rate and fee.
+func (q *Quote) Apply(store *PriceStore, amount cryptoManager.Amount) (cryptoManager.Amount, error) {
+	rate := ratFromFloat(q.Rate)
+	return ConvertAtRate(store, q.FromID, q.ToID, amount, rate.Mul(rate, ratFromFloat(1-q.Fee)))
+}
+
+// Price converts a deposit received at the given time. The quoted rate
+// covers at most the quoted amount, anything above it is converted at the
+// live rate. A deposit received after the quote expired keeps the quoted rate
+// only while the live rate is still within the allowed deviation of it.
+func (q *Quote) Price(store *PriceStore, amount cryptoManager.Amount, received time.Time) (cryptoManager.Amount, error) {
+	if received.Unix() > q.Expires && q.checkDeviation(store) != nil {
+		return Convert(store, q.FromID, q.ToID, amount)
+	}
+	quoted := amount
+	if quoted.Cmp(q.Amount) > 0 {
+		quoted = q.Amount
+	}
+	receiveAmount, err := q.Apply(store, quoted)
+	if err != nil {
+		return cryptoManager.Amount{}, err
+	}
+	if excess := amount.Sub(quoted); excess.Sign() > 0 {
+		excessAmount, err := Convert(store, q.FromID, q.ToID, excess)
+		if err != nil {
+			return cryptoManager.Amount{}, err
+		}
+		receiveAmount = receiveAmount.Add(excessAmount)
+	}
+	return receiveAmount, nil
+}
+
+// claimQuote marks a quote token as used, a token opens at most one order.
+// Tokens are remembered until their quote expires, ParseQuote rejects them
+// after that.
+func claimQuote(token string, quote *Quote) error {
+	usedQuotesMutex.Lock()
+	defer usedQuotesMutex.Unlock()
+	now := time.Now().Unix()
+	for used, expires := range usedQuotes {
+		if now > expires {
+			delete(usedQuotes, used)
+		}
+	}
+	if _, ok := usedQuotes[token]; ok {
+		return fmt.Errorf("quote already used")
+	}
+	usedQuotes[token] = quote.Expires
+	return nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"teProj/cryptoManager"
+	"time"
+)
+
+const defaultReserveInterval = 900
+
+const pendingSweepTimeout = 24 * time.Hour
+
+// ReservePolicy keeps the hot wallet of an asset between Target and Ceiling,
+// in whole coins. Both count what is left after the payouts of open orders.
+// Above Ceiling the excess down to Target is sent to ColdAddress, which is
+// watch-only for the exchange and may be given as "env:" or "file:". Below Target a refill from ColdAddress is
+// requested from the operator.
+type ReservePolicy struct {
+	Target      string `json:"target"`
+	Ceiling     string `json:"ceiling"`
+	ColdAddress string `json:"coldAddress"`
+}
+
+// RefillRequest asks the operator to move Amount from cold storage to the
+// hot wallet. Unsigned is the transaction to sign offline when the handler
+// can build one, otherwise the operator pays Address.
+type RefillRequest struct {
+	AssetID  int
+	Amount   cryptoManager.Amount
+	Address  string
+	Unsigned string
+	Raised   time.Time
+}
+
+// ReserveStatus is the state of one hot wallet after a reserve check.
+type ReserveStatus struct {
+	AssetID  int
+	Balance  cryptoManager.Amount
+	Reserved cryptoManager.Amount
+	Target   cryptoManager.Amount
+	Ceiling  cryptoManager.Amount
+	Swept    []string
+	Sweep    *PendingSweep
+	Refill   *RefillRequest
+	Err      error
+}
+
+// PendingSweep is a sweep to cold storage from a hot wallet signed
+// offline. Its inputs stay locked until the signed PSBT is imported, or
+// until it is abandoned after pendingSweepTimeout or once the wallet is no
+// longer above its ceiling.
+type PendingSweep struct {
+	AssetID  int
+	Amount   cryptoManager.Amount
+	Unsigned string
+	Raised   time.Time
+}
+
+var (
+	pendingSweeps       = make(map[int]*PendingSweep)
+	refillRequests      = make(map[int]*RefillRequest)
+	refillRequestsMutex sync.Mutex
+)
+
+// reservedForOrders sums the payouts of open orders to asset that have not
+// been sent or are not mined yet, and the deposits being refunded in asset.
+// A sent transaction may already be out of the balance, counting it twice
+// only holds back a sweep.
+func reservedForOrders(assetID int) cryptoManager.Amount {
+	sessionsMutex.RLock()
+	defer sessionsMutex.RUnlock()
+	reserved := cryptoManager.NewAmount(0)
+	for _, session := range Sessions {
+		if session.FromCurrencyID == assetID && session.refunding && !mined(session.Refunds) {
+			reserved = reserved.Add(session.FromTransaction.Amount)
+		}
+		if session.ToCurrencyID != assetID || session.refunding {
+			continue
+		}
+		switch session.Status {
+		case "AWAITING INPUT", "CONFIRMING INPUT", "EXCHANGING", "AWAITING SIGNATURE":
+			reserved = reserved.Add(session.ReceiveAmount)
+		case "CONFIRMING OUTPUT":
+			if !mined(session.ToTransactions) {
+				reserved = reserved.Add(session.ReceiveAmount)
+			}
+		}
+	}
+	return reserved
+}
+
+func mined(transactions []cryptoManager.CryptoTransaction) bool {
+	if len(transactions) == 0 {
+		return false
+	}
+	for _, transaction := range transactions {
+		if transaction.Confirmations < 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckReserves sweeps hot wallets above their ceiling to cold storage and
+// raises refill requests for those below their target.
+func CheckReserves(ctx context.Context) []ReserveStatus {
+	var statuses []ReserveStatus
+	for _, crypto := range config.SupportedCryptos {
+		if crypto.Reserve == nil {
+			continue
+		}
+		handler, ok := handlers[int64(crypto.InternalAssetID)]
+		if !ok {
+			continue
+		}
+		status := checkReserve(ctx, crypto, handler)
+		if status.Err != nil {
+			LogError("Reserve check of %s failed: %v", crypto.AssetName, status.Err)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func checkReserve(ctx context.Context, crypto CryptoCurrency, handler cryptoManager.CryptoHandler) ReserveStatus {
+	policy := crypto.Reserve
+	status := ReserveStatus{AssetID: crypto.InternalAssetID}
+	var err error
+	if status.Target, err = cryptoManager.ParseAmount(policy.Target, crypto.Precision); err != nil {
+		status.Err = fmt.Errorf("invalid reserve target: %v", err)
+		return status
+	}
+	if status.Ceiling, err = cryptoManager.ParseAmount(policy.Ceiling, crypto.Precision); err != nil {
+		status.Err = fmt.Errorf("invalid reserve ceiling: %v", err)
+		return status
+	}
+	if status.Ceiling.Cmp(status.Target) < 0 {
+		status.Err = fmt.Errorf("reserve ceiling below target")
+		return status
+	}
+	coldAddress, err := cryptoManager.ResolveSecret(policy.ColdAddress)
+	if err != nil {
+		status.Err = fmt.Errorf("invalid cold address: %v", err)
+		return status
+	}
+	if validator, ok := handler.(cryptoManager.AddressValidator); ok {
+		if err := validator.ValidateAddress(coldAddress); err != nil {
+			status.Err = fmt.Errorf("invalid cold address: %v", err)
+			return status
+		}
+	}
+
+	// Reserved is taken before the balance, a payout or refund sent in
+	// between is then counted twice rather than not at all. Sends are not
+	// locked out, batched payouts wait for their window inside Send.
+	status.Reserved = reservedForOrders(crypto.InternalAssetID)
+	status.Balance, err = handler.CheckBalance(ctx)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	available := status.Balance.Sub(status.Reserved)
+
+	signer, offline := handler.(cryptoManager.OfflineSigner)
+	offline = offline && signer.OfflineSigning()
+	refillRequestsMutex.Lock()
+	defer refillRequestsMutex.Unlock()
+	switch {
+	case available.Cmp(status.Ceiling) > 0:
+		delete(refillRequests, crypto.InternalAssetID)
+		excess := available.Sub(status.Target)
+		if offline {
+			status.Sweep, status.Err = prepareSweep(ctx, signer, crypto, coldAddress, excess)
+			return status
+		}
+		status.Swept, err = handler.Send(ctx, cryptoManager.CryptoAddress{Address: coldAddress}, excess)
+		if err != nil {
+			status.Err = fmt.Errorf("sweep to cold storage failed: %v", err)
+			return status
+		}
+		LogActivity("Swept %s %s above the hot wallet ceiling to cold storage [%v]", formatCryptoValue(excess, crypto.InternalAssetID), crypto.AssetSign, status.Swept)
+	case available.Cmp(status.Target) < 0:
+		if offline {
+			dropPendingSweep(ctx, signer, crypto.InternalAssetID)
+		}
+		if request, ok := refillRequests[crypto.InternalAssetID]; ok {
+			status.Refill = request
+			return status
+		}
+		request, err := newRefillRequest(ctx, handler, crypto.InternalAssetID, coldAddress, status.Target.Sub(available))
+		if err != nil {
+			status.Err = fmt.Errorf("unable to prepare refill: %v", err)
+			return status
+		}
+		refillRequests[crypto.InternalAssetID] = request
+		status.Refill = request
+		instruction := "pay " + request.Address
+		if request.Unsigned != "" {
+			instruction = "sign and send " + request.Unsigned
+		}
+		LogAlert("Hot wallet of %s below target: balance %s, reserved for orders %s, refill %s %s from cold storage, %s",
+			crypto.AssetName, formatCryptoValue(status.Balance, crypto.InternalAssetID), formatCryptoValue(status.Reserved, crypto.InternalAssetID),
+			formatCryptoValue(request.Amount, crypto.InternalAssetID), crypto.AssetSign, instruction)
+	default:
+		delete(refillRequests, crypto.InternalAssetID)
+		if offline {
+			dropPendingSweep(ctx, signer, crypto.InternalAssetID)
+		}
+	}
+	return status
+}
+
+// prepareSweep prepares the sweep of a hot wallet signed offline, unless
+// one is still waiting for its signature.
+func prepareSweep(ctx context.Context, signer cryptoManager.OfflineSigner, crypto CryptoCurrency, coldAddress string, amount cryptoManager.Amount) (*PendingSweep, error) {
+	if sweep, ok := pendingSweeps[crypto.InternalAssetID]; ok {
+		if time.Since(sweep.Raised) < pendingSweepTimeout {
+			return sweep, nil
+		}
+		dropPendingSweep(ctx, signer, crypto.InternalAssetID)
+	}
+	unsigned, err := signer.PreparePayout(ctx, cryptoManager.CryptoAddress{Address: coldAddress}, amount)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare sweep to cold storage: %v", err)
+	}
+	sweep := &PendingSweep{
+		AssetID:  crypto.InternalAssetID,
+		Amount:   amount,
+		Unsigned: unsigned,
+		Raised:   time.Now(),
+	}
+	pendingSweeps[crypto.InternalAssetID] = sweep
+	LogAlert("Sweep of %s %s above the hot wallet ceiling to cold storage awaits an offline signature, sign and import with importsweep %d: %s",
+		formatCryptoValue(amount, crypto.InternalAssetID), crypto.AssetSign, crypto.InternalAssetID, unsigned)
+	return sweep, nil
+}
+
+// dropPendingSweep abandons the pending sweep of an asset and releases its
+// inputs for payouts.
+func dropPendingSweep(ctx context.Context, signer cryptoManager.OfflineSigner, assetID int) {
+	sweep, ok := pendingSweeps[assetID]
+	if !ok {
+		return
+	}
+	delete(pendingSweeps, assetID)
+	if err := signer.ReleasePayout(ctx, sweep.Unsigned); err != nil {
+		LogError("Unable to release the inputs of the abandoned sweep of asset %d: %v", assetID, err)
+		return
+	}
+	LogActivity("Sweep of %s of asset %d to cold storage abandoned unsigned", formatCryptoValue(sweep.Amount, assetID), assetID)
+}
+
+// ImportSignedSweep broadcasts the signed PSBT of the pending sweep of an
+// asset.
+func ImportSignedSweep(assetID int, signed string) ([]string, error) {
+	refillRequestsMutex.Lock()
+	defer refillRequestsMutex.Unlock()
+	sweep, ok := pendingSweeps[assetID]
+	if !ok {
+		return nil, fmt.Errorf("no sweep awaiting a signature")
+	}
+	signer, ok := handlers[int64(assetID)].(cryptoManager.OfflineSigner)
+	if !ok {
+		return nil, fmt.Errorf("handler does not sign offline")
+	}
+	txids, err := signer.FinalizePayout(appContext, sweep.Unsigned, signed)
+	if err != nil {
+		return nil, err
+	}
+	delete(pendingSweeps, assetID)
+	LogActivity("Swept %s above the hot wallet ceiling of asset %d to cold storage [%v]", formatCryptoValue(sweep.Amount, assetID), assetID, txids)
+	return txids, nil
+}
+
+// newRefillRequest prepares the transfer from cold storage. Handlers that
+// cannot build it get an address, or an invoice, to pay instead.
+func newRefillRequest(ctx context.Context, handler cryptoManager.CryptoHandler, assetID int, coldAddress string, amount cryptoManager.Amount) (*RefillRequest, error) {
+	request := &RefillRequest{
+		AssetID: assetID,
+		Amount:  amount,
+		Raised:  time.Now(),
+	}
+	if builder, ok := handler.(cryptoManager.RefillBuilder); ok {
+		unsigned, err := builder.BuildRefill(ctx, coldAddress, amount)
+		if err != nil {
+			return nil, err
+		}
+		request.Unsigned = unsigned
+		return request, nil
+	}
+	var address cryptoManager.CryptoAddress
+	var err error
+	if issuer, ok := handler.(cryptoManager.InvoiceIssuer); ok {
+		address, err = issuer.NewInvoice(ctx, amount, "Hot wallet refill")
+	} else {
+		address, err = handler.GenerateNewAddress(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	request.Address = address.Address
+	return request, nil
+}
+
+func RunReserveManager(ctx context.Context) {
+	interval := time.Duration(config.Reserve.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultReserveInterval * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			CheckReserves(ctx)
+		}
+	}
+}
+
+func printReserves(statuses []ReserveStatus) {
+	if len(statuses) == 0 {
+		fmt.Println("No reserve policies configured")
+		return
+	}
+	for _, status := range statuses {
+		id := status.AssetID
+		if status.Err != nil {
+			fmt.Printf("Asset %d: %v\n", id, status.Err)
+			continue
+		}
+		fmt.Printf("Asset %d: balance %s, reserved for orders %s, target %s, ceiling %s\n", id,
+			formatCryptoValue(status.Balance, id), formatCryptoValue(status.Reserved, id),
+			formatCryptoValue(status.Target, id), formatCryptoValue(status.Ceiling, id))
+		if len(status.Swept) > 0 {
+			fmt.Printf("  swept to cold storage [%v]\n", status.Swept)
+		}
+		if status.Sweep != nil {
+			fmt.Printf("  sweep of %s to cold storage awaits a signature since %s\n", formatCryptoValue(status.Sweep.Amount, id), status.Sweep.Raised.Format(time.RFC3339))
+			fmt.Printf("  unsigned transaction: %s\n", status.Sweep.Unsigned)
+		}
+		if status.Refill != nil {
+			fmt.Printf("  refill of %s requested %s\n", formatCryptoValue(status.Refill.Amount, id), status.Refill.Raised.Format(time.RFC3339))
+			if status.Refill.Unsigned != "" {
+				fmt.Printf("  unsigned transaction: %s\n", status.Refill.Unsigned)
+			} else {
+				fmt.Printf("  pay to: %s\n", status.Refill.Address)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"teProj/cryptoManager"
+)
+
+const simulateUsage = `Usage:
+  sim deposit <assetID> <address> <amount>
+  sim mine <assetID> <blocks>
+  sim reorg <assetID> <depth> [drop]
+  sim fail <assetID> <method> [count]
+  sim balance <assetID> <amount>`
+
+// simulateCommand drives the simulated chains from the console.
+func simulateCommand(args []string) {
+	if len(args) < 2 {
+		fmt.Println(simulateUsage)
+		return
+	}
+	assetID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		fmt.Println("Invalid asset id:", args[1])
+		return
+	}
+	sim, ok := handlers[assetID].(*cryptoManager.SimHandler)
+	if !ok {
+		fmt.Printf("Asset %d is not simulated\n", assetID)
+		return
+	}
+
+	switch {
+	case args[0] == "deposit" && len(args) == 4:
+		amount, err := cryptoManager.ParseAmount(args[3], sim.Precision())
+		if err != nil {
+			fmt.Println("Invalid amount:", err)
+			return
+		}
+		fmt.Println("Deposited", sim.Deposit(args[2], amount))
+	case args[0] == "mine" && len(args) == 3:
+		blocks, err := strconv.Atoi(args[2])
+		if err != nil {
+			fmt.Println("Invalid block count:", args[2])
+			return
+		}
+		sim.Mine(blocks)
+		fmt.Printf("Mined %d blocks\n", blocks)
+	case args[0] == "reorg" && (len(args) == 3 || len(args) == 4):
+		depth, err := strconv.Atoi(args[2])
+		if err != nil {
+			fmt.Println("Invalid depth:", args[2])
+			return
+		}
+		sim.Reorg(depth, len(args) == 4 && args[3] == "drop")
+		fmt.Printf("Reorganised %d blocks\n", depth)
+	case args[0] == "fail" && (len(args) == 3 || len(args) == 4):
+		count := 1
+		if len(args) == 4 {
+			count, err = strconv.Atoi(args[3])
+			if err != nil {
+				fmt.Println("Invalid count:", args[3])
+				return
+			}
+		}
+		sim.FailNext(args[2], count)
+		fmt.Printf("Next %d %s calls will fail\n", count, args[2])
+	case args[0] == "balance" && len(args) == 3:
+		amount, err := cryptoManager.ParseAmount(args[2], sim.Precision())
+		if err != nil {
+			fmt.Println("Invalid amount:", err)
+			return
+		}
+		sim.SetBalance(amount)
+		fmt.Println("Balance set")
+	default:
+		fmt.Println(simulateUsage)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"teProj/cryptoManager"
+	"time"
+)
+
+const defaultSweepInterval = 600
+
+// SweepAll runs every handler that collects deposits before spending them.
+func SweepAll(ctx context.Context) {
+	for internalID, handler := range handlers {
+		sweeper, ok := handler.(cryptoManager.Sweeper)
+		if !ok {
+			continue
+		}
+		txids, err := sweeper.Sweep(ctx)
+		if len(txids) > 0 {
+			LogActivity("Sweep of asset %d broadcast [%v]", internalID, txids)
+		}
+		if err != nil {
+			LogError("Sweep of asset %d failed: %v", internalID, err)
+		}
+	}
+}
+
+func RunSweeper(ctx context.Context) {
+	interval := time.Duration(config.Sweep.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultSweepInterval * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			SweepAll(ctx)
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package cryptoManager
 
-import "math"
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+)
 
 type CryptoAddress struct {
 	Address   string
 	StartTime int64
+	// Index is the derivation index of addresses from HD wallets.
+	Index uint32
 }
 
 type CryptoTransactionExplorer struct {
@@ -16,19 +23,174 @@ type CryptoTransactionExplorer struct {
 type CryptoTransaction struct {
 	Txid          string
 	Confirmations int64
-	Amount        float64
+	Amount        Amount
 	Explorers     []*CryptoTransactionExplorer
+	Proof         *PaymentProof
+	// OutputIndex is set for payouts sharing a transaction with others.
+	OutputIndex *int64
+	Status      TransactionStatus
+}
+
+// TransactionStatus is where a transaction stands on chain. Handlers report
+// a transaction the node does not know as TxNotFound rather than failing, an
+// error from GetTransactionDetails means the node could not be asked.
+type TransactionStatus string
+
+const (
+	TxPending   TransactionStatus = "pending"
+	TxConfirmed TransactionStatus = "confirmed"
+	// TxConflicted will never confirm, it was double spent, replaced or
+	// reverted.
+	TxConflicted TransactionStatus = "conflicted"
+	// TxNotFound was dropped from the mempool or reorganised out of the
+	// chain, it may come back.
+	TxNotFound TransactionStatus = "not found"
+)
+
+// confirmationStatus is the status of a transaction the node knows.
+func confirmationStatus(confirmations int64) TransactionStatus {
+	switch {
+	case confirmations < 0:
+		return TxConflicted
+	case confirmations == 0:
+		return TxPending
+	default:
+		return TxConfirmed
+	}
+}
+
+// PaymentProof lets a recipient check a payment that block explorers cannot
+// show, such as a Monero output.
+type PaymentProof struct {
+	TxKey   string `json:"txKey"`
+	Proof   string `json:"proof"`
+	Address string `json:"address"`
 }
 
 type CryptoHandler interface {
-	GenerateNewAddress() (CryptoAddress, error)
-	CheckBalance() (float64, error)
-	GetAddressTransaction(address CryptoAddress) (*CryptoTransaction, error)
-	GetTransactionDetails(txid string) (*CryptoTransaction, error)
-	Send(address CryptoAddress, amount float64) ([]string, error)
+	GenerateNewAddress(ctx context.Context) (CryptoAddress, error)
+	CheckBalance(ctx context.Context) (Amount, error)
+	GetAddressTransaction(ctx context.Context, address CryptoAddress) (*CryptoTransaction, error)
+	GetTransactionDetails(ctx context.Context, txid string) (*CryptoTransaction, error)
+	Send(ctx context.Context, address CryptoAddress, amount Amount) ([]string, error)
+}
+
+// jsonInt64 reads an integer from an RPC response decoded with UseNumber.
+func jsonInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, true
+		}
+		f, err := v.Float64()
+		return int64(f), err == nil
+	case float64:
+		return int64(v), true
+	case string:
+		// LND's REST API sends 64 bit integers as strings.
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// jsonAmount reads an amount from an RPC response decoded with UseNumber,
+// keeping the exact decimal digits the node sent. Nodes that report atomic
+// units are read with precision 0.
+func jsonAmount(value interface{}, precision int) (Amount, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		amount, err := ParseAmount(v.String(), precision)
+		return amount, err == nil
+	case float64:
+		amount, err := ParseAmount(strconv.FormatFloat(v, 'f', -1, 64), precision)
+		return amount, err == nil
+	default:
+		return Amount{}, false
+	}
+}
+
+// sleepContext waits for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ProofProvider is implemented by handlers whose payments are private. The
+// proof is for the payment of txid to address.
+type ProofProvider interface {
+	PaymentProof(ctx context.Context, txid string, address CryptoAddress) (*PaymentProof, error)
+}
+
+// Sweeper is implemented by handlers whose deposits have to be collected
+// into a spending account before they can be paid out. Sweep returns the ids
+// of the transactions it broadcast.
+type Sweeper interface {
+	Sweep(ctx context.Context) ([]string, error)
+}
+
+// FeeBumper is implemented by handlers that can replace a stuck payout with
+// one paying a higher fee. BumpAfter is how long a payout may stay
+// unconfirmed before it is bumped, 0 disables bumping.
+type FeeBumper interface {
+	BumpAfter() time.Duration
+	BumpFee(ctx context.Context, txid string) (string, error)
+}
+
+// InvoiceIssuer is implemented by handlers that are paid to invoices rather
+// than addresses. NewInvoice replaces GenerateNewAddress for orders, so the
+// invoice asks for the order's amount.
+type InvoiceIssuer interface {
+	NewInvoice(ctx context.Context, amount Amount, memo string) (CryptoAddress, error)
+}
+
+// InvoiceChecker is implemented by handlers that pay to invoices. It checks
+// an invoice a customer supplied can be paid amount.
+type InvoiceChecker interface {
+	CheckInvoice(ctx context.Context, invoice string, amount Amount) error
+}
+
+// AddressValidator is implemented by handlers that can check an address,
+// including its checksum, before anything is sent to it.
+type AddressValidator interface {
+	ValidateAddress(address string) error
+}
+
+// Rebroadcaster is implemented by handlers that can send a transaction of
+// their wallet to the network again after it was dropped.
+type Rebroadcaster interface {
+	Rebroadcast(ctx context.Context, txid string) error
+}
+
+// RefillBuilder is implemented by handlers that can prepare a transfer of
+// amount from a watch-only cold address to their hot wallet. The result is
+// unsigned and meant for the offline signer, a PSBT for UTXO chains.
+type RefillBuilder interface {
+	BuildRefill(ctx context.Context, cold string, amount Amount) (string, error)
+}
+
+// Refunder is implemented by handlers whose deposits stay on their own
+// address until they are swept. Refund pays the deposit made to the deposit
+// address back without touching funds that belong to other orders.
+type Refunder interface {
+	Refund(ctx context.Context, deposit CryptoAddress, address CryptoAddress, amount Amount) ([]string, error)
 }
 
-func RoundToNDigits(val float64, n int) float64 {
-	pow := math.Pow(10, float64(n))
-	return math.Round(val*pow) / pow
+// OfflineSigner is implemented by handlers whose payouts can be signed
+// outside the node. When OfflineSigning is set, PreparePayout replaces Send
+// and returns an unsigned PSBT, FinalizePayout checks the signed PSBT
+// against it and broadcasts it. ReleasePayout gives the inputs of a PSBT
+// that will not be imported back to the wallet.
+type OfflineSigner interface {
+	OfflineSigning() bool
+	PreparePayout(ctx context.Context, address CryptoAddress, amount Amount) (string, error)
+	FinalizePayout(ctx context.Context, unsigned, signed string) ([]string, error)
+	ReleasePayout(ctx context.Context, unsigned string) error
 }
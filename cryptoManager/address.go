@@ -0,0 +1,363 @@
+package cryptoManager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"strings"
+)
+
+var errAddressChecksum = fmt.Errorf("checksum mismatch, the address is probably mistyped")
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, value := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(value)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+// bech32Decode splits a bech32 or bech32m string into its human readable
+// part and 5 bit data, without the checksum. The checksum constant tells the
+// two encodings apart.
+func bech32Decode(value string, maxLength int) (string, []byte, uint32, error) {
+	if maxLength > 0 && len(value) > maxLength {
+		return "", nil, 0, fmt.Errorf("address too long")
+	}
+	if strings.ToLower(value) != value && strings.ToUpper(value) != value {
+		return "", nil, 0, fmt.Errorf("address mixes upper and lower case")
+	}
+	value = strings.ToLower(value)
+	separator := strings.LastIndexByte(value, '1')
+	if separator < 1 || separator+7 > len(value) {
+		return "", nil, 0, fmt.Errorf("invalid bech32 separator position")
+	}
+	hrp := value[:separator]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, 0, fmt.Errorf("invalid character in address prefix")
+		}
+	}
+	data := make([]byte, 0, len(value)-separator-1)
+	for _, char := range value[separator+1:] {
+		index := strings.IndexRune(bech32Charset, char)
+		if index < 0 {
+			return "", nil, 0, fmt.Errorf("invalid character %q in address", char)
+		}
+		data = append(data, byte(index))
+	}
+	checksum := bech32Polymod(append(bech32HrpExpand(hrp), data...))
+	if checksum != bech32Const && checksum != bech32mConst {
+		return "", nil, 0, errAddressChecksum
+	}
+	return hrp, data[:len(data)-6], checksum, nil
+}
+
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc, bits uint
+	var result []byte
+	maxValue := uint(1)<<to - 1
+	for _, value := range data {
+		acc = acc<<from | uint(value)
+		bits += from
+		for bits >= to {
+			bits -= to
+			result = append(result, byte(acc>>bits&maxValue))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			result = append(result, byte(acc<<(to-bits)&maxValue))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxValue != 0 {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return result, nil
+}
+
+// validateSegwitAddress checks a BIP-173/BIP-350 address: version 0 uses
+// bech32, later versions bech32m.
+func validateSegwitAddress(address, hrp string) error {
+	decodedHrp, data, checksum, err := bech32Decode(address, 90)
+	if err != nil {
+		return err
+	}
+	if decodedHrp != hrp {
+		return fmt.Errorf("address is for another network (%s1...), expected %s1...", decodedHrp, hrp)
+	}
+	if len(data) < 1 {
+		return fmt.Errorf("address has no witness version")
+	}
+	version := data[0]
+	if version > 16 {
+		return fmt.Errorf("invalid witness version %d", version)
+	}
+	program, err := convertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return fmt.Errorf("invalid witness program: %v", err)
+	}
+	if len(program) < 2 || len(program) > 40 {
+		return fmt.Errorf("invalid witness program length %d", len(program))
+	}
+	if version == 0 {
+		if checksum != bech32Const {
+			return fmt.Errorf("version 0 address must use bech32, not bech32m")
+		}
+		if len(program) != 20 && len(program) != 32 {
+			return fmt.Errorf("invalid witness program length %d", len(program))
+		}
+	} else if checksum != bech32mConst {
+		return fmt.Errorf("version %d address must use bech32m, not bech32", version)
+	}
+	return nil
+}
+
+func base58Decode(value string) ([]byte, error) {
+	result := new(big.Int)
+	radix := big.NewInt(58)
+	for _, char := range value {
+		index := strings.IndexRune(base58Alphabet, char)
+		if index < 0 {
+			return nil, fmt.Errorf("invalid character %q in address", char)
+		}
+		result.Mul(result, radix)
+		result.Add(result, big.NewInt(int64(index)))
+	}
+	decoded := result.Bytes()
+	for i := 0; i < len(value) && value[i] == base58Alphabet[0]; i++ {
+		decoded = append([]byte{0}, decoded...)
+	}
+	return decoded, nil
+}
+
+// validateBase58CheckAddress checks a legacy address' checksum and that its
+// version byte is one of versions.
+func validateBase58CheckAddress(address string, versions []byte) error {
+	decoded, err := base58Decode(address)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != 25 {
+		return fmt.Errorf("invalid address length")
+	}
+	first := sha256.Sum256(decoded[:21])
+	second := sha256.Sum256(first[:])
+	if !bytes.Equal(second[:4], decoded[21:]) {
+		return errAddressChecksum
+	}
+	if bytes.IndexByte(versions, decoded[0]) < 0 {
+		return fmt.Errorf("address is for another network or coin (version %d)", decoded[0])
+	}
+	return nil
+}
+
+// validateEthAddress checks the form of an address and, when it is written
+// in mixed case, its EIP-55 checksum.
+func validateEthAddress(address string) error {
+	if !strings.HasPrefix(address, "0x") || len(address) != 42 {
+		return fmt.Errorf("address must be 0x followed by 40 hex digits")
+	}
+	if !common.IsHexAddress(address) {
+		return fmt.Errorf("address contains characters that are not hex digits")
+	}
+	hexPart := address[2:]
+	if strings.ToLower(hexPart) == hexPart || strings.ToUpper(hexPart) == hexPart {
+		return nil
+	}
+	if common.HexToAddress(address).Hex() != address {
+		return errAddressChecksum
+	}
+	return nil
+}
+
+// moneroBlockSizes maps the length of an encoded base58 block to the number
+// of bytes it holds.
+var moneroBlockSizes = map[int]int{2: 1, 3: 2, 5: 3, 6: 4, 7: 5, 9: 6, 10: 7, 11: 8}
+
+// moneroBase58Decode decodes Monero's base58, which encodes 8 byte blocks as
+// 11 characters each.
+func moneroBase58Decode(value string) ([]byte, error) {
+	var decoded []byte
+	for start := 0; start < len(value); start += 11 {
+		end := start + 11
+		if end > len(value) {
+			end = len(value)
+		}
+		size, ok := moneroBlockSizes[end-start]
+		if !ok {
+			return nil, fmt.Errorf("invalid address length")
+		}
+		block := new(big.Int)
+		for _, char := range value[start:end] {
+			index := strings.IndexRune(base58Alphabet, char)
+			if index < 0 {
+				return nil, fmt.Errorf("invalid character %q in address", char)
+			}
+			block.Mul(block, big.NewInt(58))
+			block.Add(block, big.NewInt(int64(index)))
+		}
+		if block.BitLen() > size*8 {
+			return nil, fmt.Errorf("invalid address encoding")
+		}
+		decoded = append(decoded, common.LeftPadBytes(block.Bytes(), size)...)
+	}
+	return decoded, nil
+}
+
+// moneroNetwork holds the address prefixes of a Monero network.
+type moneroNetwork struct {
+	Standard   byte
+	Integrated byte
+	Subaddress byte
+}
+
+var moneroNetworks = map[string]moneroNetwork{
+	"mainnet":  {Standard: 18, Integrated: 19, Subaddress: 42},
+	"stagenet": {Standard: 24, Integrated: 25, Subaddress: 36},
+	"testnet":  {Standard: 53, Integrated: 54, Subaddress: 63},
+}
+
+// validateMoneroAddress checks a standard, integrated or subaddress for the
+// network, including its Keccak checksum.
+func validateMoneroAddress(address string, network moneroNetwork) error {
+	decoded, err := moneroBase58Decode(address)
+	if err != nil {
+		return err
+	}
+	if len(decoded) < 5 {
+		return fmt.Errorf("invalid address length")
+	}
+	payload, checksum := decoded[:len(decoded)-4], decoded[len(decoded)-4:]
+	if !bytes.Equal(crypto.Keccak256(payload)[:4], checksum) {
+		return errAddressChecksum
+	}
+	switch payload[0] {
+	case network.Standard, network.Subaddress:
+		if len(payload) != 65 {
+			return fmt.Errorf("invalid address length")
+		}
+	case network.Integrated:
+		if len(payload) != 73 {
+			return fmt.Errorf("invalid integrated address length")
+		}
+	default:
+		return fmt.Errorf("address is for another network (prefix %d)", payload[0])
+	}
+	return nil
+}
+
+// validateBolt11Invoice checks the bech32 checksum of an invoice and that it
+// is for the network's prefix, e.g. lnbc for Bitcoin mainnet.
+func validateBolt11Invoice(invoice string, prefix string) error {
+	hrp, _, checksum, err := bech32Decode(invoice, 0)
+	if err != nil {
+		return err
+	}
+	if checksum != bech32Const {
+		return errAddressChecksum
+	}
+	// The amount follows the prefix, another network's prefix such as
+	// lnbcrt would leave letters behind.
+	rest, ok := strings.CutPrefix(hrp, prefix)
+	if !ok || (rest != "" && (rest[0] < '0' || rest[0] > '9')) {
+		return fmt.Errorf("invoice is for another network (%s)", hrp)
+	}
+	return nil
+}
+
+func cashAddrPolymod(values []byte) uint64 {
+	generator := [5]uint64{0x98f2bc8e61, 0x79b76d99e2, 0xf33e5fb3c4, 0xae2eabe2a8, 0x1e4f43e470}
+	chk := uint64(1)
+	for _, value := range values {
+		top := chk >> 35
+		chk = (chk&0x07ffffffff)<<5 ^ uint64(value)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk ^ 1
+}
+
+// validateCashAddress checks a Bitcoin Cash cashaddr, with or without its
+// "prefix:" part, including its checksum and that it pays a key or script
+// hash of a valid size.
+func validateCashAddress(address, prefix string) error {
+	if strings.ToLower(address) != address && strings.ToUpper(address) != address {
+		return fmt.Errorf("address mixes upper and lower case")
+	}
+	address = strings.ToLower(address)
+	if addressPrefix, payload, found := strings.Cut(address, ":"); found {
+		if addressPrefix != prefix {
+			return fmt.Errorf("address is for another network (%s:...), expected %s:...", addressPrefix, prefix)
+		}
+		address = payload
+	}
+	if len(address) < 9 {
+		return fmt.Errorf("invalid address length")
+	}
+	data := make([]byte, 0, len(address))
+	for _, char := range address {
+		index := strings.IndexRune(bech32Charset, char)
+		if index < 0 {
+			return fmt.Errorf("invalid character %q in address", char)
+		}
+		data = append(data, byte(index))
+	}
+	values := make([]byte, 0, len(prefix)+1+len(data))
+	for i := 0; i < len(prefix); i++ {
+		values = append(values, prefix[i]&31)
+	}
+	values = append(values, 0)
+	if cashAddrPolymod(append(values, data...)) != 0 {
+		return errAddressChecksum
+	}
+	payload, err := convertBits(data[:len(data)-8], 5, 8, false)
+	if err != nil {
+		return fmt.Errorf("invalid address payload: %v", err)
+	}
+	if len(payload) < 1 {
+		return fmt.Errorf("invalid address length")
+	}
+	version := payload[0]
+	if addressType := version >> 3; addressType != 0 && addressType != 1 {
+		return fmt.Errorf("unsupported address type %d", addressType)
+	}
+	hashSizes := [8]int{20, 24, 28, 32, 40, 48, 56, 64}
+	if len(payload)-1 != hashSizes[version&7] {
+		return fmt.Errorf("invalid address hash length %d", len(payload)-1)
+	}
+	return nil
+}
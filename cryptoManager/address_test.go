@@ -0,0 +1,94 @@
+package cryptoManager
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// cashAddrHash returns the hash carried by a valid cashaddr.
+func cashAddrHash(t *testing.T, address string) []byte {
+	_, payload, _ := strings.Cut(address, ":")
+	data := make([]byte, 0, len(payload))
+	for _, char := range payload {
+		data = append(data, byte(strings.IndexRune(bech32Charset, char)))
+	}
+	decoded, err := convertBits(data[:len(data)-8], 5, 8, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded[1:]
+}
+
+func TestValidateCashAddress(t *testing.T) {
+	// Examples of the cashaddr specification with the legacy address of the
+	// same hash.
+	vectors := []struct {
+		cash   string
+		legacy string
+	}{
+		{"bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a", "1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu"},
+		{"bitcoincash:qr95sy3j9xwd2ap32xkykttr4cvcu7as4y0qverfuy", "1KXrWXciRDZUpQwQmuM1DbwsKDLYAYsVLR"},
+		{"bitcoincash:ppm2qsznhks23z7629mms6s4cwef74vcwvn0h829pq", "3CWFddi6m4ndiGyKqzYvsFYagqDLPVMTzC"},
+	}
+	for _, vector := range vectors {
+		if err := validateCashAddress(vector.cash, "bitcoincash"); err != nil {
+			t.Fatalf("%s: %v", vector.cash, err)
+		}
+		withoutPrefix := strings.TrimPrefix(vector.cash, "bitcoincash:")
+		if err := validateCashAddress(strings.ToUpper(withoutPrefix), "bitcoincash"); err != nil {
+			t.Fatalf("%s: %v", withoutPrefix, err)
+		}
+		legacy, err := base58Decode(vector.legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cashAddrHash(t, vector.cash), legacy[1:21]) {
+			t.Fatalf("%s does not carry the hash of %s", vector.cash, vector.legacy)
+		}
+	}
+
+	invalid := []string{
+		// Last character changed.
+		"bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6q",
+		// Valid address for another network prefix.
+		"bchtest:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a",
+		"bitcoincash:Qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a",
+		"bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6b",
+		"bitcoincash:",
+	}
+	for _, address := range invalid {
+		if err := validateCashAddress(address, "bitcoincash"); err == nil {
+			t.Fatalf("%s accepted", address)
+		}
+	}
+}
+
+func TestUtxoValidateAddress(t *testing.T) {
+	bch := &UtxoHandler{sign: "BCH", cashPrefix: "bitcoincash", versions: []byte{0, 5}}
+	for _, address := range []string{
+		"bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a",
+		"qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a",
+		"1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu",
+	} {
+		if err := bch.ValidateAddress(address); err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+	}
+	if err := bch.ValidateAddress("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"); err == nil {
+		t.Fatal("segwit address accepted for BCH")
+	}
+
+	btc := &UtxoHandler{sign: "BTC", hrp: "bc", versions: []byte{0, 5}}
+	for _, address := range []string{
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		"1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu",
+	} {
+		if err := btc.ValidateAddress(address); err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+	}
+	if err := btc.ValidateAddress("qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a"); err == nil {
+		t.Fatal("cashaddr accepted for BTC")
+	}
+}
@@ -0,0 +1,164 @@
+package cryptoManager
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Amount is an exact quantity of an asset counted in its smallest unit
+// (satoshi, piconero, wei). The zero value is zero. Amounts are immutable,
+// arithmetic always returns a new value.
+type Amount struct {
+	atomic *big.Int
+}
+
+func NewAmount(atomic int64) Amount {
+	return Amount{atomic: big.NewInt(atomic)}
+}
+
+func AmountFromBig(atomic *big.Int) Amount {
+	if atomic == nil {
+		return Amount{}
+	}
+	return Amount{atomic: new(big.Int).Set(atomic)}
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// ParseAmount reads a decimal number of whole coins ("0.015", "1e-8") and
+// returns it in atomic units. It fails rather than rounds when the value has
+// more decimal places than precision allows.
+func ParseAmount(value string, precision int) (Amount, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return Amount{}, fmt.Errorf("empty amount")
+	}
+	rat, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return Amount{}, fmt.Errorf("invalid amount %q", value)
+	}
+	rat.Mul(rat, new(big.Rat).SetInt(pow10(precision)))
+	if !rat.IsInt() {
+		return Amount{}, fmt.Errorf("amount %q has more than %d decimal places", value, precision)
+	}
+	return Amount{atomic: new(big.Int).Set(rat.Num())}, nil
+}
+
+// AmountFromFloat rounds a float to the nearest atomic unit. It is meant for
+// values that are already approximate, such as config limits and prices,
+// never for balances or transaction amounts.
+func AmountFromFloat(value float64, precision int) Amount {
+	// The shortest representation is the decimal the float was written as,
+	// which is exact whenever it fits the precision.
+	amount, err := ParseAmount(strconv.FormatFloat(value, 'f', -1, 64), precision)
+	if err == nil {
+		return amount
+	}
+	amount, err = ParseAmount(strconv.FormatFloat(value, 'f', precision, 64), precision)
+	if err != nil {
+		return Amount{}
+	}
+	return amount
+}
+
+func (a Amount) int() *big.Int {
+	if a.atomic == nil {
+		return new(big.Int)
+	}
+	return a.atomic
+}
+
+// Big returns a copy of the atomic value.
+func (a Amount) Big() *big.Int {
+	return new(big.Int).Set(a.int())
+}
+
+func (a Amount) Add(b Amount) Amount {
+	return Amount{atomic: new(big.Int).Add(a.int(), b.int())}
+}
+
+func (a Amount) Sub(b Amount) Amount {
+	return Amount{atomic: new(big.Int).Sub(a.int(), b.int())}
+}
+
+func (a Amount) Cmp(b Amount) int {
+	return a.int().Cmp(b.int())
+}
+
+func (a Amount) Sign() int {
+	return a.int().Sign()
+}
+
+func (a Amount) IsZero() bool {
+	return a.Sign() == 0
+}
+
+// MulRat multiplies by an exact ratio, rounding towards zero.
+func (a Amount) MulRat(r *big.Rat) Amount {
+	product := new(big.Int).Mul(a.int(), r.Num())
+	return Amount{atomic: product.Quo(product, r.Denom())}
+}
+
+// Rescale converts between precisions, rounding towards zero when precision
+// is lost.
+func (a Amount) Rescale(from, to int) Amount {
+	if to >= from {
+		return Amount{atomic: new(big.Int).Mul(a.int(), pow10(to-from))}
+	}
+	return Amount{atomic: new(big.Int).Quo(a.int(), pow10(from-to))}
+}
+
+// Rat returns the amount in whole coins.
+func (a Amount) Rat(precision int) *big.Rat {
+	return new(big.Rat).SetFrac(a.Big(), pow10(precision))
+}
+
+// Float64 returns the amount in whole coins as a float. It is only meant for
+// price estimates and display, never for anything that moves funds.
+func (a Amount) Float64(precision int) float64 {
+	value, _ := a.Rat(precision).Float64()
+	return value
+}
+
+// Format writes the amount in whole coins with exactly precision decimals.
+func (a Amount) Format(precision int) string {
+	atomic := a.int()
+	digits := new(big.Int).Abs(atomic).String()
+	if precision > 0 {
+		if len(digits) <= precision {
+			digits = strings.Repeat("0", precision-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-precision] + "." + digits[len(digits)-precision:]
+	}
+	if atomic.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// String writes the atomic value.
+func (a Amount) String() string {
+	return a.int().String()
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	atomic, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		return fmt.Errorf("invalid atomic amount %q", value)
+	}
+	a.atomic = atomic
+	return nil
+}
@@ -0,0 +1,104 @@
+package cryptoManager
+
+import (
+	"encoding/json"
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func randomAmount(r *rand.Rand) Amount {
+	// Up to 40 digits, well past what fits an int64.
+	digits := make([]byte, 1+r.Intn(40))
+	for i := range digits {
+		digits[i] = byte('0' + r.Intn(10))
+	}
+	atomic, _ := new(big.Int).SetString(string(digits), 10)
+	if r.Intn(4) == 0 {
+		atomic.Neg(atomic)
+	}
+	return AmountFromBig(atomic)
+}
+
+func TestAmountFormatParseRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for precision := 0; precision <= 18; precision++ {
+		for i := 0; i < 500; i++ {
+			amount := randomAmount(r)
+			formatted := amount.Format(precision)
+			parsed, err := ParseAmount(formatted, precision)
+			if err != nil {
+				t.Fatalf("precision %d: ParseAmount(%q): %v", precision, formatted, err)
+			}
+			if parsed.Cmp(amount) != 0 {
+				t.Fatalf("precision %d: %s formatted as %q parsed back as %s", precision, amount, formatted, parsed)
+			}
+		}
+	}
+}
+
+func TestAmountStringRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 1000; i++ {
+		amount := randomAmount(r)
+		data, err := json.Marshal(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Amount
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("unmarshal %s: %v", data, err)
+		}
+		if decoded.Cmp(amount) != 0 || decoded.String() != amount.String() {
+			t.Fatalf("%s encoded as %s decoded as %s", amount, data, decoded)
+		}
+	}
+}
+
+func TestParseAmountRejectsExcessPrecision(t *testing.T) {
+	for precision := 0; precision <= 18; precision++ {
+		value := "1." + strings.Repeat("0", precision) + "1"
+		if _, err := ParseAmount(value, precision); err == nil {
+			t.Fatalf("precision %d: %q accepted", precision, value)
+		}
+		// Trailing zeros beyond the precision do not lose anything.
+		value = "1." + strings.Repeat("0", precision+3)
+		amount, err := ParseAmount(value, precision)
+		if err != nil {
+			t.Fatalf("precision %d: %q: %v", precision, value, err)
+		}
+		if amount.Cmp(AmountFromBig(pow10(precision))) != 0 {
+			t.Fatalf("precision %d: %q parsed as %s", precision, value, amount)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		value     string
+		precision int
+		atomic    string
+	}{
+		{"0.015", 8, "1500000"},
+		{"1e-8", 8, "1"},
+		{"21000000", 8, "2100000000000000"},
+		{"1.000000000000000001", 18, "1000000000000000001"},
+		{" 7 ", 0, "7"},
+		{"-0.5", 1, "-5"},
+	}
+	for _, test := range tests {
+		amount, err := ParseAmount(test.value, test.precision)
+		if err != nil {
+			t.Fatalf("ParseAmount(%q, %d): %v", test.value, test.precision, err)
+		}
+		if amount.String() != test.atomic {
+			t.Fatalf("ParseAmount(%q, %d) = %s, want %s", test.value, test.precision, amount, test.atomic)
+		}
+	}
+	for _, value := range []string{"", "abc", "1.2.3"} {
+		if _, err := ParseAmount(value, 8); err == nil {
+			t.Fatalf("ParseAmount(%q) accepted", value)
+		}
+	}
+}
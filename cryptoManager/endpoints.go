@@ -0,0 +1,257 @@
+package cryptoManager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EndpointPolicy configures failover between the nodes of a handler. Every
+// CheckSeconds each node is probed; a node is healthy when it answers within
+// MaxLatencyMs, has at least MinPeers peers and is at most MaxLagBlocks
+// behind the best height any node reports. The handler sticks to its node
+// while that stays healthy and goes back to the first node once it has been
+// healthy for a few checks in a row. Zero values check every 30 seconds
+// and set no latency or peer limit, an unset MaxLagBlocks allows a lag of 3
+// blocks.
+type EndpointPolicy struct {
+	CheckSeconds int    `json:"checkSeconds"`
+	MaxLagBlocks *int64 `json:"maxLagBlocks"`
+	MaxLatencyMs int    `json:"maxLatencyMs"`
+	MinPeers     int    `json:"minPeers"`
+}
+
+const (
+	defaultEndpointCheckSeconds = 30
+	defaultEndpointMaxLag       = 3
+	// failbackChecks is how many checks in a row the first node has to pass
+	// before the handler returns to it.
+	failbackChecks = 3
+)
+
+// EndpointSwitched is called when a handler fails over to another node. The
+// application sets it to log the switch.
+var EndpointSwitched func(handler, from, to, reason string)
+
+// EndpointHealth is the last check of one node of a handler. Problem says
+// why the node is excluded and is empty while it is healthy.
+type EndpointHealth struct {
+	Endpoint string
+	Current  bool
+	Height   int64
+	Peers    int
+	Latency  time.Duration
+	Problem  string
+}
+
+// EndpointReporter is implemented by handlers that fail over between nodes.
+type EndpointReporter interface {
+	Endpoints() []EndpointHealth
+}
+
+// endpointStatus is what a probe learned about a node. peers is -1 when the
+// node does not tell.
+type endpointStatus struct {
+	height int64
+	peers  int
+}
+
+type endpointProbe func(ctx context.Context, endpoint string) (endpointStatus, error)
+
+type endpointSet struct {
+	mutex     sync.Mutex
+	handler   string
+	endpoints []string
+	// names are shown instead of the endpoints, which may carry API keys.
+	names   []string
+	current int
+	health  []EndpointHealth
+	streak  []int
+	policy  EndpointPolicy
+	maxLag  int64
+	probe   endpointProbe
+	// activate prepares a node before it is used, a failed activation keeps
+	// the handler where it is.
+	activate func(ctx context.Context, endpoint string) error
+	wake     chan struct{}
+}
+
+// newEndpointSet starts health checking when there is more than one node.
+func newEndpointSet(handler string, endpoints, names []string, policy EndpointPolicy, probe endpointProbe, activate func(ctx context.Context, endpoint string) error) *endpointSet {
+	if policy.CheckSeconds <= 0 {
+		policy.CheckSeconds = defaultEndpointCheckSeconds
+	}
+	maxLag := int64(defaultEndpointMaxLag)
+	if policy.MaxLagBlocks != nil && *policy.MaxLagBlocks >= 0 {
+		maxLag = *policy.MaxLagBlocks
+	}
+	if names == nil {
+		names = endpoints
+	}
+	s := &endpointSet{
+		handler:   handler,
+		endpoints: endpoints,
+		names:     names,
+		health:    make([]EndpointHealth, len(endpoints)),
+		streak:    make([]int, len(endpoints)),
+		policy:    policy,
+		maxLag:    maxLag,
+		probe:     probe,
+		activate:  activate,
+		wake:      make(chan struct{}, 1),
+	}
+	for i, name := range names {
+		s.health[i].Endpoint = name
+	}
+	if len(endpoints) > 1 {
+		go s.run()
+	}
+	return s
+}
+
+// hostList puts the primary first and drops empty entries.
+func hostList(primary string, others []string) []string {
+	var hosts []string
+	for _, host := range append([]string{primary}, others...) {
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func (s *endpointSet) Current() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.endpoints[s.current]
+}
+
+func (s *endpointSet) index() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.current
+}
+
+// failed tells the checker that a call to endpoint could not reach it, so
+// it is checked now rather than at the next interval. Calls are not retried
+// on another node, a payout might have gone through.
+func (s *endpointSet) failed(endpoint string) {
+	if len(s.endpoints) < 2 || endpoint != s.Current() {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *endpointSet) Endpoints() []EndpointHealth {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	health := make([]EndpointHealth, len(s.health))
+	copy(health, s.health)
+	health[s.current].Current = true
+	return health
+}
+
+func (s *endpointSet) run() {
+	ticker := time.NewTicker(time.Duration(s.policy.CheckSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		s.check(context.Background())
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *endpointSet) check(ctx context.Context) {
+	statuses := make([]endpointStatus, len(s.endpoints))
+	latencies := make([]time.Duration, len(s.endpoints))
+	errs := make([]error, len(s.endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range s.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started := time.Now()
+			statuses[i], errs[i] = s.probe(ctx, endpoint)
+			latencies[i] = time.Since(started)
+		}()
+	}
+	wg.Wait()
+
+	var best int64
+	for i := range statuses {
+		if errs[i] == nil && statuses[i].height > best {
+			best = statuses[i].height
+		}
+	}
+
+	s.mutex.Lock()
+	for i := range s.endpoints {
+		problem := s.problem(statuses[i], latencies[i], errs[i], best)
+		s.health[i] = EndpointHealth{
+			Endpoint: s.names[i],
+			Height:   statuses[i].height,
+			Peers:    statuses[i].peers,
+			Latency:  latencies[i],
+			Problem:  problem,
+		}
+		if problem == "" {
+			s.streak[i]++
+		} else {
+			s.streak[i] = 0
+		}
+	}
+	current := s.current
+	var candidates []int
+	reason := ""
+	if s.health[current].Problem != "" {
+		for i := range s.endpoints {
+			if s.health[i].Problem == "" {
+				candidates = append(candidates, i)
+			}
+		}
+		reason = s.health[current].Problem
+	} else if current != 0 && s.streak[0] >= failbackChecks {
+		candidates = []int{0}
+		reason = "primary node healthy again"
+	}
+	s.mutex.Unlock()
+
+	for _, target := range candidates {
+		if s.activate != nil {
+			if err := s.activate(ctx, s.endpoints[target]); err != nil {
+				s.mutex.Lock()
+				s.health[target].Problem = fmt.Sprintf("activation failed: %v", err)
+				s.streak[target] = 0
+				s.mutex.Unlock()
+				continue
+			}
+		}
+		s.mutex.Lock()
+		s.current = target
+		s.mutex.Unlock()
+		if EndpointSwitched != nil {
+			EndpointSwitched(s.handler, s.names[current], s.names[target], reason)
+		}
+		return
+	}
+}
+
+func (s *endpointSet) problem(status endpointStatus, latency time.Duration, err error, best int64) string {
+	switch {
+	case err != nil:
+		return err.Error()
+	case s.policy.MaxLatencyMs > 0 && latency > time.Duration(s.policy.MaxLatencyMs)*time.Millisecond:
+		return fmt.Sprintf("latency %v above %dms", latency.Round(time.Millisecond), s.policy.MaxLatencyMs)
+	case s.policy.MinPeers > 0 && status.peers >= 0 && status.peers < s.policy.MinPeers:
+		return fmt.Sprintf("%d peers, %d required", status.peers, s.policy.MinPeers)
+	case best-status.height > s.maxLag:
+		return fmt.Sprintf("%d blocks behind the best node", best-status.height)
+	}
+	return ""
+}
@@ -0,0 +1,410 @@
+package cryptoManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"sync"
+)
+
+var (
+	erc20TransferTopic    = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+	erc20BalanceOfMethod  = common.FromHex("0x70a08231")
+	erc20TransferMethod   = common.FromHex("0xa9059cbb")
+	erc20GasTopUpMultiple = big.NewInt(2)
+)
+
+// Erc20Settings configure a token on top of the Ethereum node and wallet
+// settings. The wallet's own account (index 0) is the gas funder, it pays the
+// gas of deposit addresses when they are swept and is where swept tokens
+// collect.
+type Erc20Settings struct {
+	EthSettings
+	Sign     string `json:"sign"`
+	Contract string `json:"contract"`
+	Decimals int    `json:"decimals"`
+}
+
+type Erc20Handler struct {
+	eth       *EthHandler
+	sign      string
+	contract  common.Address
+	decimals  int
+	gasFunder ethAccount
+	sendMutex sync.Mutex
+	// scannedBlocks holds the last block searched for deposits per address.
+	scannedBlocks map[string]uint64
+	scannedMutex  sync.Mutex
+	// recipients maps the deposits found and the payouts sent to the address
+	// they pay, a transaction can move tokens to others as well.
+	recipients      map[common.Hash]common.Address
+	recipientsMutex sync.Mutex
+}
+
+func init() {
+	RegisterHandler("erc20", func(raw json.RawMessage) (CryptoHandler, error) {
+		var settings Erc20Settings
+		if err := decodeSettings(raw, &settings); err != nil {
+			return nil, err
+		}
+		return NewErc20Handler(settings)
+	})
+}
+
+func NewErc20Handler(settings Erc20Settings) (*Erc20Handler, error) {
+	if err := ResolveSecrets(&settings.Contract); err != nil {
+		return nil, err
+	}
+	if !common.IsHexAddress(settings.Contract) {
+		return nil, fmt.Errorf("invalid token contract address")
+	}
+	eth, err := newEthHandler(settings.EthSettings, settings.Sign)
+	if err != nil {
+		return nil, err
+	}
+	eth.wallet.use(settings.Sign)
+	gasFunder, err := eth.wallet.address(0)
+	if err != nil {
+		return nil, err
+	}
+	handler := &Erc20Handler{
+		eth:           eth,
+		sign:          settings.Sign,
+		contract:      common.HexToAddress(settings.Contract),
+		decimals:      settings.Decimals,
+		gasFunder:     ethAccount{index: 0, address: gasFunder},
+		scannedBlocks: make(map[string]uint64),
+		recipients:    make(map[common.Hash]common.Address),
+	}
+	return handler, nil
+}
+
+func erc20TransferData(to common.Address, amount *big.Int) []byte {
+	data := append([]byte{}, erc20TransferMethod...)
+	data = append(data, common.LeftPadBytes(to.Bytes(), 32)...)
+	return append(data, common.LeftPadBytes(amount.Bytes(), 32)...)
+}
+
+func (h *Erc20Handler) balanceOf(ctx context.Context, account common.Address) (*big.Int, error) {
+	ctx, cancel := h.eth.call(ctx)
+	defer cancel()
+	data := append(append([]byte{}, erc20BalanceOfMethod...), common.LeftPadBytes(account.Bytes(), 32)...)
+	result, err := h.eth.ehtClient().CallContract(ctx, ethereum.CallMsg{To: &h.contract, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != 32 {
+		return nil, fmt.Errorf("unexpected balanceOf response length %d", len(result))
+	}
+	return new(big.Int).SetBytes(result), nil
+}
+
+func (h *Erc20Handler) ValidateAddress(address string) error {
+	return validateEthAddress(address)
+}
+
+// CheckBalance reports the gas funder, deposits count once they are swept.
+func (h *Erc20Handler) CheckBalance(ctx context.Context) (Amount, error) {
+	balance, err := h.balanceOf(ctx, h.gasFunder.address)
+	if err != nil {
+		return Amount{}, err
+	}
+	return AmountFromBig(balance), nil
+}
+
+func (h *Erc20Handler) setRecipient(txHash common.Hash, recipient common.Address) {
+	h.recipientsMutex.Lock()
+	h.recipients[txHash] = recipient
+	h.recipientsMutex.Unlock()
+}
+
+// recipient is the address a transaction is counted for. Transactions not
+// seen by this process are only understood when they are a plain transfer.
+func (h *Erc20Handler) recipient(tx *types.Transaction) (common.Address, error) {
+	h.recipientsMutex.Lock()
+	recipient, ok := h.recipients[tx.Hash()]
+	h.recipientsMutex.Unlock()
+	if ok {
+		return recipient, nil
+	}
+	data := tx.Data()
+	if tx.To() == nil || *tx.To() != h.contract || len(data) != 68 || string(data[:4]) != string(erc20TransferMethod) {
+		return common.Address{}, fmt.Errorf("transaction %s is not a token transfer", tx.Hash().Hex())
+	}
+	return common.BytesToAddress(data[4:36]), nil
+}
+
+func (h *Erc20Handler) GenerateNewAddress(ctx context.Context) (CryptoAddress, error) {
+	return h.eth.GenerateNewAddress(ctx)
+}
+
+func (h *Erc20Handler) GetAddressTransaction(ctx context.Context, address CryptoAddress) (*CryptoTransaction, error) {
+	if !common.IsHexAddress(address.Address) {
+		return nil, fmt.Errorf("invalid Ethereum address")
+	}
+	currentBlock, err := getCurrentEthBlock(ctx, h.eth)
+	if err != nil {
+		return nil, err
+	}
+	fromBlock := uint64(address.StartTime)
+	h.scannedMutex.Lock()
+	if scanned, exists := h.scannedBlocks[address.Address]; exists {
+		fromBlock = scanned + 1
+	}
+	h.scannedMutex.Unlock()
+	if fromBlock > uint64(currentBlock) {
+		return nil, nil
+	}
+
+	recipient := common.BytesToHash(common.LeftPadBytes(common.HexToAddress(address.Address).Bytes(), 32))
+	callCtx, cancel := h.eth.call(ctx)
+	defer cancel()
+	logs, err := h.eth.ehtClient().FilterLogs(callCtx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(fromBlock),
+		ToBlock:   big.NewInt(currentBlock),
+		Addresses: []common.Address{h.contract},
+		Topics:    [][]common.Hash{{erc20TransferTopic}, nil, {recipient}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, log := range logs {
+		if log.Removed || len(log.Data) != 32 {
+			continue
+		}
+		h.scannedMutex.Lock()
+		delete(h.scannedBlocks, address.Address)
+		h.scannedMutex.Unlock()
+		h.setRecipient(log.TxHash, common.HexToAddress(address.Address))
+		confirmations := currentBlock - int64(log.BlockNumber)
+		return &CryptoTransaction{
+			Txid:          log.TxHash.Hex(),
+			Confirmations: confirmations,
+			Amount:        AmountFromBig(new(big.Int).SetBytes(log.Data)),
+			Explorers:     h.eth.explorers,
+			Status:        confirmationStatus(confirmations),
+		}, nil
+	}
+	h.scannedMutex.Lock()
+	h.scannedBlocks[address.Address] = uint64(currentBlock)
+	h.scannedMutex.Unlock()
+	return nil, nil
+}
+
+func (h *Erc20Handler) GetTransactionDetails(ctx context.Context, txid string) (*CryptoTransaction, error) {
+	txHash := common.HexToHash(txid)
+	ctx, cancel := h.eth.call(ctx)
+	defer cancel()
+
+	tx, isPending, err := h.eth.ehtClient().TransactionByHash(ctx, txHash)
+	if errors.Is(err, ethereum.NotFound) {
+		return &CryptoTransaction{Txid: txHash.Hex(), Status: TxNotFound, Explorers: h.eth.explorers}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := h.recipient(tx)
+	if err != nil {
+		return nil, err
+	}
+	if isPending {
+		// Only a plain transfer says what it pays before it is mined.
+		data := tx.Data()
+		if len(data) != 68 || string(data[:4]) != string(erc20TransferMethod) || common.BytesToAddress(data[4:36]) != recipient {
+			return &CryptoTransaction{Txid: txHash.Hex(), Explorers: h.eth.explorers, Status: TxPending}, nil
+		}
+		return &CryptoTransaction{
+			Txid:          txHash.Hex(),
+			Confirmations: 0,
+			Amount:        AmountFromBig(new(big.Int).SetBytes(data[36:68])),
+			Explorers:     h.eth.explorers,
+			Status:        TxPending,
+		}, nil
+	}
+
+	receipt, err := h.eth.ehtClient().TransactionReceipt(ctx, txHash)
+	if err != nil {
+		return nil, err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return &CryptoTransaction{Txid: txHash.Hex(), Status: TxConflicted, Explorers: h.eth.explorers}, nil
+	}
+	currentHeader, err := h.eth.ehtClient().HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	amount := new(big.Int)
+	recipientTopic := common.BytesToHash(common.LeftPadBytes(recipient.Bytes(), 32))
+	for _, log := range receipt.Logs {
+		if log.Address == h.contract && len(log.Topics) == 3 && log.Topics[0] == erc20TransferTopic && log.Topics[2] == recipientTopic && len(log.Data) == 32 {
+			amount.Add(amount, new(big.Int).SetBytes(log.Data))
+		}
+	}
+
+	confirmations := new(big.Int).Sub(currentHeader.Number, receipt.BlockNumber).Int64()
+	return &CryptoTransaction{
+		Txid:          txHash.Hex(),
+		Confirmations: confirmations,
+		Amount:        AmountFromBig(amount),
+		Explorers:     h.eth.explorers,
+		Status:        confirmationStatus(confirmations),
+	}, nil
+}
+
+// transferCost estimates the gas of a token transfer from account and
+// returns the gas limit, the fees and the most the transfer can cost in wei.
+func (h *Erc20Handler) transferCost(ctx context.Context, from, to common.Address, amount *big.Int) (uint64, *ethFees, *big.Int, error) {
+	callCtx, cancel := h.eth.call(ctx)
+	defer cancel()
+	gasLimit, err := h.eth.ehtClient().EstimateGas(callCtx, ethereum.CallMsg{
+		From: from,
+		To:   &h.contract,
+		Data: erc20TransferData(to, amount),
+	})
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("gas estimation failed: %v", err)
+	}
+	fees, err := h.eth.suggestFees(ctx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return gasLimit, fees, fees.cost(gasLimit), nil
+}
+
+func (h *Erc20Handler) sendTransaction(ctx context.Context, account ethAccount, to common.Address, value *big.Int, gasLimit uint64, fees *ethFees, data []byte) (string, error) {
+	unlock := lockEthAccount(account.address)
+	defer unlock()
+	ctx, cancel := h.eth.call(ctx)
+	defer cancel()
+	nonce, err := h.eth.ehtClient().PendingNonceAt(ctx, account.address)
+	if err != nil {
+		return "", err
+	}
+	tx := h.eth.newTransaction(nonce, to, value, gasLimit, fees, data)
+	signedTx, err := h.eth.signTransaction(account, tx)
+	if err != nil {
+		return "", err
+	}
+	if err := h.eth.broadcast(ctx, signedTx); err != nil {
+		return "", err
+	}
+	return signedTx.Hash().Hex(), nil
+}
+
+// BuildRefill creates the unsigned token transfer of amount from the cold
+// address to the gas funder, which payouts are made from first.
+func (h *Erc20Handler) BuildRefill(ctx context.Context, cold string, amount Amount) (string, error) {
+	if !common.IsHexAddress(cold) {
+		return "", fmt.Errorf("invalid cold address")
+	}
+	from := common.HexToAddress(cold)
+	value := amount.Big()
+	gasLimit, fees, _, err := h.transferCost(ctx, from, h.gasFunder.address, value)
+	if err != nil {
+		return "", err
+	}
+	return h.eth.unsignedTransaction(ctx, from, h.contract, big.NewInt(0), gasLimit, fees, erc20TransferData(h.gasFunder.address, value))
+}
+
+func (h *Erc20Handler) Send(ctx context.Context, address CryptoAddress, amount Amount) ([]string, error) {
+	h.sendMutex.Lock()
+	defer h.sendMutex.Unlock()
+	if !common.IsHexAddress(address.Address) {
+		return nil, fmt.Errorf("invalid recipient address")
+	}
+	toAddress := common.HexToAddress(address.Address)
+	value := amount.Big()
+
+	// Payouts come from the gas funder only, deposit accounts are left to
+	// Sweep. A short hot wallet is refilled through the reserve check.
+	account := h.gasFunder
+	balance, err := h.balanceOf(ctx, account.address)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Cmp(value) < 0 {
+		return nil, fmt.Errorf("insufficient funds: available %s %s, required %s %s", AmountFromBig(balance).Format(h.decimals), h.sign, amount.Format(h.decimals), h.sign)
+	}
+	gasLimit, fees, fee, err := h.transferCost(ctx, account.address, toAddress, value)
+	if err != nil {
+		return nil, err
+	}
+	ethBalance, err := getAccountBalance(ctx, h.eth, account.address.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if ethBalance.Cmp(fee) < 0 {
+		return nil, fmt.Errorf("insufficient funds: the hot wallet lacks ETH for the transfer fee")
+	}
+	txid, err := h.sendTransaction(ctx, account, h.contract, big.NewInt(0), gasLimit, fees, erc20TransferData(toAddress, value))
+	if err != nil {
+		return nil, err
+	}
+	h.setRecipient(common.HexToHash(txid), toAddress)
+	return []string{txid}, nil
+}
+
+// Sweep moves token balances from deposit addresses to the gas funder.
+// Addresses without enough ETH for the transfer are topped up by the gas
+// funder first and swept on a later run, once the top up has confirmed.
+func (h *Erc20Handler) Sweep(ctx context.Context) ([]string, error) {
+	h.sendMutex.Lock()
+	defer h.sendMutex.Unlock()
+	var txids []string
+	accounts, err := getSweepAccounts(h.eth)
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		if account.index == h.gasFunder.index && !account.legacy {
+			continue
+		}
+		balance, err := h.balanceOf(ctx, account.address)
+		if err != nil {
+			return txids, err
+		}
+		if err := h.eth.found(account, balance.Sign() == 0); err != nil {
+			return txids, err
+		}
+		if balance.Sign() == 0 {
+			continue
+		}
+		gasLimit, fees, fee, err := h.transferCost(ctx, account.address, h.gasFunder.address, balance)
+		if err != nil {
+			return txids, err
+		}
+		ethBalance, err := getAccountBalance(ctx, h.eth, account.address.Hex())
+		if err != nil {
+			return txids, err
+		}
+		if ethBalance.Cmp(fee) < 0 {
+			topUp := new(big.Int).Sub(new(big.Int).Mul(fee, erc20GasTopUpMultiple), ethBalance)
+			txid, err := h.sendTransaction(ctx, h.gasFunder, account.address, topUp, 21000, fees, nil)
+			if err != nil {
+				return txids, fmt.Errorf("gas top up for %s failed: %v", account.address.Hex(), err)
+			}
+			txids = append(txids, txid)
+			continue
+		}
+		txid, err := h.sendTransaction(ctx, account, h.contract, big.NewInt(0), gasLimit, fees, erc20TransferData(h.gasFunder.address, balance))
+		if err != nil {
+			return txids, fmt.Errorf("sweep of %s failed: %v", account.address.Hex(), err)
+		}
+		txids = append(txids, txid)
+	}
+	return txids, nil
+}
+
+func (h *Erc20Handler) Rebroadcast(ctx context.Context, txid string) error {
+	return h.eth.Rebroadcast(ctx, txid)
+}
+
+func (h *Erc20Handler) Endpoints() []EndpointHealth {
+	return h.eth.Endpoints()
+}
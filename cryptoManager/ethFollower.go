@@ -0,0 +1,263 @@
+package cryptoManager
+
+import (
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ethWatchTTL drops addresses nobody has asked about for a while, orders
+	// poll every few seconds until they expire.
+	ethWatchTTL = time.Hour
+	// ethMaxBlocksPerPoll bounds the work a single poll does when the
+	// follower is catching up.
+	ethMaxBlocksPerPoll = 50
+)
+
+type ethDeposit struct {
+	txid   string
+	block  uint64
+	amount *big.Int
+}
+
+type ethWatch struct {
+	startBlock uint64
+	balance    *big.Int
+	lastSeen   time.Time
+	deposit    *ethDeposit
+}
+
+// ethFollower walks the chain once for every watched deposit address. Each
+// block is fetched a single time; direct transfers are found by recipient
+// and transfers made from inside contracts by the change in balance.
+type ethFollower struct {
+	h        *EthHandler
+	mutex    sync.Mutex
+	head     uint64
+	watched  map[common.Address]*ethWatch
+	deposits map[string]*ethDeposit
+}
+
+func newEthFollower(h *EthHandler) *ethFollower {
+	return &ethFollower{
+		h:        h,
+		watched:  make(map[common.Address]*ethWatch),
+		deposits: make(map[string]*ethDeposit),
+	}
+}
+
+// internalDepositID names a deposit that arrived through a contract call.
+// Without tracing the node cannot tell which transaction made it, so it is
+// identified by block and address instead.
+func internalDepositID(blockHash common.Hash, address common.Address) string {
+	return "internal:" + blockHash.Hex() + ":" + address.Hex()
+}
+
+func (f *ethFollower) balances(ctx context.Context, addresses []common.Address, block uint64) ([]*big.Int, error) {
+	return getAccountBalances(ctx, f.h, addresses, hexutil.EncodeUint64(block))
+}
+
+// watch starts following an address. When the follower is already past the
+// address' start block the missed blocks are searched once for it alone.
+func (f *ethFollower) watch(ctx context.Context, address CryptoAddress) (*ethWatch, error) {
+	ethAddress := common.HexToAddress(address.Address)
+	if watch, ok := f.watched[ethAddress]; ok {
+		watch.lastSeen = time.Now()
+		return watch, nil
+	}
+	if f.head == 0 || len(f.watched) == 0 {
+		current, err := getCurrentEthBlock(ctx, f.h)
+		if err != nil {
+			return nil, err
+		}
+		f.head = uint64(current)
+	}
+	balances, err := f.balances(ctx, []common.Address{ethAddress}, f.head)
+	if err != nil {
+		return nil, err
+	}
+	watch := &ethWatch{
+		startBlock: uint64(address.StartTime),
+		balance:    balances[0],
+		lastSeen:   time.Now(),
+	}
+	if watch.balance.Sign() > 0 {
+		deposit, err := f.findMissedDeposit(ctx, ethAddress, watch.startBlock)
+		if err != nil {
+			return nil, err
+		}
+		watch.deposit = deposit
+		f.deposits[deposit.txid] = deposit
+	}
+	f.watched[ethAddress] = watch
+	return watch, nil
+}
+
+func (f *ethFollower) findMissedDeposit(ctx context.Context, address common.Address, startBlock uint64) (*ethDeposit, error) {
+	for number := startBlock; number <= f.head; number++ {
+		callCtx, cancel := f.h.call(ctx)
+		block, err := f.h.ehtClient().BlockByNumber(callCtx, new(big.Int).SetUint64(number))
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range block.Transactions() {
+			if tx.To() != nil && *tx.To() == address && tx.Value().Sign() > 0 && tx.ChainId().Cmp(f.h.chainID) == 0 {
+				return &ethDeposit{txid: tx.Hash().Hex(), block: number, amount: tx.Value()}, nil
+			}
+		}
+	}
+	callCtx, cancel := f.h.call(ctx)
+	defer cancel()
+	header, err := f.h.ehtClient().HeaderByNumber(callCtx, new(big.Int).SetUint64(f.head))
+	if err != nil {
+		return nil, err
+	}
+	balances, err := f.balances(ctx, []common.Address{address}, f.head)
+	if err != nil {
+		return nil, err
+	}
+	return &ethDeposit{txid: internalDepositID(header.Hash(), address), block: f.head, amount: balances[0]}, nil
+}
+
+func (f *ethFollower) processBlock(ctx context.Context, number uint64) error {
+	callCtx, cancel := f.h.call(ctx)
+	block, err := f.h.ehtClient().BlockByNumber(callCtx, new(big.Int).SetUint64(number))
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	direct := make(map[common.Address]*big.Int)
+	for _, tx := range block.Transactions() {
+		if tx.To() == nil || tx.Value().Sign() == 0 || tx.ChainId().Cmp(f.h.chainID) != 0 {
+			continue
+		}
+		watch, ok := f.watched[*tx.To()]
+		if !ok {
+			continue
+		}
+		if direct[*tx.To()] == nil {
+			direct[*tx.To()] = new(big.Int)
+		}
+		direct[*tx.To()].Add(direct[*tx.To()], tx.Value())
+		if watch.deposit == nil {
+			watch.deposit = &ethDeposit{txid: tx.Hash().Hex(), block: number, amount: tx.Value()}
+			f.deposits[watch.deposit.txid] = watch.deposit
+		}
+	}
+
+	addresses := make([]common.Address, 0, len(f.watched))
+	for address := range f.watched {
+		addresses = append(addresses, address)
+	}
+	balances, err := f.balances(ctx, addresses, number)
+	if err != nil {
+		return err
+	}
+	for i, address := range addresses {
+		watch := f.watched[address]
+		received := new(big.Int).Sub(balances[i], watch.balance)
+		watch.balance = balances[i]
+		if direct[address] != nil {
+			received.Sub(received, direct[address])
+		}
+		if received.Sign() > 0 && watch.deposit == nil {
+			watch.deposit = &ethDeposit{txid: internalDepositID(block.Hash(), address), block: number, amount: received}
+			f.deposits[watch.deposit.txid] = watch.deposit
+		}
+	}
+	f.head = number
+	return nil
+}
+
+func (f *ethFollower) expire() {
+	for address, watch := range f.watched {
+		if time.Since(watch.lastSeen) > ethWatchTTL {
+			if watch.deposit != nil {
+				delete(f.deposits, watch.deposit.txid)
+			}
+			delete(f.watched, address)
+		}
+	}
+}
+
+// poll brings the follower up to the current head and returns it.
+func (f *ethFollower) poll(ctx context.Context) (uint64, error) {
+	current, err := getCurrentEthBlock(ctx, f.h)
+	if err != nil {
+		return 0, err
+	}
+	f.expire()
+	target := uint64(current)
+	if target > f.head+ethMaxBlocksPerPoll {
+		target = f.head + ethMaxBlocksPerPoll
+	}
+	for number := f.head + 1; number <= target; number++ {
+		if err := f.processBlock(ctx, number); err != nil {
+			return 0, err
+		}
+	}
+	return uint64(current), nil
+}
+
+func (f *ethFollower) depositFor(ctx context.Context, address CryptoAddress) (*ethDeposit, uint64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	watch, err := f.watch(ctx, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	current, err := f.poll(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return watch.deposit, current, nil
+}
+
+// internalDeposit looks up a deposit by the id internalDepositID gave it. When
+// its block is no longer on the canonical chain the deposit is reported as
+// not canonical and forgotten, the address is searched again on the next
+// depositFor.
+func (f *ethFollower) internalDeposit(ctx context.Context, txid string) (*ethDeposit, uint64, bool, error) {
+	f.mutex.Lock()
+	deposit, ok := f.deposits[txid]
+	f.mutex.Unlock()
+	if !ok {
+		return nil, 0, false, fmt.Errorf("unknown internal deposit %s", txid)
+	}
+	current, err := getCurrentEthBlock(ctx, f.h)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	callCtx, cancel := f.h.call(ctx)
+	header, err := f.h.ehtClient().HeaderByNumber(callCtx, new(big.Int).SetUint64(deposit.block))
+	cancel()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	parts := strings.Split(txid, ":")
+	if len(parts) == 3 && header.Hash() == common.HexToHash(parts[1]) {
+		return deposit, uint64(current), true, nil
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.deposits, txid)
+	for address, watch := range f.watched {
+		if watch.deposit == deposit {
+			delete(f.watched, address)
+		}
+	}
+	return deposit, uint64(current), false, nil
+}
+
+func isInternalDeposit(txid string) bool {
+	return strings.HasPrefix(txid, "internal:")
+}
@@ -2,20 +2,23 @@ package cryptoManager
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts"
-	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 	"math/big"
-	"math/rand"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 )
 
-const ethhost = "<ETHNODEURL>"
-
 var EthBlockchainExplorers = []*CryptoTransactionExplorer{
 	{
 		Name:     "etherscan",
@@ -26,214 +29,581 @@ var EthBlockchainExplorers = []*CryptoTransactionExplorer{
 	},
 }
 
+type EthSettings struct {
+	NodeURL        string     `json:"nodeURL"`
+	Wallet         HDSettings `json:"wallet"`
+	TimeoutSeconds int        `json:"timeoutSeconds"`
+	// ChainID is checked against the node. Left at 0 it is taken from the
+	// node, which is convenient for dev chains.
+	ChainID   int64              `json:"chainId"`
+	Fee       EthFeePolicy       `json:"fee"`
+	Sweep     EthSweepPolicy     `json:"sweep"`
+	Explorers []ExplorerSettings `json:"explorers"`
+	// NodeURLs are further nodes to fail over to.
+	NodeURLs []string       `json:"nodeURLs"`
+	Failover EndpointPolicy `json:"failover"`
+}
+
+// EthSweepPolicy decides when deposits are moved to the hot wallet. Only
+// balances MinConfirmations deep and at least MinAmount ETH are swept, and
+// nothing is swept while the fee cap is above MaxGasPriceGwei.
+type EthSweepPolicy struct {
+	MinAmount        float64 `json:"minAmount"`
+	MaxGasPriceGwei  float64 `json:"maxGasPriceGwei"`
+	MinConfirmations int     `json:"minConfirmations"`
+}
+
+// EthFeePolicy prices dynamic fee transactions. The fee cap is the latest
+// base fee times BaseFeeMultiplier plus the priority fee, limited to
+// MaxFeeGwei. A zero PriorityFeeGwei uses the node's suggested tip.
+type EthFeePolicy struct {
+	MaxFeeGwei        float64 `json:"maxFeeGwei"`
+	PriorityFeeGwei   float64 `json:"priorityFeeGwei"`
+	BaseFeeMultiplier float64 `json:"baseFeeMultiplier"`
+}
+
+type ethFees struct {
+	baseFee *big.Int
+	tipCap  *big.Int
+	feeCap  *big.Int
+}
+
+// cost is the most a transaction with gasLimit can pay.
+func (f *ethFees) cost(gasLimit uint64) *big.Int {
+	return new(big.Int).Mul(f.feeCap, new(big.Int).SetUint64(gasLimit))
+}
+
+// expected is what a transaction with gasLimit pays when it is mined at the
+// current base fee.
+func (f *ethFees) expected(gasLimit uint64) *big.Int {
+	price := new(big.Int).Add(f.baseFee, f.tipCap)
+	if price.Cmp(f.feeCap) > 0 {
+		price = f.feeCap
+	}
+	return new(big.Int).Mul(price, new(big.Int).SetUint64(gasLimit))
+}
+
+// ethMineTimeout bounds the wait for a sweep a refund depends on.
+const ethMineTimeout = 30 * time.Minute
+
+func gweiToWei(gwei float64) *big.Int {
+	return AmountFromFloat(gwei, 9).Big()
+}
+
 type EthHandler struct {
-	ethKeystore      *keystore.KeyStore
-	ehtClient        *ethclient.Client
-	sendMutex        sync.Mutex
-	transactionCache map[string]int64
+	wallet      *hdWallet
+	clients     map[string]*ethclient.Client
+	nodes       *endpointSet
+	sendMutex   sync.Mutex
+	sweepMutex  sync.Mutex
+	follower    *ethFollower
+	callTimeout time.Duration
+	chainID     *big.Int
+	signer      types.Signer
+	fee         EthFeePolicy
+	sweep       EthSweepPolicy
+	explorers   []*CryptoTransactionExplorer
+	// sent keeps the signed transactions of this run for rebroadcasting.
+	sent      map[common.Hash]*types.Transaction
+	sentMutex sync.Mutex
+	// user names the handler to the wallet's active set, legacyEmpty holds
+	// the legacy keystore accounts it swept empty.
+	user        string
+	legacyEmpty map[common.Address]bool
+}
+
+// ethAccount is an address of the handler's HD wallet, or of the legacy
+// keystore.
+type ethAccount struct {
+	index   uint32
+	address common.Address
+	legacy  bool
+}
+
+var (
+	ethAccountLocks      = make(map[common.Address]*sync.Mutex)
+	ethAccountLocksMutex sync.Mutex
+)
+
+// lockEthAccount serializes transactions from an account. The ETH handler
+// and every token handler on the same wallet send from the same accounts,
+// each of them picking the nonce itself.
+func lockEthAccount(address common.Address) func() {
+	ethAccountLocksMutex.Lock()
+	lock, ok := ethAccountLocks[address]
+	if !ok {
+		lock = &sync.Mutex{}
+		ethAccountLocks[address] = lock
+	}
+	ethAccountLocksMutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
 }
 
-func getCurrentEthBlock(h *EthHandler) (int64, error) {
-	number, err := h.ehtClient.HeaderByNumber(context.Background(), nil)
-	if err != nil && number.Number != nil {
+func init() {
+	RegisterHandler("ethereum", func(raw json.RawMessage) (CryptoHandler, error) {
+		var settings EthSettings
+		if err := decodeSettings(raw, &settings); err != nil {
+			return nil, err
+		}
+		return NewEthHandler(settings)
+	})
+}
+
+// call derives the context for a single node request.
+func (h *EthHandler) call(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, h.callTimeout)
+}
+
+func getCurrentEthBlock(ctx context.Context, h *EthHandler) (int64, error) {
+	ctx, cancel := h.call(ctx)
+	defer cancel()
+	number, err := h.ehtClient().HeaderByNumber(ctx, nil)
+	if err != nil {
 		return 0, err
 	}
 	return number.Number.Int64(), nil
 }
 
-func getAccountList(handler *EthHandler) ([]string, error) {
-	accounts := handler.ethKeystore.Accounts()
-	strAccounts := make([]string, 0)
-	for _, account := range accounts {
-		strAccounts = append(strAccounts, account.Address.Hex())
+func getAccountList(handler *EthHandler) ([]ethAccount, error) {
+	var accounts []ethAccount
+	for _, index := range handler.wallet.indexes() {
+		address, err := handler.wallet.address(index)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, ethAccount{index: index, address: address})
 	}
-	return strAccounts, nil
+	return accounts, nil
+}
 
+// getSweepAccounts lists the active wallet accounts and the legacy keystore
+// accounts the handler has not found empty yet.
+func getSweepAccounts(handler *EthHandler) ([]ethAccount, error) {
+	accounts, err := getAccountList(handler)
+	if err != nil || handler.wallet.legacy == nil {
+		return accounts, err
+	}
+	for _, account := range handler.wallet.legacy.Accounts() {
+		if !handler.legacyEmpty[account.Address] {
+			accounts = append(accounts, ethAccount{address: account.Address, legacy: true})
+		}
+	}
+	return accounts, nil
 }
 
-func getAccountBalance(handler *EthHandler, account string) (*big.Int, error) {
+// found tells the wallet whether a sweep left an account empty, so it can
+// leave the active set.
+func (h *EthHandler) found(account ethAccount, empty bool) error {
+	if account.legacy {
+		if empty {
+			h.legacyEmpty[account.address] = true
+		}
+		return nil
+	}
+	return h.wallet.found(h.user, account.index, empty)
+}
+
+// getAccountBalances fetches the balances of all accounts in one batch
+// request. block is a block number or "latest".
+func getAccountBalances(ctx context.Context, handler *EthHandler, addresses []common.Address, block string) ([]*big.Int, error) {
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+	results := make([]hexutil.Big, len(addresses))
+	batch := make([]rpc.BatchElem, len(addresses))
+	for i, address := range addresses {
+		batch[i] = rpc.BatchElem{
+			Method: "eth_getBalance",
+			Args:   []interface{}{address, block},
+			Result: &results[i],
+		}
+	}
+	ctx, cancel := handler.call(ctx)
+	defer cancel()
+	if err := handler.ehtClient().Client().BatchCallContext(ctx, batch); err != nil {
+		return nil, err
+	}
+	balances := make([]*big.Int, len(addresses))
+	for i, elem := range batch {
+		if elem.Error != nil {
+			return nil, elem.Error
+		}
+		balances[i] = results[i].ToInt()
+	}
+	return balances, nil
+}
+
+func getAccountBalance(ctx context.Context, handler *EthHandler, account string) (*big.Int, error) {
+	ctx, cancel := handler.call(ctx)
+	defer cancel()
 	addressRaw := common.HexToAddress(account)
-	balanceWei, err := handler.ehtClient.BalanceAt(context.Background(), addressRaw, nil)
+	balanceWei, err := handler.ehtClient().BalanceAt(ctx, addressRaw, nil)
 	if err != nil {
 		return nil, err
 	}
 	return balanceWei, nil
 }
 
-func NewEthHandler() (*EthHandler, error) {
-	client, err := ethclient.Dial(ethhost)
+func NewEthHandler(settings EthSettings) (*EthHandler, error) {
+	handler, err := newEthHandler(settings, "ETH")
+	if err != nil {
+		return nil, err
+	}
+	handler.wallet.use(handler.user)
+	return handler, nil
+}
+
+// newEthHandler connects the handler, user is the name it sweeps the
+// wallet under.
+func newEthHandler(settings EthSettings, user string) (*EthHandler, error) {
+	if err := ResolveSecrets(&settings.NodeURL); err != nil {
+		return nil, err
+	}
+	for i := range settings.NodeURLs {
+		if err := ResolveSecrets(&settings.NodeURLs[i]); err != nil {
+			return nil, err
+		}
+	}
+	wallet, err := openHDWallet(settings.Wallet)
 	if err != nil {
 		return nil, err
 	}
+	timeout := callTimeout(settings.TimeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	urls := hostList(settings.NodeURL, settings.NodeURLs)
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no node URL configured")
+	}
+	if settings.Fee.BaseFeeMultiplier <= 0 {
+		settings.Fee.BaseFeeMultiplier = 2
+	}
+	explorers := EthBlockchainExplorers
+	if len(settings.Explorers) > 0 {
+		explorers = newExplorers(settings.Explorers)
+	}
 	handler := &EthHandler{
-		ehtClient:        client,
-		ethKeystore:      keystore.NewKeyStore("ethKeystore", keystore.StandardScryptN, keystore.StandardScryptP),
-		transactionCache: make(map[string]int64),
+		wallet:      wallet,
+		clients:     make(map[string]*ethclient.Client),
+		callTimeout: timeout,
+		fee:         settings.Fee,
+		sweep:       settings.Sweep,
+		explorers:   explorers,
+		sent:        make(map[common.Hash]*types.Transaction),
+		user:        user,
+		legacyEmpty: make(map[common.Address]bool),
+	}
+	var names []string
+	for _, nodeURL := range urls {
+		transport := &ethNodeTransport{handler: handler, endpoint: nodeURL}
+		rpcClient, err := rpc.DialOptions(ctx, nodeURL, rpc.WithHTTPClient(&http.Client{Transport: transport}))
+		if err != nil {
+			return nil, err
+		}
+		handler.clients[nodeURL] = ethclient.NewClient(rpcClient)
+		names = append(names, endpointName(nodeURL))
+	}
+	chainID, err := handler.clients[urls[0]].ChainID(ctx)
+	if err != nil {
+		return nil, err
 	}
+	if settings.ChainID != 0 && chainID.Int64() != settings.ChainID {
+		return nil, fmt.Errorf("node is on chain %d, expected %d", chainID.Int64(), settings.ChainID)
+	}
+	handler.chainID = chainID
+	handler.signer = types.LatestSignerForChainID(chainID)
+	handler.nodes = newEndpointSet("ETH", urls, names, settings.Failover, handler.probeNode, nil)
+	handler.follower = newEthFollower(handler)
 	return handler, nil
 }
 
-func (h *EthHandler) CheckBalance() (float64, error) {
-	accounts, err := getAccountList(h)
+// endpointName shows a node URL without the path and credentials, hosted
+// nodes often take their API key there.
+func endpointName(nodeURL string) string {
+	parsed, err := url.Parse(nodeURL)
+	if err != nil || parsed.Host == "" {
+		return "node"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+type ethProbeKey struct{}
+
+// ethNodeTransport tells the failover checker when a request could not
+// reach its node, so it is checked at once. Probes are left out, the check
+// sees them fail by itself.
+type ethNodeTransport struct {
+	handler  *EthHandler
+	endpoint string
+}
+
+func (t *ethNodeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil && r.Context().Value(ethProbeKey{}) == nil && t.handler.nodes != nil && !errors.Is(r.Context().Err(), context.Canceled) {
+		t.handler.nodes.failed(t.endpoint)
+	}
+	return resp, err
+}
+
+// ehtClient is the client of the node in use.
+func (h *EthHandler) ehtClient() *ethclient.Client {
+	return h.clients[h.nodes.Current()]
+}
+
+// probeNode reads the height and peer count of a node and checks it is on
+// the handler's chain.
+func (h *EthHandler) probeNode(ctx context.Context, nodeURL string) (endpointStatus, error) {
+	client := h.clients[nodeURL]
+	ctx, cancel := h.call(context.WithValue(ctx, ethProbeKey{}, true))
+	defer cancel()
+	chainID, err := client.ChainID(ctx)
 	if err != nil {
-		return 0, err
+		return endpointStatus{}, err
 	}
+	if chainID.Cmp(h.chainID) != 0 {
+		return endpointStatus{}, fmt.Errorf("node is on chain %d, expected %d", chainID.Int64(), h.chainID.Int64())
+	}
+	height, err := client.BlockNumber(ctx)
+	if err != nil {
+		return endpointStatus{}, err
+	}
+	status := endpointStatus{height: int64(height), peers: -1}
+	// Hosted nodes often do not answer net_peerCount.
+	if peers, err := client.PeerCount(ctx); err == nil {
+		status.peers = int(peers)
+	}
+	return status, nil
+}
 
-	var totalBalanceWei *big.Int = big.NewInt(0)
-	oneEthInWei := big.NewInt(1e18)
+func (h *EthHandler) Endpoints() []EndpointHealth {
+	return h.nodes.Endpoints()
+}
 
-	for _, account := range accounts {
-		balanceWei, err := getAccountBalance(h, account)
+// suggestFees prices a transaction for the next block according to the fee
+// policy.
+func (h *EthHandler) suggestFees(ctx context.Context) (*ethFees, error) {
+	ctx, cancel := h.call(ctx)
+	defer cancel()
+	header, err := h.ehtClient().HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header.BaseFee == nil {
+		return nil, fmt.Errorf("chain does not support dynamic fee transactions")
+	}
+	tipCap := gweiToWei(h.fee.PriorityFeeGwei)
+	if h.fee.PriorityFeeGwei <= 0 {
+		tipCap, err = h.ehtClient().SuggestGasTipCap(ctx)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		totalBalanceWei.Add(totalBalanceWei, balanceWei)
 	}
+	feeCap, _ := new(big.Float).Mul(new(big.Float).SetInt(header.BaseFee), big.NewFloat(h.fee.BaseFeeMultiplier)).Int(nil)
+	feeCap.Add(feeCap, tipCap)
+	if h.fee.MaxFeeGwei > 0 {
+		maxFee := gweiToWei(h.fee.MaxFeeGwei)
+		if feeCap.Cmp(maxFee) > 0 {
+			feeCap = maxFee
+		}
+		if feeCap.Cmp(new(big.Int).Add(header.BaseFee, tipCap)) < 0 {
+			return nil, fmt.Errorf("network fee above the configured maximum of %v gwei", h.fee.MaxFeeGwei)
+		}
+	}
+	return &ethFees{baseFee: header.BaseFee, tipCap: tipCap, feeCap: feeCap}, nil
+}
 
-	totalBalanceEth := new(big.Float).SetInt(totalBalanceWei)
-	totalBalanceEth.Quo(totalBalanceEth, new(big.Float).SetInt(oneEthInWei))
-	balance, _ := totalBalanceEth.Float64()
+func (h *EthHandler) newTransaction(nonce uint64, to common.Address, value *big.Int, gasLimit uint64, fees *ethFees, data []byte) *types.Transaction {
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   h.chainID,
+		Nonce:     nonce,
+		GasTipCap: fees.tipCap,
+		GasFeeCap: fees.feeCap,
+		Gas:       gasLimit,
+		To:        &to,
+		Value:     value,
+		Data:      data,
+	})
+}
 
-	return balance, nil
+func (h *EthHandler) ValidateAddress(address string) error {
+	return validateEthAddress(address)
 }
 
-func (h *EthHandler) GenerateNewAddress() (CryptoAddress, error) {
-	account, err := h.ethKeystore.NewAccount("<ETHKEYSTOREPASS>")
+// CheckBalance reports the hot wallet, deposits count once they are swept.
+func (h *EthHandler) CheckBalance(ctx context.Context) (Amount, error) {
+	hot, err := h.hotAccount()
+	if err != nil {
+		return Amount{}, err
+	}
+	balanceWei, err := getAccountBalance(ctx, h, hot.address.Hex())
+	if err != nil {
+		return Amount{}, err
+	}
+	return AmountFromBig(balanceWei), nil
+}
+
+func (h *EthHandler) GenerateNewAddress(ctx context.Context) (CryptoAddress, error) {
+	currentBlock, err := getCurrentEthBlock(ctx, h)
 	if err != nil {
 		return CryptoAddress{}, err
 	}
-	currentBlock, err := getCurrentEthBlock(h)
+	index, err := h.wallet.reserveIndex()
+	if err != nil {
+		return CryptoAddress{}, err
+	}
+	address, err := h.wallet.address(index)
 	if err != nil {
 		return CryptoAddress{}, err
 	}
 	return CryptoAddress{
-		Address:   account.Address.Hex(),
+		Address:   address.Hex(),
 		StartTime: currentBlock,
+		Index:     index,
 	}, nil
 
 }
 
-func (h *EthHandler) GetAddressTransaction(address CryptoAddress) (*CryptoTransaction, error) {
+func (h *EthHandler) GetAddressTransaction(ctx context.Context, address CryptoAddress) (*CryptoTransaction, error) {
 	if !common.IsHexAddress(address.Address) {
 		return nil, fmt.Errorf("invalid Ethereum address")
 	}
-	ethAddress := common.HexToAddress(address.Address)
-	currentBlock, err := getCurrentEthBlock(h)
-	if err != nil {
+	deposit, currentBlock, err := h.follower.depositFor(ctx, address)
+	if err != nil || deposit == nil {
 		return nil, err
 	}
-	var startBlock *big.Int
-	if cachedBlock, exists := h.transactionCache[address.Address]; exists {
-		startBlock = big.NewInt(cachedBlock + 1)
-	} else {
-		startBlock = big.NewInt(address.StartTime)
-	}
-
-	currentBlockBigInt := big.NewInt(currentBlock)
-	bigInt1 := big.NewInt(1)
+	return &CryptoTransaction{
+		Txid:          deposit.txid,
+		Confirmations: int64(currentBlock - deposit.block),
+		Amount:        AmountFromBig(deposit.amount),
+		Explorers:     h.explorers,
+		Status:        confirmationStatus(int64(currentBlock - deposit.block)),
+	}, nil
+}
 
-	for blockNum := startBlock; blockNum.Cmp(currentBlockBigInt) <= 0; blockNum.Add(blockNum, bigInt1) {
-		block, err := h.ehtClient.BlockByNumber(context.Background(), blockNum)
+func (h *EthHandler) GetTransactionDetails(ctx context.Context, txid string) (*CryptoTransaction, error) {
+	if isInternalDeposit(txid) {
+		deposit, currentBlock, canonical, err := h.follower.internalDeposit(ctx, txid)
 		if err != nil {
 			return nil, err
 		}
-		for _, tx := range block.Transactions() {
-			if tx.ChainId().Int64() != 1 {
-				continue
-			}
-			sender, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
-			if err != nil {
-				continue
-			}
-			if sender == ethAddress || (tx.To() != nil && *tx.To() == ethAddress) {
-				delete(h.transactionCache, address.Address)
-				confirmations := new(big.Int).Sub(currentBlockBigInt, block.Number()).Int64()
-				amount := new(big.Float).Quo(
-					new(big.Float).SetInt(tx.Value()),
-					new(big.Float).SetInt(big.NewInt(1e18)),
-				).SetPrec(64)
-				amountFloat, _ := amount.Float64()
-
-				return &CryptoTransaction{
-					Txid:          tx.Hash().Hex(),
-					Confirmations: confirmations,
-					Amount:        amountFloat,
-					Explorers:     EthBlockchainExplorers,
-				}, nil
-			}
+		if !canonical {
+			return &CryptoTransaction{Txid: txid, Amount: AmountFromBig(deposit.amount), Explorers: h.explorers, Status: TxConflicted}, nil
 		}
+		return &CryptoTransaction{
+			Txid:          txid,
+			Confirmations: int64(currentBlock - deposit.block),
+			Amount:        AmountFromBig(deposit.amount),
+			Explorers:     h.explorers,
+			Status:        confirmationStatus(int64(currentBlock - deposit.block)),
+		}, nil
 	}
-	h.transactionCache[address.Address] = currentBlockBigInt.Int64()
-	return nil, nil
-}
-
-func (h *EthHandler) GetTransactionDetails(txid string) (*CryptoTransaction, error) {
 	txHash := common.HexToHash(txid)
+	ctx, cancel := h.call(ctx)
+	defer cancel()
 
-	tx, isPending, err := h.ehtClient.TransactionByHash(context.Background(), txHash)
+	tx, isPending, err := h.ehtClient().TransactionByHash(ctx, txHash)
+	if errors.Is(err, ethereum.NotFound) {
+		return &CryptoTransaction{Txid: txHash.Hex(), Status: TxNotFound, Explorers: h.explorers}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	if isPending {
+		return &CryptoTransaction{
+			Txid:      txHash.Hex(),
+			Amount:    AmountFromBig(tx.Value()),
+			Explorers: h.explorers,
+			Status:    TxPending,
+		}, nil
+	}
 
-	receipt, err := h.ehtClient.TransactionReceipt(context.Background(), txHash)
+	receipt, err := h.ehtClient().TransactionReceipt(ctx, txHash)
 	if err != nil {
 		return nil, err
 	}
 
-	currentHeader, err := h.ehtClient.HeaderByNumber(context.Background(), nil)
+	currentHeader, err := h.ehtClient().HeaderByNumber(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	var confirmations int64
-	if !isPending && receipt != nil {
-		confirmations = new(big.Int).Sub(currentHeader.Number, receipt.BlockNumber).Int64()
+	confirmations := new(big.Int).Sub(currentHeader.Number, receipt.BlockNumber).Int64()
+	status := confirmationStatus(confirmations)
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		status = TxConflicted
 	}
 
-	amount := new(big.Float).Quo(
-		new(big.Float).SetInt(tx.Value()),
-		new(big.Float).SetInt(big.NewInt(1e18)),
-	)
-	amountFloat, _ := amount.Float64()
-
 	return &CryptoTransaction{
 		Txid:          txHash.Hex(),
 		Confirmations: confirmations,
-		Amount:        amountFloat,
-		Explorers:     EthBlockchainExplorers,
+		Amount:        AmountFromBig(tx.Value()),
+		Explorers:     h.explorers,
+		Status:        status,
 	}, nil
 }
 
-func sendFromAccount(h *EthHandler, account accounts.Account, toAddress common.Address, amountWei, gasPrice *big.Int, gasLimit uint64) ([]string, error) {
-	err := h.ethKeystore.Unlock(account, "<ETHKEYSTOREPASS>")
+// broadcast sends a signed transaction and keeps it for Rebroadcast.
+func (h *EthHandler) broadcast(ctx context.Context, signedTx *types.Transaction) error {
+	if err := h.ehtClient().SendTransaction(ctx, signedTx); err != nil {
+		return err
+	}
+	h.sentMutex.Lock()
+	h.sent[signedTx.Hash()] = signedTx
+	h.sentMutex.Unlock()
+	return nil
+}
+
+// Rebroadcast sends a transaction signed by this process again. A
+// transaction from before a restart is gone with the process.
+func (h *EthHandler) Rebroadcast(ctx context.Context, txid string) error {
+	h.sentMutex.Lock()
+	signedTx, ok := h.sent[common.HexToHash(txid)]
+	h.sentMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("transaction %s was not sent by this process", txid)
+	}
+	ctx, cancel := h.call(ctx)
+	defer cancel()
+	if err := h.ehtClient().SendTransaction(ctx, signedTx); err != nil {
+		return fmt.Errorf("failed to rebroadcast %s: %v", txid, err)
+	}
+	return nil
+}
+
+// signTransaction signs tx with the key of the account.
+func (h *EthHandler) signTransaction(account ethAccount, tx *types.Transaction) (*types.Transaction, error) {
+	if account.legacy {
+		return h.wallet.legacy.SignTxWithPassphrase(accounts.Account{Address: account.address}, h.wallet.legacyPassword, tx, h.chainID)
+	}
+	key, err := h.wallet.key(account.index)
 	if err != nil {
 		return nil, err
 	}
-	defer h.ethKeystore.Lock(account.Address) // Lock when done
+	return types.SignTx(tx, h.signer, key)
+}
 
-	nonce, err := h.ehtClient.PendingNonceAt(context.Background(), account.Address)
+// sendFromAccount sends valueWei, the account has to hold the value and the
+// most the gas can cost.
+func sendFromAccount(ctx context.Context, h *EthHandler, account ethAccount, toAddress common.Address, valueWei *big.Int, fees *ethFees, gasLimit uint64) ([]string, error) {
+	unlock := lockEthAccount(account.address)
+	defer unlock()
+	callCtx, cancel := h.call(ctx)
+	nonce, err := h.ehtClient().PendingNonceAt(callCtx, account.address)
+	cancel()
 	if err != nil {
 		return nil, err
 	}
-	fee := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(gasLimit))
+	tx := h.newTransaction(nonce, toAddress, valueWei, gasLimit, fees, nil)
 
-	tx := types.NewTransaction(
-		nonce,
-		toAddress,
-		new(big.Int).Sub(amountWei, fee),
-		gasLimit,
-		gasPrice,
-		nil,
-	)
-
-	signedTx, err := h.ethKeystore.SignTx(account, tx, big.NewInt(1))
+	signedTx, err := h.signTransaction(account, tx)
 	if err != nil {
 		return nil, err
 	}
 
-	time.Sleep(5 * time.Second)
-
-	err = h.ehtClient.SendTransaction(context.Background(), signedTx)
+	callCtx, cancel = h.call(ctx)
+	defer cancel()
+	err = h.broadcast(callCtx, signedTx)
 	if err != nil {
 		return nil, err
 	}
@@ -241,129 +611,230 @@ func sendFromAccount(h *EthHandler, account accounts.Account, toAddress common.A
 	return []string{signedTx.Hash().Hex()}, nil
 }
 
-func sendFromMultipleAccounts(h *EthHandler, toAddress common.Address, amountWei, gasPrice *big.Int, gasLimit uint64) ([]string, error) {
-	type accountBalance struct {
-		account accounts.Account
-		balance *big.Int
+func (h *EthHandler) Send(ctx context.Context, address CryptoAddress, amount Amount) ([]string, error) {
+	h.sendMutex.Lock()
+	defer h.sendMutex.Unlock()
+	if !common.IsHexAddress(address.Address) {
+		return nil, fmt.Errorf("invalid recipient address")
 	}
-	var accountsWithBalances []accountBalance
-	totalBalance := new(big.Int)
-	fee := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(gasLimit))
+	toAddress := common.HexToAddress(address.Address)
+	amountWei := amount.Big()
+	fees, err := h.suggestFees(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gasLimit := uint64(21000)
 
-	for _, acc := range h.ethKeystore.Accounts() {
-		balance, err := h.ehtClient.BalanceAt(context.Background(), acc.Address, nil)
-		if err != nil {
-			continue
-		}
-		accountsWithBalances = append(accountsWithBalances, accountBalance{
-			account: acc,
-			balance: balance,
-		})
-		totalBalance.Add(totalBalance, balance)
+	// The recipient pays the fee the transaction is expected to cost, the
+	// hot wallet covers the fee cap beyond it.
+	fee := fees.expected(gasLimit)
+	if amountWei.Cmp(fee) <= 0 {
+		return nil, fmt.Errorf("amount %s ETH does not cover the network fee of %s ETH", amount.Format(18), AmountFromBig(fee).Format(18))
 	}
+	value := new(big.Int).Sub(amountWei, fee)
+	required := new(big.Int).Add(value, fees.cost(gasLimit))
 
-	totalNeeded := new(big.Int).Sub(amountWei, fee)
-	if totalBalance.Cmp(totalNeeded) < 0 {
-		return nil, fmt.Errorf("insufficient funds")
+	hot, err := h.hotAccount()
+	if err != nil {
+		return nil, err
+	}
+	balance, err := getAccountBalance(ctx, h, hot.address.Hex())
+	if err != nil {
+		return nil, err
 	}
+	if balance.Cmp(required) < 0 {
+		return nil, fmt.Errorf("insufficient funds in hot wallet: available %s ETH, required %s ETH", AmountFromBig(balance).Format(18), AmountFromBig(required).Format(18))
+	}
+	return sendFromAccount(ctx, h, hot, toAddress, value, fees, gasLimit)
+}
 
-	var txHashes []string
-	remaining := new(big.Int).Set(amountWei)
-	for _, accBal := range accountsWithBalances {
-		if remaining.Sign() <= 0 {
-			break
-		}
-		sendAmount := new(big.Int).Set(accBal.balance)
-		if sendAmount.Cmp(remaining) > 0 {
-			sendAmount.Set(remaining)
-		}
-		txHash, err := sendFromAccount(h, accBal.account, toAddress, sendAmount, gasPrice, gasLimit)
-		if err != nil {
-			return nil, err
-		}
-		txHashes = append(txHashes, txHash[0])
-		remaining.Sub(remaining, sendAmount)
+// unsignedTransaction builds a transaction from an account this wallet has
+// no key for, hex encoded for an offline signer. Nonce and fees are current
+// values, the transaction has to be signed and sent soon after.
+func (h *EthHandler) unsignedTransaction(ctx context.Context, from, to common.Address, value *big.Int, gasLimit uint64, fees *ethFees, data []byte) (string, error) {
+	callCtx, cancel := h.call(ctx)
+	defer cancel()
+	nonce, err := h.ehtClient().PendingNonceAt(callCtx, from)
+	if err != nil {
+		return "", err
 	}
-	if len(txHashes) > 0 {
-		return txHashes, nil
+	encoded, err := h.newTransaction(nonce, to, value, gasLimit, fees, data).MarshalBinary()
+	if err != nil {
+		return "", err
 	}
-	return nil, fmt.Errorf("no transactions were sent")
+	return hexutil.Encode(encoded), nil
 }
 
-func consolidateSmallBalances(h *EthHandler, gasPrice *big.Int, gasLimit uint64) error {
-	type accountBalance struct {
-		account accounts.Account
-		balance *big.Int
+// BuildRefill creates the unsigned transfer of amount from the cold address
+// to the hot wallet.
+func (h *EthHandler) BuildRefill(ctx context.Context, cold string, amount Amount) (string, error) {
+	if !common.IsHexAddress(cold) {
+		return "", fmt.Errorf("invalid cold address")
 	}
+	hot, err := h.hotAccount()
+	if err != nil {
+		return "", err
+	}
+	fees, err := h.suggestFees(ctx)
+	if err != nil {
+		return "", err
+	}
+	return h.unsignedTransaction(ctx, common.HexToAddress(cold), hot.address, amount.Big(), 21000, fees, nil)
+}
 
-	fee := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(gasLimit))
-	tenTimesFee := new(big.Int).Mul(big.NewInt(10), fee)
-	var smallAccounts []accountBalance
-	var largeAccounts []accounts.Account
-	for _, acc := range h.ethKeystore.Accounts() {
-		balance, err := h.ehtClient.BalanceAt(context.Background(), acc.Address, nil)
-		if err != nil {
-			continue
-		}
+// hotAccount is the wallet's own account, payouts are made from it and
+// deposits are swept into it.
+func (h *EthHandler) hotAccount() (ethAccount, error) {
+	address, err := h.wallet.address(0)
+	if err != nil {
+		return ethAccount{}, err
+	}
+	return ethAccount{index: 0, address: address}, nil
+}
 
-		if balance.Cmp(tenTimesFee) < 0 {
-			smallAccounts = append(smallAccounts, accountBalance{account: acc, balance: balance})
-		} else {
-			largeAccounts = append(largeAccounts, acc)
-		}
+// Sweep moves confirmed deposits into the hot wallet. Deposit addresses are
+// only swept while gas is below the configured ceiling and when the balance
+// is above the threshold, so small deposits wait until sweeping them is
+// worth the fee.
+func (h *EthHandler) Sweep(ctx context.Context) ([]string, error) {
+	h.sweepMutex.Lock()
+	defer h.sweepMutex.Unlock()
+
+	fees, err := h.suggestFees(ctx)
+	if err != nil {
+		return nil, err
 	}
-	if len(largeAccounts) == 0 {
-		return nil
+	if h.sweep.MaxGasPriceGwei > 0 && fees.feeCap.Cmp(gweiToWei(h.sweep.MaxGasPriceGwei)) > 0 {
+		return nil, nil
 	}
-	for _, smallAcc := range smallAccounts {
-		if smallAcc.balance.Cmp(fee) <= 0 {
-			continue
-		}
-
-		targetAccount := largeAccounts[rand.Intn(len(largeAccounts))]
+	gasLimit := uint64(21000)
+	fee := fees.cost(gasLimit)
 
-		sendAmount := new(big.Int).Sub(smallAcc.balance, fee)
+	currentBlock, err := getCurrentEthBlock(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	confirmedBlock := currentBlock - int64(h.sweep.MinConfirmations)
+	if confirmedBlock < 0 {
+		return nil, nil
+	}
 
-		_, err := sendFromAccount(h, smallAcc.account, targetAccount.Address, sendAmount, gasPrice, gasLimit)
-		if err != nil {
+	accounts, err := getSweepAccounts(h)
+	if err != nil {
+		return nil, err
+	}
+	var deposits []ethAccount
+	var addresses []common.Address
+	for _, account := range accounts {
+		if account.index == 0 && !account.legacy {
 			continue
 		}
+		deposits = append(deposits, account)
+		addresses = append(addresses, account.address)
 	}
-	return nil
-}
-
-func (h *EthHandler) Send(address CryptoAddress, amount float64) ([]string, error) {
-	h.sendMutex.Lock()
-	defer h.sendMutex.Unlock()
-	if !common.IsHexAddress(address.Address) {
-		return nil, fmt.Errorf("invalid recipient address")
+	confirmed, err := getAccountBalances(ctx, h, addresses, hexutil.EncodeUint64(uint64(confirmedBlock)))
+	if err != nil {
+		return nil, err
 	}
-	toAddress := common.HexToAddress(address.Address)
-	amountWei := new(big.Int)
-	amountFloat := big.NewFloat(amount)
-	amountFloat.Mul(amountFloat, big.NewFloat(1e18))
-	amountFloat.Int(amountWei)
-	gasPrice, err := h.ehtClient.SuggestGasPrice(context.Background())
+	latest, err := getAccountBalances(ctx, h, addresses, "latest")
 	if err != nil {
 		return nil, err
 	}
-	gasLimit := uint64(21000)
-	totalCost := amountWei
 
-	var sufficientAccounts []accounts.Account
-	h.ethKeystore.Accounts()
-	for _, acc := range h.ethKeystore.Accounts() {
-		balance, err := h.ehtClient.BalanceAt(context.Background(), acc.Address, nil)
-		if err != nil {
+	hot, err := h.hotAccount()
+	if err != nil {
+		return nil, err
+	}
+	threshold := AmountFromFloat(h.sweep.MinAmount, 18).Big()
+	var txids []string
+	for i, account := range deposits {
+		balance := confirmed[i]
+		if latest[i].Cmp(balance) < 0 {
+			balance = latest[i]
+		}
+		// What is left below the fee of a sweep cannot be moved anyway.
+		if err := h.found(account, latest[i].Cmp(fee) <= 0 && confirmed[i].Cmp(fee) <= 0); err != nil {
+			return txids, err
+		}
+		if balance.Cmp(fee) <= 0 || balance.Cmp(threshold) < 0 {
 			continue
 		}
+		txid, err := sendFromAccount(ctx, h, account, hot.address, new(big.Int).Sub(balance, fee), fees, gasLimit)
+		if err != nil {
+			return txids, fmt.Errorf("sweep of %s failed: %v", account.address.Hex(), err)
+		}
+		txids = append(txids, txid...)
+	}
+	return txids, nil
+}
 
-		if balance.Cmp(totalCost) >= 0 {
-			sufficientAccounts = append(sufficientAccounts, acc)
+// Refund pays a deposit back from the hot wallet. A deposit still on its
+// address is swept first and the refund waits until the sweep is mined, so
+// the hot wallet never pays it out of the funds of other orders.
+func (h *EthHandler) Refund(ctx context.Context, deposit CryptoAddress, address CryptoAddress, amount Amount) ([]string, error) {
+	txid, err := h.sweepDeposit(ctx, deposit)
+	if err != nil {
+		return nil, fmt.Errorf("sweep of the deposit failed: %v", err)
+	}
+	if txid != "" {
+		if err := h.waitMined(ctx, txid); err != nil {
+			return nil, fmt.Errorf("sweep %s of the deposit: %v", txid, err)
 		}
 	}
-	if len(sufficientAccounts) > 0 {
-		return sendFromAccount(h, sufficientAccounts[0], toAddress, amountWei, gasPrice, gasLimit)
+	return h.Send(ctx, address, amount)
+}
+
+func (h *EthHandler) sweepDeposit(ctx context.Context, deposit CryptoAddress) (string, error) {
+	h.sweepMutex.Lock()
+	defer h.sweepMutex.Unlock()
+	address, err := h.wallet.address(deposit.Index)
+	if err != nil {
+		return "", err
+	}
+	if deposit.Index == 0 || address != common.HexToAddress(deposit.Address) {
+		return "", fmt.Errorf("%s is not deposit address %d of the wallet", deposit.Address, deposit.Index)
+	}
+	fees, err := h.suggestFees(ctx)
+	if err != nil {
+		return "", err
+	}
+	gasLimit := uint64(21000)
+	fee := fees.cost(gasLimit)
+	balance, err := getAccountBalance(ctx, h, address.Hex())
+	if err != nil {
+		return "", err
+	}
+	if balance.Cmp(fee) <= 0 {
+		// Already swept.
+		return "", nil
+	}
+	hot, err := h.hotAccount()
+	if err != nil {
+		return "", err
+	}
+	txids, err := sendFromAccount(ctx, h, ethAccount{index: deposit.Index, address: address}, hot.address, new(big.Int).Sub(balance, fee), fees, gasLimit)
+	if err != nil {
+		return "", err
+	}
+	return txids[0], nil
+}
+
+// waitMined polls for the receipt of a transaction of this wallet.
+func (h *EthHandler) waitMined(ctx context.Context, txid string) error {
+	ctx, cancel := context.WithTimeout(ctx, ethMineTimeout)
+	defer cancel()
+	for {
+		callCtx, callCancel := h.call(ctx)
+		receipt, err := h.ehtClient().TransactionReceipt(callCtx, common.HexToHash(txid))
+		callCancel()
+		if err == nil {
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				return fmt.Errorf("transaction failed")
+			}
+			return nil
+		}
+		if err := sleepContext(ctx, 5*time.Second); err != nil {
+			return fmt.Errorf("not mined: %v", err)
+		}
 	}
-	return sendFromMultipleAccounts(h, toAddress, amountWei, gasPrice, gasLimit)
 }
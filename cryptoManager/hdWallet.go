@@ -0,0 +1,404 @@
+package cryptoManager
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/unicode/norm"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hdHardened = 0x80000000
+
+// hdRetireAfter is how long a deposit address stays in the active set after
+// it was handed out. Older addresses leave it once every handler on the
+// wallet found them empty, payments arriving later are still recoverable
+// from the seed.
+const hdRetireAfter = 7 * 24 * time.Hour
+
+//go:embed bip39english.txt
+var bip39English string
+
+var bip39Words = func() map[string]int {
+	words := make(map[string]int)
+	for i, word := range strings.Fields(bip39English) {
+		words[word] = i
+	}
+	return words
+}()
+
+// DefaultEthDerivationPath is the BIP-44 account path for Ethereum, address
+// indexes are appended to it.
+const DefaultEthDerivationPath = "m/44'/60'/0'/0"
+
+type hdKey struct {
+	key       []byte
+	chainCode []byte
+}
+
+// MnemonicSeed turns a BIP-39 mnemonic of the English wordlist into a seed.
+// Unknown words and a wrong checksum are rejected, a typo would otherwise
+// give a different wallet.
+func MnemonicSeed(mnemonic, passphrase string) ([]byte, error) {
+	words := strings.Fields(norm.NFKD.String(mnemonic))
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, fmt.Errorf("mnemonic has %d words, expected 12, 15, 18, 21 or 24", len(words))
+	}
+	bits := new(big.Int)
+	for i, word := range words {
+		index, ok := bip39Words[word]
+		if !ok {
+			return nil, fmt.Errorf("mnemonic word %d is not in the BIP-39 English wordlist", i+1)
+		}
+		bits.Lsh(bits, 11).Or(bits, big.NewInt(int64(index)))
+	}
+	checksumBits := uint(len(words) / 3)
+	checksum := new(big.Int).And(bits, new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), checksumBits), big.NewInt(1)))
+	entropy := common.LeftPadBytes(new(big.Int).Rsh(bits, checksumBits).Bytes(), int(checksumBits)*4)
+	hash := sha256.Sum256(entropy)
+	if uint64(hash[0]>>(8-checksumBits)) != checksum.Uint64() {
+		return nil, fmt.Errorf("mnemonic checksum mismatch")
+	}
+	sentence := strings.Join(words, " ")
+	return pbkdf2.Key([]byte(sentence), []byte("mnemonic"+norm.NFKD.String(passphrase)), 2048, 64, sha512.New), nil
+}
+
+func hdMasterKey(seed []byte) (*hdKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	key := &hdKey{key: sum[:32], chainCode: sum[32:]}
+	if err := checkHDKey(key.key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func checkHDKey(key []byte) error {
+	value := new(big.Int).SetBytes(key)
+	if value.Sign() == 0 || value.Cmp(crypto.S256().Params().N) >= 0 {
+		return fmt.Errorf("invalid derived key")
+	}
+	return nil
+}
+
+// child derives a private child key (BIP-32 CKDpriv).
+func (k *hdKey) child(index uint32) (*hdKey, error) {
+	var data []byte
+	if index >= hdHardened {
+		data = append([]byte{0}, k.key...)
+	} else {
+		private, err := crypto.ToECDSA(k.key)
+		if err != nil {
+			return nil, err
+		}
+		data = crypto.CompressPubkey(&private.PublicKey)
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	if err := checkHDKey(sum[:32]); err != nil {
+		return nil, err
+	}
+	childKey := new(big.Int).SetBytes(sum[:32])
+	childKey.Add(childKey, new(big.Int).SetBytes(k.key))
+	childKey.Mod(childKey, crypto.S256().Params().N)
+	if childKey.Sign() == 0 {
+		return nil, fmt.Errorf("invalid derived key")
+	}
+	return &hdKey{key: common.LeftPadBytes(childKey.Bytes(), 32), chainCode: sum[32:]}, nil
+}
+
+func parseDerivationPath(path string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimSpace(path), "/")
+	if len(parts) == 0 || parts[0] != "m" {
+		return nil, fmt.Errorf("derivation path must start with m")
+	}
+	var indexes []uint32
+	for _, part := range parts[1:] {
+		hardened := strings.HasSuffix(part, "'")
+		value, err := strconv.ParseUint(strings.TrimSuffix(part, "'"), 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid derivation path element %q", part)
+		}
+		index := uint32(value)
+		if hardened {
+			index += hdHardened
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// HDSettings configure deterministic deposit addresses. IndexFile keeps the
+// next unused address index across restarts, the addresses still in use
+// are kept next to it in IndexFile.active.
+//
+// LegacyKeystoreDir is the keystore of the one account per order wallet used
+// before. Its accounts are swept into the hot wallet like deposits until
+// they are empty, nothing new is created there.
+type HDSettings struct {
+	Mnemonic               string `json:"mnemonic"`
+	Passphrase             string `json:"passphrase"`
+	DerivationPath         string `json:"derivationPath"`
+	IndexFile              string `json:"indexFile"`
+	LegacyKeystoreDir      string `json:"legacyKeystoreDir"`
+	LegacyKeystorePassword string `json:"legacyKeystorePassword"`
+}
+
+// hdWallet derives addresses by index below an account path. Index 0 is the
+// wallet's own account, deposit addresses start at 1.
+type hdWallet struct {
+	account   *hdKey
+	indexFile string
+	// seedID identifies the mnemonic, passphrase and derivation path the
+	// wallet was opened with.
+	seedID    [32]byte
+	mutex     sync.Mutex
+	nextIndex uint32
+	keys      map[uint32]*ecdsa.PrivateKey
+	// active holds the deposit indexes that may still receive or hold funds
+	// with the time they were handed out.
+	active map[uint32]int64
+	// users are the handlers sweeping the wallet, empty holds the ones that
+	// found an active index empty. It is retired once all of them did.
+	users map[string]bool
+	empty map[uint32]map[string]bool
+
+	legacy         *keystore.KeyStore
+	legacyPassword string
+}
+
+var (
+	hdWallets      = make(map[string]*hdWallet)
+	hdWalletsMutex sync.Mutex
+)
+
+// openHDWallet returns the wallet for the settings. Handlers sharing an
+// index file share the wallet, so they never hand out the same index, and
+// must derive it from the same seed and path.
+func openHDWallet(settings HDSettings) (*hdWallet, error) {
+	if err := ResolveSecrets(&settings.Mnemonic, &settings.Passphrase, &settings.LegacyKeystorePassword); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(settings.Mnemonic) == "" {
+		return nil, fmt.Errorf("mnemonic missing")
+	}
+	if settings.DerivationPath == "" {
+		settings.DerivationPath = DefaultEthDerivationPath
+	}
+	if settings.IndexFile == "" {
+		settings.IndexFile = "ethHDIndex"
+	}
+
+	seedID := sha256.Sum256([]byte(strings.Join([]string{settings.Mnemonic, settings.Passphrase, settings.DerivationPath}, "\x00")))
+
+	hdWalletsMutex.Lock()
+	defer hdWalletsMutex.Unlock()
+	if wallet, ok := hdWallets[settings.IndexFile]; ok {
+		if wallet.seedID != seedID {
+			return nil, fmt.Errorf("index file %s is already used with a different mnemonic or derivation path", settings.IndexFile)
+		}
+		return wallet, nil
+	}
+
+	path, err := parseDerivationPath(settings.DerivationPath)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := MnemonicSeed(settings.Mnemonic, settings.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hdMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range path {
+		key, err = key.child(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	wallet := &hdWallet{
+		account:   key,
+		indexFile: settings.IndexFile,
+		seedID:    seedID,
+		nextIndex: 1,
+		keys:      make(map[uint32]*ecdsa.PrivateKey),
+		users:     make(map[string]bool),
+		empty:     make(map[uint32]map[string]bool),
+	}
+	contents, err := os.ReadFile(settings.IndexFile)
+	if err == nil {
+		next, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index file %s: %v", settings.IndexFile, err)
+		}
+		if next > 1 {
+			wallet.nextIndex = uint32(next)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := wallet.loadActive(); err != nil {
+		return nil, err
+	}
+	if settings.LegacyKeystoreDir != "" {
+		if _, err := os.Stat(settings.LegacyKeystoreDir); err != nil {
+			return nil, fmt.Errorf("legacy keystore: %v", err)
+		}
+		wallet.legacy = keystore.NewKeyStore(settings.LegacyKeystoreDir, keystore.StandardScryptN, keystore.StandardScryptP)
+		wallet.legacyPassword = settings.LegacyKeystorePassword
+	}
+	hdWallets[settings.IndexFile] = wallet
+	return wallet, nil
+}
+
+func (w *hdWallet) key(index uint32) (*ecdsa.PrivateKey, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if key, ok := w.keys[index]; ok {
+		return key, nil
+	}
+	if index >= hdHardened {
+		return nil, fmt.Errorf("address index %d out of range", index)
+	}
+	child, err := w.account.child(index)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.ToECDSA(child.key)
+	if err != nil {
+		return nil, err
+	}
+	w.keys[index] = key
+	return key, nil
+}
+
+func (w *hdWallet) address(index uint32) (common.Address, error) {
+	key, err := w.key(index)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(key.PublicKey), nil
+}
+
+// loadActive reads the active set. Without the file, from before it
+// existed, every index handed out so far is active and has to be found
+// empty once before it leaves the set.
+func (w *hdWallet) loadActive() error {
+	w.active = make(map[uint32]int64)
+	contents, err := os.ReadFile(w.indexFile + ".active")
+	if os.IsNotExist(err) {
+		now := time.Now().Unix()
+		for index := uint32(1); index < w.nextIndex; index++ {
+			w.active[index] = now
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(contents, &w.active); err != nil {
+		return fmt.Errorf("invalid active index file %s.active: %v", w.indexFile, err)
+	}
+	return nil
+}
+
+func (w *hdWallet) saveActive() error {
+	contents, err := json.Marshal(w.active)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(w.indexFile+".active", contents, 0600); err != nil {
+		return fmt.Errorf("failed to persist active addresses: %v", err)
+	}
+	return nil
+}
+
+// reserveIndex hands out the next deposit index. It is written to the index
+// file before it is used, so a crash can skip an index but never reuse one.
+func (w *hdWallet) reserveIndex() (uint32, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	index := w.nextIndex
+	w.active[index] = time.Now().Unix()
+	if err := w.saveActive(); err != nil {
+		delete(w.active, index)
+		return 0, err
+	}
+	if err := os.WriteFile(w.indexFile, []byte(strconv.FormatUint(uint64(index+1), 10)), 0600); err != nil {
+		return 0, fmt.Errorf("failed to persist address index: %v", err)
+	}
+	w.nextIndex = index + 1
+	return index, nil
+}
+
+// indexes lists the wallet's own index and the active deposit indexes.
+func (w *hdWallet) indexes() []uint32 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	indexes := make([]uint32, 0, len(w.active)+1)
+	indexes = append(indexes, 0)
+	for index := range w.active {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes
+}
+
+// use registers a handler that sweeps the wallet's addresses.
+func (w *hdWallet) use(user string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.users[user] = true
+}
+
+// found records what a sweep saw at an index. An index older than
+// hdRetireAfter leaves the active set once every user found it empty.
+func (w *hdWallet) found(user string, index uint32, empty bool) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	issued, ok := w.active[index]
+	if !ok {
+		return nil
+	}
+	if !empty {
+		delete(w.empty, index)
+		return nil
+	}
+	if w.empty[index] == nil {
+		w.empty[index] = make(map[string]bool)
+	}
+	w.empty[index][user] = true
+	if time.Since(time.Unix(issued, 0)) < hdRetireAfter {
+		return nil
+	}
+	for other := range w.users {
+		if !w.empty[index][other] {
+			return nil
+		}
+	}
+	delete(w.active, index)
+	delete(w.empty, index)
+	return w.saveActive()
+}
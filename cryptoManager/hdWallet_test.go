@@ -0,0 +1,252 @@
+package cryptoManager
+
+import (
+	"encoding/hex"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"hash/crc32"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBip39Wordlist(t *testing.T) {
+	// CRC32 of english.txt of the BIP-39 repository.
+	if sum := crc32.ChecksumIEEE([]byte(bip39English)); sum != 0xc1dbd296 {
+		t.Fatalf("wordlist checksum %x", sum)
+	}
+	if len(bip39Words) != 2048 {
+		t.Fatalf("wordlist has %d words", len(bip39Words))
+	}
+}
+
+func TestMnemonicSeed(t *testing.T) {
+	// Vectors of the BIP-39 specification, all with the passphrase TREZOR.
+	vectors := []struct {
+		mnemonic string
+		seed     string
+	}{
+		{"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+			"c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04"},
+		{"legal winner thank year wave sausage worth useful legal winner thank yellow",
+			"2e8905819b8723fe2c1d161860e5ee1830318dbf49a83bd451cfb8440c28bd6fa457fe1296106559a3c80937a1c1069be3a3a5bd381ee6260e8d9739fce1f607"},
+		{"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo wrong",
+			"ac27495480225222079d7be181583751e86f571027b0497b5b5d11218e0a8a13332572917f0f8e5a589620c6f15b11c61dee327651a14c34e18231052e48c069"},
+		{"letter advice cage absurd amount doctor acoustic avoid letter advice cage absurd amount doctor acoustic avoid letter always",
+			"107d7c02a5aa6f38c58083ff74f04c607c2d2c0ecc55501dadd72d025b751bc27fe913ffb796f841c49b1d33b610cf0e91d3aa239027f5e99fe4ce9e5088cd65"},
+		{"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo vote",
+			"dd48c104698c30cfe2b6142103248622fb7bb0ff692eebb00089b32d22484e1613912f0a5b694407be899ffd31ed3992c456cdf60f5d4564b8ba3f05a69890ad"},
+		{"renew stay biology evidence goat welcome casual join adapt armor shuffle fault little machine walk stumble urge swap",
+			"9248d83e06f4cd98debf5b6f010542760df925ce46cf38a1bdb4e4de7d21f5c39366941c69e1bdbf2966e0f6e6dbece898a0e2f0a4c2b3e640953dfe8b7bbdc5"},
+		{"dignity pass list indicate nasty swamp pool script soccer toe leaf photo multiply desk host tomato cradle drill spread actor shine dismiss champion exotic",
+			"ff7f3184df8696d8bef94b6c03114dbee0ef89ff938712301d27ed8336ca89ef9635da20af07d4175f2bf5f3de130f39c9d9e8dd0472489c19b1a020a940da67"},
+		{"beyond stage sleep clip because twist token leaf atom beauty genius food business side grid unable middle armed observe pair crouch tonight away coconut",
+			"b15509eaa2d09d3efd3e006ef42151b30367dc6e3aa5e44caba3fe4d3e352e65101fbdb86a96776b91946ff06f8eac594dc6ee1d3e82a42dfe1b40fef6bcc3fd"},
+	}
+	for _, vector := range vectors {
+		seed, err := MnemonicSeed(vector.mnemonic, "TREZOR")
+		if err != nil {
+			t.Fatalf("%s: %v", vector.mnemonic, err)
+		}
+		if hex.EncodeToString(seed) != vector.seed {
+			t.Fatalf("%s: seed %x", vector.mnemonic, seed)
+		}
+	}
+
+	invalid := []string{
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"legal winner thank year wave sausage worth useful legal winner thank yellow yellow",
+		"letter advice cage absurd amount doctor acoustic avoid letter advice caged above",
+		"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo, wrong",
+		"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo why",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"",
+	}
+	for _, mnemonic := range invalid {
+		if _, err := MnemonicSeed(mnemonic, ""); err == nil {
+			t.Fatalf("%q accepted", mnemonic)
+		}
+	}
+}
+
+func TestHDDerivation(t *testing.T) {
+	// Test vector 1 of the BIP-32 specification.
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	key, err := hdMasterKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		index     uint32
+		key       string
+		chainCode string
+	}{
+		{hdHardened, "edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea", "47fdacbd0f1097043b78c63c20c34ef4ed9a111d980047ad16282c7ae6236141"},
+		{1, "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368", "2a7857631386ba23dacac34180dd1983734e444fdbf774041578e9b6adb37c19"},
+		{hdHardened + 2, "cbce0d719ecf7431d88e6a89fa1483e02e35092af60c042b1df2ff59fa424dca", "04466b9cc8e161e966409ca52986c584f07e9dc81f735db683c3ff6ec7b1503f"},
+		{2, "0f479245fb19a38a1954c5c7c0ebab2f9bdfd96a17563ef28a6a4b1a2a764ef4", "cfb71883f01676f587d023cc53a35bc7f88f724b1f8c2892ac1275ac822a3edd"},
+		{1000000000, "471b76e389e528d6de6d816857e012c5455051cad6660850e58372a6c3e6e7c8", "c783e67b921d2beb8f6b389cc646d7263b4145701dadd2161548a8b078e65e9e"},
+	}
+	if hex.EncodeToString(key.key) != "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35" ||
+		hex.EncodeToString(key.chainCode) != "873dff81c02f525623fd1fe5167eac3a55a049de3d314bb42ee227ffed37d508" {
+		t.Fatalf("master key %x chain code %x", key.key, key.chainCode)
+	}
+	for i, step := range steps {
+		key, err = key.child(step.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key.key) != step.key || hex.EncodeToString(key.chainCode) != step.chainCode {
+			t.Fatalf("step %d: key %x chain code %x", i, key.key, key.chainCode)
+		}
+	}
+}
+
+func testHDWallet(t *testing.T) *hdWallet {
+	t.Helper()
+	wallet, err := openHDWallet(HDSettings{
+		Mnemonic:  "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		IndexFile: filepath.Join(t.TempDir(), "index"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wallet
+}
+
+func TestHDWalletAddress(t *testing.T) {
+	wallet := testHDWallet(t)
+	// The first address wallets derive for this mnemonic at m/44'/60'/0'/0/0.
+	address, err := wallet.address(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.Hex() != "0x9858EfFD232B4033E47d90003D41EC34EcaEda94" {
+		t.Fatalf("address %s", address.Hex())
+	}
+}
+
+func TestHDWalletSharedIndexFile(t *testing.T) {
+	wallet := testHDWallet(t)
+	shared, err := openHDWallet(HDSettings{
+		Mnemonic:  "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		IndexFile: wallet.indexFile,
+	})
+	if err != nil || shared != wallet {
+		t.Fatalf("same settings opened a different wallet: %v", err)
+	}
+	if _, err := openHDWallet(HDSettings{
+		Mnemonic:       "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		DerivationPath: "m/44'/60'/1'/0",
+		IndexFile:      wallet.indexFile,
+	}); err == nil {
+		t.Fatal("conflicting derivation path accepted")
+	}
+	if _, err := openHDWallet(HDSettings{
+		Mnemonic:  "legal winner thank year wave sausage worth useful legal winner thank yellow",
+		IndexFile: wallet.indexFile,
+	}); err == nil {
+		t.Fatal("conflicting mnemonic accepted")
+	}
+}
+
+func TestHDWalletActiveSet(t *testing.T) {
+	wallet := testHDWallet(t)
+	wallet.use("ETH")
+	wallet.use("USDT")
+	first, err := wallet.reserveIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := wallet.reserveIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexes := wallet.indexes(); len(indexes) != 3 || indexes[0] != 0 || indexes[1] != first || indexes[2] != second {
+		t.Fatalf("indexes %v", indexes)
+	}
+
+	// Recent addresses stay active even when empty.
+	for _, user := range []string{"ETH", "USDT"} {
+		if err := wallet.found(user, first, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(wallet.indexes()) != 3 {
+		t.Fatalf("recent index retired")
+	}
+
+	wallet.active[first] = time.Now().Add(-hdRetireAfter - time.Hour).Unix()
+	wallet.active[second] = wallet.active[first]
+	if err := wallet.found("ETH", second, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := wallet.found("USDT", second, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := wallet.found("ETH", first, true); err != nil {
+		t.Fatal(err)
+	}
+	if indexes := wallet.indexes(); len(indexes) != 2 || indexes[1] != second {
+		t.Fatalf("indexes %v", indexes)
+	}
+
+	// The active set survives a restart.
+	delete(hdWallets, wallet.indexFile)
+	reopened, err := openHDWallet(HDSettings{
+		Mnemonic:  "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		IndexFile: wallet.indexFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexes := reopened.indexes(); len(indexes) != 2 || indexes[1] != second || reopened.nextIndex != second+1 {
+		t.Fatalf("reopened with indexes %v next %d", indexes, reopened.nextIndex)
+	}
+}
+
+func TestLegacyKeystoreAccounts(t *testing.T) {
+	dir := t.TempDir()
+	store := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	account, err := store.NewAccount("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := openHDWallet(HDSettings{
+		Mnemonic:               "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		IndexFile:              filepath.Join(t.TempDir(), "index"),
+		LegacyKeystoreDir:      dir,
+		LegacyKeystorePassword: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainID := big.NewInt(1)
+	h := &EthHandler{wallet: wallet, chainID: chainID, signer: types.LatestSignerForChainID(chainID), legacyEmpty: make(map[common.Address]bool)}
+
+	accounts, err := getSweepAccounts(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 || !accounts[1].legacy || accounts[1].address != account.Address {
+		t.Fatalf("accounts %+v", accounts)
+	}
+	fees := &ethFees{baseFee: big.NewInt(1), tipCap: big.NewInt(1), feeCap: big.NewInt(2)}
+	signed, err := h.signTransaction(accounts[1], h.newTransaction(0, common.Address{}, big.NewInt(1), 21000, fees, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from, err := types.Sender(h.signer, signed); err != nil || from != account.Address {
+		t.Fatalf("signed by %s: %v", from.Hex(), err)
+	}
+
+	// Once swept empty the legacy account is left alone.
+	if err := h.found(accounts[1], true); err != nil {
+		t.Fatal(err)
+	}
+	if accounts, err = getSweepAccounts(h); err != nil || len(accounts) != 1 {
+		t.Fatalf("accounts %+v: %v", accounts, err)
+	}
+}
@@ -0,0 +1,438 @@
+package cryptoManager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LndSettings configure a handler for an LND node's REST API. URL includes
+// the scheme, e.g. https://127.0.0.1:8080. TLSCert is the node's tls.cert,
+// leave it empty for a node behind a publicly trusted certificate or a
+// plain http node.
+type LndSettings struct {
+	URL      string `json:"url"`
+	Macaroon string `json:"macaroon"`
+	TLSCert  string `json:"tlsCert"`
+	// InvoiceExpirySeconds is how long deposit invoices can be paid.
+	InvoiceExpirySeconds int `json:"invoiceExpirySeconds"`
+	// FeeLimitPercent caps routing fees of payouts.
+	FeeLimitPercent int `json:"feeLimitPercent"`
+	// PaymentTimeoutSeconds bounds a payout, which can take longer than a
+	// regular call while routes are tried.
+	PaymentTimeoutSeconds int    `json:"paymentTimeoutSeconds"`
+	TimeoutSeconds        int    `json:"timeoutSeconds"`
+	Sign                  string `json:"sign"`
+	// InvoicePrefix is the network's BOLT11 prefix, lnbc for mainnet.
+	InvoicePrefix string `json:"invoicePrefix"`
+}
+
+// LndHandler handles Lightning BTC. Invoices take the place of deposit
+// addresses and payment hashes the place of txids. A settled payment counts
+// as one confirmation. Amounts are in satoshis.
+type LndHandler struct {
+	url            string
+	macaroon       string
+	sign           string
+	invoicePrefix  string
+	invoiceExpiry  time.Duration
+	feeLimit       int
+	paymentTimeout time.Duration
+	client         *http.Client
+	sendMutex      sync.Mutex
+	// callTimeout bounds each call on top of the caller's context.
+	callTimeout time.Duration
+	// hashes caches the payment hash of invoices already decoded.
+	hashes      map[string]string
+	hashesMutex sync.Mutex
+}
+
+func init() {
+	RegisterHandler("lnd", func(raw json.RawMessage) (CryptoHandler, error) {
+		var settings LndSettings
+		if err := decodeSettings(raw, &settings); err != nil {
+			return nil, err
+		}
+		return NewLndHandler(settings)
+	})
+}
+
+func NewLndHandler(settings LndSettings) (*LndHandler, error) {
+	if err := ResolveSecrets(&settings.URL, &settings.Macaroon, &settings.TLSCert); err != nil {
+		return nil, err
+	}
+	if settings.URL == "" {
+		return nil, fmt.Errorf("lnd url missing")
+	}
+	if settings.InvoiceExpirySeconds <= 0 {
+		settings.InvoiceExpirySeconds = 900
+	}
+	if settings.FeeLimitPercent <= 0 {
+		settings.FeeLimitPercent = 1
+	}
+	if settings.PaymentTimeoutSeconds <= 0 {
+		settings.PaymentTimeoutSeconds = 60
+	}
+	if settings.InvoicePrefix == "" {
+		settings.InvoicePrefix = "lnbc"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if settings.TLSCert != "" {
+		cert, err := os.ReadFile(settings.TLSCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cert) {
+			return nil, fmt.Errorf("invalid tls certificate %s", settings.TLSCert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	handler := &LndHandler{
+		url:            strings.TrimSuffix(settings.URL, "/"),
+		macaroon:       settings.Macaroon,
+		sign:           settings.Sign,
+		invoicePrefix:  settings.InvoicePrefix,
+		invoiceExpiry:  time.Duration(settings.InvoiceExpirySeconds) * time.Second,
+		feeLimit:       settings.FeeLimitPercent,
+		paymentTimeout: time.Duration(settings.PaymentTimeoutSeconds) * time.Second,
+		client:         &http.Client{Transport: transport},
+		callTimeout:    callTimeout(settings.TimeoutSeconds),
+		hashes:         make(map[string]string),
+	}
+
+	if _, err := handler.call(context.Background(), "GET", "/v1/getinfo", nil); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+func (h *LndHandler) call(ctx context.Context, method, path string, body interface{}) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.callTimeout)
+	defer cancel()
+	return h.do(ctx, method, path, body)
+}
+
+func (h *LndHandler) do(ctx context.Context, method, path string, body interface{}) (map[string]interface{}, error) {
+	var reader io.Reader
+	if body != nil {
+		jsonBody, _ := json.Marshal(body)
+		reader = bytes.NewReader(jsonBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, h.url+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("request creation failed: %v", err)
+	}
+	if h.macaroon != "" {
+		req.Header.Set("Grpc-Metadata-macaroon", h.macaroon)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("lnd request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := result["message"].(string)
+		if message == "" {
+			message, _ = result["error"].(string)
+		}
+		return nil, &lndError{status: resp.StatusCode, message: message}
+	}
+	return result, nil
+}
+
+// lndError is an error the node answered with, as opposed to a call that
+// failed on the way.
+type lndError struct {
+	status  int
+	message string
+}
+
+func (e *lndError) Error() string {
+	return fmt.Sprintf("lnd error %d: %s", e.status, e.message)
+}
+
+// lndBytes converts a bytes field, which the REST API encodes as base64,
+// to hex.
+func lndBytes(value interface{}) (string, bool) {
+	encoded, ok := value.(string)
+	if !ok {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return hex.EncodeToString(decoded), true
+}
+
+// ValidateAddress checks the checksum and network of an invoice. Whether it
+// can be paid is left to CheckInvoice, which asks the node.
+func (h *LndHandler) ValidateAddress(invoice string) error {
+	return validateBolt11Invoice(invoice, h.invoicePrefix)
+}
+
+func (h *LndHandler) CheckBalance(ctx context.Context) (Amount, error) {
+	result, err := h.call(ctx, "GET", "/v1/balance/channels", nil)
+	if err != nil {
+		return Amount{}, fmt.Errorf("failed to get balance: %v", err)
+	}
+	local, _ := result["local_balance"].(map[string]interface{})
+	balance, ok := jsonInt64(local["sat"])
+	if !ok {
+		return Amount{}, fmt.Errorf("unexpected response format from channel balance")
+	}
+	return NewAmount(balance), nil
+}
+
+// GenerateNewAddress creates an invoice for any amount. Orders use
+// NewInvoice so the customer pays exactly the order's amount.
+func (h *LndHandler) GenerateNewAddress(ctx context.Context) (CryptoAddress, error) {
+	return h.NewInvoice(ctx, NewAmount(0), "")
+}
+
+func (h *LndHandler) NewInvoice(ctx context.Context, amount Amount, memo string) (CryptoAddress, error) {
+	result, err := h.call(ctx, "POST", "/v1/invoices", map[string]interface{}{
+		"value":  amount.String(),
+		"memo":   memo,
+		"expiry": fmt.Sprintf("%d", int64(h.invoiceExpiry/time.Second)),
+	})
+	if err != nil {
+		return CryptoAddress{}, fmt.Errorf("failed to create invoice: %v", err)
+	}
+	invoice, ok := result["payment_request"].(string)
+	if !ok {
+		return CryptoAddress{}, fmt.Errorf("unexpected response format from add invoice")
+	}
+	hash, ok := lndBytes(result["r_hash"])
+	if !ok {
+		return CryptoAddress{}, fmt.Errorf("unexpected response format from add invoice")
+	}
+	h.hashesMutex.Lock()
+	h.hashes[invoice] = hash
+	h.hashesMutex.Unlock()
+	return CryptoAddress{
+		Address:   invoice,
+		StartTime: time.Now().Unix(),
+	}, nil
+}
+
+type lndInvoice struct {
+	hash      string
+	amount    Amount
+	expiresAt time.Time
+}
+
+func (h *LndHandler) decodeInvoice(ctx context.Context, invoice string) (*lndInvoice, error) {
+	result, err := h.call(ctx, "GET", "/v1/payreq/"+url.PathEscape(invoice), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice: %v", err)
+	}
+	hash, _ := result["payment_hash"].(string)
+	amount, ok := jsonInt64(result["num_satoshis"])
+	timestamp, _ := jsonInt64(result["timestamp"])
+	expiry, _ := jsonInt64(result["expiry"])
+	if hash == "" || !ok {
+		return nil, fmt.Errorf("unexpected response format from decode invoice")
+	}
+	return &lndInvoice{
+		hash:      hash,
+		amount:    NewAmount(amount),
+		expiresAt: time.Unix(timestamp+expiry, 0),
+	}, nil
+}
+
+func (h *LndHandler) invoiceHash(ctx context.Context, invoice string) (string, error) {
+	h.hashesMutex.Lock()
+	hash, ok := h.hashes[invoice]
+	h.hashesMutex.Unlock()
+	if ok {
+		return hash, nil
+	}
+	decoded, err := h.decodeInvoice(ctx, invoice)
+	if err != nil {
+		return "", err
+	}
+	h.hashesMutex.Lock()
+	h.hashes[invoice] = decoded.hash
+	h.hashesMutex.Unlock()
+	return decoded.hash, nil
+}
+
+// CheckInvoice accepts an invoice the customer wants to be paid with. An
+// invoice with an amount has to ask for exactly amount, and is only paid
+// when the order settles on that amount. Invoices without an amount take
+// whatever the deposit is worth.
+func (h *LndHandler) CheckInvoice(ctx context.Context, invoice string, amount Amount) error {
+	decoded, err := h.decodeInvoice(ctx, invoice)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(decoded.expiresAt) {
+		return fmt.Errorf("invoice expired")
+	}
+	if !decoded.amount.IsZero() && decoded.amount.Cmp(amount) != 0 {
+		return fmt.Errorf("invoice asks for %s %s, expected %s %s", decoded.amount.Format(8), h.sign, amount.Format(8), h.sign)
+	}
+	return nil
+}
+
+func (h *LndHandler) lookupInvoice(ctx context.Context, hash string) (*CryptoTransaction, error) {
+	result, err := h.call(ctx, "GET", "/v1/invoice/"+hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	state, _ := result["state"].(string)
+	paid, _ := jsonInt64(result["amt_paid_sat"])
+	transaction := &CryptoTransaction{
+		Txid:   hash,
+		Amount: NewAmount(paid),
+		Status: TxPending,
+	}
+	switch state {
+	case "SETTLED":
+		transaction.Confirmations = 1
+		transaction.Status = TxConfirmed
+	case "CANCELED":
+		transaction.Status = TxConflicted
+	}
+	return transaction, nil
+}
+
+func (h *LndHandler) GetAddressTransaction(ctx context.Context, address CryptoAddress) (*CryptoTransaction, error) {
+	hash, err := h.invoiceHash(ctx, address.Address)
+	if err != nil {
+		return nil, err
+	}
+	transaction, err := h.lookupInvoice(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if transaction.Status == TxConflicted {
+		return nil, fmt.Errorf("invoice %s canceled", hash)
+	}
+	if transaction.Confirmations == 0 {
+		return nil, nil
+	}
+	return transaction, nil
+}
+
+// GetTransactionDetails looks the hash up as a received invoice first and
+// as an outgoing payment otherwise.
+func (h *LndHandler) GetTransactionDetails(ctx context.Context, hash string) (*CryptoTransaction, error) {
+	if transaction, err := h.lookupInvoice(ctx, hash); err == nil {
+		return transaction, nil
+	}
+
+	return h.lookupPayment(ctx, hash)
+}
+
+// lookupPayment finds an outgoing payment among the node's latest payments.
+func (h *LndHandler) lookupPayment(ctx context.Context, hash string) (*CryptoTransaction, error) {
+	result, err := h.call(ctx, "GET", "/v1/payments?include_incomplete=true&reversed=true&max_payments=1000", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list payments: %v", err)
+	}
+	payments, _ := result["payments"].([]interface{})
+	for _, raw := range payments {
+		payment, _ := raw.(map[string]interface{})
+		if paymentHash, _ := payment["payment_hash"].(string); paymentHash != hash {
+			continue
+		}
+		value, _ := jsonInt64(payment["value_sat"])
+		transaction := &CryptoTransaction{
+			Txid:   hash,
+			Amount: NewAmount(value),
+			Status: TxPending,
+		}
+		switch status, _ := payment["status"].(string); status {
+		case "SUCCEEDED":
+			transaction.Confirmations = 1
+			transaction.Status = TxConfirmed
+		case "FAILED":
+			// A failed payment never moved funds, like a conflicted
+			// transaction.
+			transaction.Status = TxConflicted
+		}
+		return transaction, nil
+	}
+	return &CryptoTransaction{Txid: hash, Status: TxNotFound}, nil
+}
+
+// Send pays the invoice in address. An invoice with an amount is only paid
+// when it asks for exactly amount.
+func (h *LndHandler) Send(ctx context.Context, address CryptoAddress, amount Amount) ([]string, error) {
+	h.sendMutex.Lock()
+	defer h.sendMutex.Unlock()
+	invoice, err := h.decodeInvoice(ctx, address.Address)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(invoice.expiresAt) {
+		return nil, fmt.Errorf("invoice expired at %s", invoice.expiresAt.UTC().Format(time.RFC3339))
+	}
+	if !invoice.amount.IsZero() && invoice.amount.Cmp(amount) != 0 {
+		return nil, fmt.Errorf("invoice amount %s %s does not match payout amount %s %s", invoice.amount.Format(8), h.sign, amount.Format(8), h.sign)
+	}
+
+	balance, err := h.CheckBalance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Cmp(amount) < 0 {
+		return nil, fmt.Errorf("insufficient funds: available %s %s, required %s %s", balance.Format(8), h.sign, amount.Format(8), h.sign)
+	}
+
+	request := map[string]interface{}{
+		"payment_request": address.Address,
+		"fee_limit":       map[string]interface{}{"percent": fmt.Sprintf("%d", h.feeLimit)},
+	}
+	if invoice.amount.IsZero() {
+		request["amt"] = amount.String()
+	}
+	payCtx, cancel := context.WithTimeout(ctx, h.paymentTimeout)
+	defer cancel()
+	result, err := h.do(payCtx, "POST", "/v1/channels/transactions", request)
+	if err != nil {
+		// After a timeout or a broken connection the payment can still be
+		// in flight and settle later. It is only given up when the node
+		// lists it as failed, or refused it and never started it.
+		// Otherwise the order follows it by hash.
+		var refused *lndError
+		payment, lookupErr := h.lookupPayment(ctx, invoice.hash)
+		if lookupErr == nil && (payment.Status == TxConflicted || payment.Status == TxNotFound && errors.As(err, &refused)) {
+			return nil, fmt.Errorf("payment failed: %v", err)
+		}
+		return []string{invoice.hash}, nil
+	}
+	if paymentError, _ := result["payment_error"].(string); paymentError != "" {
+		return nil, fmt.Errorf("payment failed: %s", paymentError)
+	}
+	return []string{invoice.hash}, nil
+}
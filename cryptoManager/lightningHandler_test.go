@@ -0,0 +1,276 @@
+package cryptoManager
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakePayreq struct {
+	hash    string
+	amount  int64
+	created time.Time
+	expiry  int64
+}
+
+// fakeLnd answers the REST calls of the handler. Payments posted to it are
+// recorded under the invoice's hash with payStatus, and the call answers
+// after payDelay with payError.
+type fakeLnd struct {
+	mutex     sync.Mutex
+	payreqs   map[string]fakePayreq
+	payments  map[string]string
+	payStatus string
+	payDelay  time.Duration
+	payError  string
+	// payRefused answers the payment call with an error status without
+	// recording the payment.
+	payRefused string
+	paid       []map[string]interface{}
+}
+
+func newFakeLnd(t *testing.T) (*fakeLnd, *httptest.Server) {
+	node := &fakeLnd{
+		payreqs:   make(map[string]fakePayreq),
+		payments:  make(map[string]string),
+		payStatus: "SUCCEEDED",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Grpc-Metadata-macaroon") != "macaroon" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{"message": "permission denied"})
+			return
+		}
+		node.mutex.Lock()
+		defer node.mutex.Unlock()
+		respond := func(status int, body map[string]interface{}) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(body)
+		}
+		switch {
+		case r.URL.Path == "/v1/getinfo":
+			respond(http.StatusOK, map[string]interface{}{"alias": "fake"})
+		case r.URL.Path == "/v1/balance/channels":
+			respond(http.StatusOK, map[string]interface{}{"local_balance": map[string]interface{}{"sat": "1000000"}})
+		case strings.HasPrefix(r.URL.Path, "/v1/payreq/"):
+			payreq, ok := node.payreqs[strings.TrimPrefix(r.URL.Path, "/v1/payreq/")]
+			if !ok {
+				respond(http.StatusInternalServerError, map[string]interface{}{"message": "invalid index"})
+				return
+			}
+			respond(http.StatusOK, map[string]interface{}{
+				"payment_hash": payreq.hash,
+				"num_satoshis": jsonString(payreq.amount),
+				"timestamp":    jsonString(payreq.created.Unix()),
+				"expiry":       jsonString(payreq.expiry),
+			})
+		case strings.HasPrefix(r.URL.Path, "/v1/invoice/"):
+			respond(http.StatusNotFound, map[string]interface{}{"message": "there are no existing invoices"})
+		case r.URL.Path == "/v1/payments":
+			var payments []interface{}
+			for hash, status := range node.payments {
+				payments = append(payments, map[string]interface{}{"payment_hash": hash, "value_sat": "1000", "status": status})
+			}
+			respond(http.StatusOK, map[string]interface{}{"payments": payments})
+		case r.URL.Path == "/v1/channels/transactions":
+			var request map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&request)
+			node.paid = append(node.paid, request)
+			if node.payRefused != "" {
+				respond(http.StatusInternalServerError, map[string]interface{}{"message": node.payRefused})
+				return
+			}
+			payreq := node.payreqs[request["payment_request"].(string)]
+			node.payments[payreq.hash] = node.payStatus
+			delay, payError := node.payDelay, node.payError
+			node.mutex.Unlock()
+			time.Sleep(delay)
+			node.mutex.Lock()
+			respond(http.StatusOK, map[string]interface{}{"payment_error": payError})
+		default:
+			respond(http.StatusNotFound, map[string]interface{}{"message": "not found"})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return node, server
+}
+
+func jsonString(value int64) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func (n *fakeLnd) invoice(name, hash string, amount int64, expiry time.Duration) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.payreqs[name] = fakePayreq{hash: hash, amount: amount, created: time.Now(), expiry: int64(expiry / time.Second)}
+	return name
+}
+
+func newTestLndHandler(t *testing.T, server *httptest.Server) *LndHandler {
+	handler, err := NewLndHandler(LndSettings{
+		URL:                   server.URL,
+		Macaroon:              "macaroon",
+		Sign:                  "BTC",
+		PaymentTimeoutSeconds: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewLndHandler: %v", err)
+	}
+	return handler
+}
+
+func TestLndCheckInvoice(t *testing.T) {
+	node, server := newFakeLnd(t)
+	handler := newTestLndHandler(t, server)
+	ctx := context.Background()
+
+	open := node.invoice("lnbc1open", "aa", 0, time.Hour)
+	if err := handler.CheckInvoice(ctx, open, NewAmount(1000)); err != nil {
+		t.Fatalf("zero amount invoice rejected: %v", err)
+	}
+	fixed := node.invoice("lnbc1fixed", "bb", 1000, time.Hour)
+	if err := handler.CheckInvoice(ctx, fixed, NewAmount(1000)); err != nil {
+		t.Fatalf("invoice for the order amount rejected: %v", err)
+	}
+	if err := handler.CheckInvoice(ctx, fixed, NewAmount(1200)); err == nil {
+		t.Fatal("invoice for a different amount accepted")
+	}
+	expired := node.invoice("lnbc1expired", "cc", 0, -time.Minute)
+	if err := handler.CheckInvoice(ctx, expired, NewAmount(1000)); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("expired invoice: %v", err)
+	}
+}
+
+func TestLndSend(t *testing.T) {
+	node, server := newFakeLnd(t)
+	handler := newTestLndHandler(t, server)
+	ctx := context.Background()
+
+	open := node.invoice("lnbc1open", "aa", 0, time.Hour)
+	txids, err := handler.Send(ctx, CryptoAddress{Address: open}, NewAmount(1500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txids) != 1 || txids[0] != "aa" {
+		t.Fatalf("txids %v", txids)
+	}
+	if amt := node.paid[0]["amt"]; amt != "1500" {
+		t.Fatalf("zero amount invoice paid with amt %v", amt)
+	}
+
+	transaction, err := handler.GetTransactionDetails(ctx, "aa")
+	if err != nil || transaction.Status != TxConfirmed {
+		t.Fatalf("payment %+v: %v", transaction, err)
+	}
+}
+
+func TestLndSendRejectsInvoice(t *testing.T) {
+	node, server := newFakeLnd(t)
+	handler := newTestLndHandler(t, server)
+	ctx := context.Background()
+
+	for _, invoice := range []string{
+		node.invoice("lnbc1lower", "aa", 900, time.Hour),
+		node.invoice("lnbc1higher", "bb", 1100, time.Hour),
+		node.invoice("lnbc1expired", "cc", 0, -time.Minute),
+	} {
+		if _, err := handler.Send(ctx, CryptoAddress{Address: invoice}, NewAmount(1000)); err == nil {
+			t.Fatalf("%s paid", invoice)
+		}
+	}
+	if len(node.paid) != 0 {
+		t.Fatalf("payments attempted: %v", node.paid)
+	}
+
+	exact := node.invoice("lnbc1exact", "dd", 1000, time.Hour)
+	if _, err := handler.Send(ctx, CryptoAddress{Address: exact}, NewAmount(1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := node.paid[0]["amt"]; ok {
+		t.Fatal("amt set for an invoice with an amount")
+	}
+}
+
+func TestLndSendFailure(t *testing.T) {
+	node, server := newFakeLnd(t)
+	handler := newTestLndHandler(t, server)
+	ctx := context.Background()
+
+	node.payStatus = "FAILED"
+	node.payError = "no_route"
+	invoice := node.invoice("lnbc1noroute", "aa", 0, time.Hour)
+	if _, err := handler.Send(ctx, CryptoAddress{Address: invoice}, NewAmount(1000)); err == nil || !strings.Contains(err.Error(), "no_route") {
+		t.Fatalf("failed payment: %v", err)
+	}
+
+	// Refused by the node before it started the payment.
+	node.payRefused = "self-payments not allowed"
+	invoice = node.invoice("lnbc1refused", "bb", 0, time.Hour)
+	if _, err := handler.Send(ctx, CryptoAddress{Address: invoice}, NewAmount(1000)); err == nil {
+		t.Fatal("refused payment reported as sent")
+	}
+}
+
+func TestLndSendTimeout(t *testing.T) {
+	node, server := newFakeLnd(t)
+	handler := newTestLndHandler(t, server)
+	ctx := context.Background()
+
+	// The call times out while the payment is still in flight, the hash is
+	// returned so the order keeps following it.
+	node.payStatus = "IN_FLIGHT"
+	node.payDelay = 2 * time.Second
+	invoice := node.invoice("lnbc1slow", "aa", 0, time.Hour)
+	txids, err := handler.Send(ctx, CryptoAddress{Address: invoice}, NewAmount(1000))
+	if err != nil {
+		t.Fatalf("in flight payment reported as failed: %v", err)
+	}
+	if len(txids) != 1 || txids[0] != "aa" {
+		t.Fatalf("txids %v", txids)
+	}
+	transaction, err := handler.GetTransactionDetails(ctx, "aa")
+	if err != nil || transaction.Status != TxPending {
+		t.Fatalf("payment %+v: %v", transaction, err)
+	}
+
+	// The call times out and the node lists the payment as failed.
+	node.payStatus = "FAILED"
+	invoice = node.invoice("lnbc1failed", "bb", 0, time.Hour)
+	if _, err := handler.Send(ctx, CryptoAddress{Address: invoice}, NewAmount(1000)); err == nil {
+		t.Fatal("failed payment reported as sent")
+	}
+}
+
+func TestLndSendUnreachable(t *testing.T) {
+	node, server := newFakeLnd(t)
+	handler := newTestLndHandler(t, server)
+	invoice := node.invoice("lnbc1open", "aa", 0, time.Hour)
+
+	// The connection breaks during the payment and the node cannot be
+	// asked about it, the payment is left to be followed rather than
+	// refunded.
+	transport := handler.client.Transport
+	handler.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/v1/channels/transactions" || r.URL.Path == "/v1/payments" {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return transport.RoundTrip(r)
+	})
+	txids, err := handler.Send(context.Background(), CryptoAddress{Address: invoice}, NewAmount(1000))
+	if err != nil || len(txids) != 1 || txids[0] != "aa" {
+		t.Fatalf("txids %v: %v", txids, err)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -2,9 +2,11 @@ package cryptoManager
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/icholy/digest"
+	"math"
 	"net/http"
 	"sort"
 	"strings"
@@ -12,12 +14,6 @@ import (
 	"time"
 )
 
-const xmrhost = "<XMRNODERPCHOST>"
-const xmrWallethost = "<XMRWALLETRPCHOST>"
-const xmruser = "<XMRRPCUSER>"
-const xmrpass = "<XMRRPCPASS>"
-const xmrwalletName = "<WALLETNAME>"
-
 var XmrBlockchainExplorers = []*CryptoTransactionExplorer{
 	{
 		Name:     "localmonero",
@@ -29,16 +25,23 @@ var XmrBlockchainExplorers = []*CryptoTransactionExplorer{
 }
 
 type XmrHandler struct {
-	host          string
+	daemons       *endpointSet
 	xmrWalletHost string
 	user          string
 	pass          string
 	wallet        string
 	client        *http.Client
 	sendMutex     sync.Mutex
+	network       moneroNetwork
+	// callTimeout bounds each RPC call on top of the caller's context.
+	callTimeout time.Duration
+}
+
+func callGlobalXmrRPC(ctx context.Context, handler *XmrHandler, method string, params map[string]interface{}) (map[string]interface{}, error) {
+	return callDaemonXmrRPC(ctx, handler, handler.daemons.Current(), method, params)
 }
 
-func callGlobalXmrRPC(handler *XmrHandler, method string, params map[string]interface{}) (map[string]interface{}, error) {
+func callDaemonXmrRPC(ctx context.Context, handler *XmrHandler, host, method string, params map[string]interface{}) (map[string]interface{}, error) {
 	requestBody := map[string]interface{}{
 		"id":     "xmr-handler",
 		"method": method,
@@ -46,7 +49,10 @@ func callGlobalXmrRPC(handler *XmrHandler, method string, params map[string]inte
 	}
 	jsonBody, _ := json.Marshal(requestBody)
 
-	req, err := http.NewRequest("POST", "http://"+handler.host+"/json_rpc", bytes.NewReader(jsonBody))
+	ctx, cancel := context.WithTimeout(ctx, handler.callTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+host+"/json_rpc", bytes.NewReader(jsonBody))
 	if err != nil {
 		return nil, err
 	}
@@ -54,26 +60,29 @@ func callGlobalXmrRPC(handler *XmrHandler, method string, params map[string]inte
 
 	resp, err := handler.client.Do(req)
 	if err != nil {
+		handler.daemons.failed(host)
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
 		return nil, err
 	}
 
 	if errResult := result["error"]; errResult != nil {
 		errorMap := errResult.(map[string]interface{})
-		code := errorMap["code"].(float64)
-		message := errorMap["message"].(string)
-		return nil, fmt.Errorf("RPC error %d: %s", int(code), message)
+		code, _ := jsonInt64(errorMap["code"])
+		message, _ := errorMap["message"].(string)
+		return nil, fmt.Errorf("RPC error %d: %s", code, message)
 	}
 
 	return result, nil
 }
 
-func callWalletXmrRPC(handler *XmrHandler, method string, params map[string]interface{}) (map[string]interface{}, error) {
+func callWalletXmrRPC(ctx context.Context, handler *XmrHandler, method string, params map[string]interface{}) (map[string]interface{}, error) {
 	requestBody := map[string]interface{}{
 		"id":     "xmr-handler",
 		"method": method,
@@ -81,7 +90,10 @@ func callWalletXmrRPC(handler *XmrHandler, method string, params map[string]inte
 	}
 	jsonBody, _ := json.Marshal(requestBody)
 
-	req, err := http.NewRequest("POST", "http://"+handler.xmrWalletHost+"/json_rpc", bytes.NewReader(jsonBody))
+	ctx, cancel := context.WithTimeout(ctx, handler.callTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+handler.xmrWalletHost+"/json_rpc", bytes.NewReader(jsonBody))
 	if err != nil {
 		return nil, err
 	}
@@ -94,48 +106,84 @@ func callWalletXmrRPC(handler *XmrHandler, method string, params map[string]inte
 	defer resp.Body.Close()
 
 	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
 		return nil, err
 	}
 
 	if errResult := result["error"]; errResult != nil {
 		errorMap := errResult.(map[string]interface{})
-		code := errorMap["code"].(float64)
-		message := errorMap["message"].(string)
-		return nil, fmt.Errorf("RPC error %d: %s", int(code), message)
+		code, _ := jsonInt64(errorMap["code"])
+		message, _ := errorMap["message"].(string)
+		return nil, fmt.Errorf("RPC error %d: %s", code, message)
 	}
 
 	return result, nil
 }
 
-func NewXmrHandler() (*XmrHandler, error) {
+type XmrSettings struct {
+	NodeSettings
+	WalletHost string `json:"walletHost"`
+	// Network is mainnet, stagenet or testnet, it decides which addresses
+	// are accepted.
+	Network string `json:"network"`
+}
+
+func init() {
+	RegisterHandler("monero", func(raw json.RawMessage) (CryptoHandler, error) {
+		var settings XmrSettings
+		if err := decodeSettings(raw, &settings); err != nil {
+			return nil, err
+		}
+		return NewXmrHandler(settings)
+	})
+}
+
+func NewXmrHandler(settings XmrSettings) (*XmrHandler, error) {
+	if err := settings.resolve(); err != nil {
+		return nil, err
+	}
+	if err := ResolveSecrets(&settings.WalletHost); err != nil {
+		return nil, err
+	}
+
+	if settings.Network == "" {
+		settings.Network = "mainnet"
+	}
+	network, ok := moneroNetworks[settings.Network]
+	if !ok {
+		return nil, fmt.Errorf("unknown monero network %q", settings.Network)
+	}
+
 	tempClient := &http.Client{Transport: &digest.Transport{
-		Username: xmruser,
-		Password: xmrpass,
-	},
-		Timeout: 10 * time.Second}
+		Username: settings.User,
+		Password: settings.Password,
+	}}
 
 	handler := &XmrHandler{
-		host:          xmrhost,
-		xmrWalletHost: xmrWallethost,
-		user:          xmruser,
-		pass:          xmrpass,
-		wallet:        xmrwalletName,
-
-		client: tempClient,
+		xmrWalletHost: settings.WalletHost,
+		user:          settings.User,
+		pass:          settings.Password,
+		wallet:        settings.Wallet,
+		network:       network,
+
+		client:      tempClient,
+		callTimeout: callTimeout(settings.TimeoutSeconds),
 	}
-	_, err := callGlobalXmrRPC(handler, "get_version", nil)
+	handler.daemons = newEndpointSet("XMR", hostList(settings.Host, settings.Hosts), nil, settings.Failover, handler.probeDaemon, handler.activateDaemon)
+	_, err := callGlobalXmrRPC(context.Background(), handler, "get_version", nil)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = callWalletXmrRPC(handler, "open_wallet", map[string]interface{}{
+	_, err = callWalletXmrRPC(context.Background(), handler, "open_wallet", map[string]interface{}{
 		"filename": handler.wallet,
 	})
 	if err == nil {
 		return handler, nil
 	} else if strings.Contains(err.Error(), "file not found") {
-		_, err = callWalletXmrRPC(handler, "create_wallet", map[string]interface{}{
+		_, err = callWalletXmrRPC(context.Background(), handler, "create_wallet", map[string]interface{}{
 			"filename": handler.wallet,
 			"language": "English",
 		})
@@ -151,32 +199,93 @@ func NewXmrHandler() (*XmrHandler, error) {
 	}
 }
 
-func (h *XmrHandler) CheckBalance() (float64, error) {
-	result, err := callWalletXmrRPC(h, "get_balance", map[string]interface{}{
+// probeDaemon reads the height and connections of a daemon. A daemon that
+// has not caught up with the network is not used.
+func (h *XmrHandler) probeDaemon(ctx context.Context, host string) (endpointStatus, error) {
+	result, err := callDaemonXmrRPC(ctx, h, host, "get_info", nil)
+	if err != nil {
+		return endpointStatus{}, err
+	}
+	info, _ := result["result"].(map[string]interface{})
+	height, ok := jsonInt64(info["height"])
+	if !ok {
+		return endpointStatus{}, fmt.Errorf("unexpected response format from get_info")
+	}
+	if synchronized, _ := info["synchronized"].(bool); !synchronized {
+		return endpointStatus{height: height}, fmt.Errorf("daemon not synchronized")
+	}
+	incoming, _ := jsonInt64(info["incoming_connections_count"])
+	outgoing, _ := jsonInt64(info["outgoing_connections_count"])
+	return endpointStatus{height: height, peers: int(incoming + outgoing)}, nil
+}
+
+// activateDaemon points the wallet RPC at another daemon.
+func (h *XmrHandler) activateDaemon(ctx context.Context, host string) error {
+	_, err := callWalletXmrRPC(ctx, h, "set_daemon", map[string]interface{}{
+		"address":  "http://" + host,
+		"username": h.user,
+		"password": h.pass,
+		"trusted":  false,
+	})
+	return err
+}
+
+func (h *XmrHandler) Endpoints() []EndpointHealth {
+	return h.daemons.Endpoints()
+}
+
+func (h *XmrHandler) ValidateAddress(address string) error {
+	return validateMoneroAddress(address, h.network)
+}
+
+func (h *XmrHandler) CheckBalance(ctx context.Context) (Amount, error) {
+	result, err := callWalletXmrRPC(ctx, h, "get_balance", map[string]interface{}{
 		"account_index": 0,
 	})
 	if err != nil {
-		return 0, fmt.Errorf("failed to get balance: %v", err)
+		return Amount{}, fmt.Errorf("failed to get balance: %v", err)
 	}
 
 	result, ok := result["result"].(map[string]interface{})
 	if !ok {
-		return 0, fmt.Errorf("unexpected response format from get_balance")
+		return Amount{}, fmt.Errorf("unexpected response format from get_balance")
 	}
 
-	atomicBalance, ok := result["unlocked_balance"].(float64)
+	balance, ok := jsonAmount(result["unlocked_balance"], 0)
 
 	if !ok {
-		return 0, fmt.Errorf("unexpected response format from get_balance")
+		return Amount{}, fmt.Errorf("unexpected response format from get_balance")
 	}
 
-	balance := atomicBalance / 1e12
-
 	return balance, nil
 }
 
-func (h *XmrHandler) GenerateNewAddress() (CryptoAddress, error) {
-	result, err := callWalletXmrRPC(h, "create_address", map[string]interface{}{"account_index": 0})
+func getXmrWalletHeight(ctx context.Context, h *XmrHandler) (int64, error) {
+	result, err := callWalletXmrRPC(ctx, h, "get_height", nil)
+	if err != nil {
+		return 0, err
+	}
+	result, ok := result["result"].(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("unexpected response format from get_height")
+	}
+	height, ok := jsonInt64(result["height"])
+	if !ok {
+		return 0, fmt.Errorf("unexpected response format from get_height")
+	}
+	return height, nil
+}
+
+// GenerateNewAddress creates a subaddress of account 0. StartTime holds the
+// wallet height at creation and Index the subaddress index, deposits are
+// looked up by both.
+func (h *XmrHandler) GenerateNewAddress(ctx context.Context) (CryptoAddress, error) {
+	height, err := getXmrWalletHeight(ctx, h)
+	if err != nil {
+		return CryptoAddress{}, err
+	}
+
+	result, err := callWalletXmrRPC(ctx, h, "create_address", map[string]interface{}{"account_index": 0})
 	if err != nil {
 		return CryptoAddress{}, err
 	}
@@ -190,16 +299,30 @@ func (h *XmrHandler) GenerateNewAddress() (CryptoAddress, error) {
 	if !ok {
 		return CryptoAddress{}, fmt.Errorf("unexpected response format from create_address")
 	}
+	index, ok := jsonInt64(result["address_index"])
+	if !ok || index <= 0 {
+		return CryptoAddress{}, fmt.Errorf("unexpected response format from create_address")
+	}
 	return CryptoAddress{
 		Address:   address,
-		StartTime: time.Now().Unix(),
+		StartTime: height,
+		Index:     uint32(index),
 	}, nil
 }
 
-func (h *XmrHandler) GetAddressTransaction(address CryptoAddress) (*CryptoTransaction, error) {
-	result, err := callWalletXmrRPC(h, "get_transfers", map[string]interface{}{
-		"in":            true,
-		"account_index": 0,
+func (h *XmrHandler) GetAddressTransaction(ctx context.Context, address CryptoAddress) (*CryptoTransaction, error) {
+	// min_height is exclusive, a deposit mined at the creation height counts.
+	minHeight := address.StartTime - 1
+	if minHeight < 0 {
+		minHeight = 0
+	}
+	result, err := callWalletXmrRPC(ctx, h, "get_transfers", map[string]interface{}{
+		"in":               true,
+		"pool":             true,
+		"account_index":    0,
+		"subaddr_indices":  []uint32{address.Index},
+		"filter_by_height": true,
+		"min_height":       minHeight,
 	})
 	if err != nil {
 		return nil, err
@@ -211,44 +334,39 @@ func (h *XmrHandler) GetAddressTransaction(address CryptoAddress) (*CryptoTransa
 		return nil, fmt.Errorf("unexpected response format from get_transfers")
 	}
 
-	inBalances, ok := result["in"].([]interface{})
-
 	type txInfo struct {
 		Txid          string
 		Confirmations int64
-		Amount        float64
-		Time          int64
+		Amount        Amount
+		Height        int64
 	}
 
 	var relevantTransactions []txInfo
 
-	for _, balance := range inBalances {
+	inBalances, _ := result["in"].([]interface{})
+	poolBalances, _ := result["pool"].([]interface{})
+	for _, balance := range append(inBalances, poolBalances...) {
 		txMap, ok := balance.(map[string]interface{})
 		if !ok {
 			continue
 		}
 		txAddress, _ := txMap["address"].(string)
-		category, _ := txMap["type"].(string)
-		if category != "in" || txAddress != address.Address {
-			continue
-		}
-		var txTime int64
-		if txTimeVal, ok := txMap["timestamp"].(float64); ok {
-			txTime = int64(txTimeVal)
-		} else {
+		if txAddress != address.Address {
 			continue
 		}
-		if txTime < address.StartTime {
-			continue
+		height, _ := jsonInt64(txMap["height"])
+		if height == 0 {
+			// Still in the pool, it sorts after everything mined.
+			height = math.MaxInt64
 		}
-		confirmations, _ := txMap["confirmations"].(float64)
-		amount, _ := txMap["amount"].(float64)
+		confirmations, _ := jsonInt64(txMap["confirmations"])
+		amount, _ := jsonAmount(txMap["amount"], 0)
 		txid, _ := txMap["txid"].(string)
 		relevantTransactions = append(relevantTransactions, txInfo{
 			Txid:          txid,
-			Confirmations: int64(confirmations),
-			Amount:        amount / 1e12,
-			Time:          txTime,
+			Confirmations: confirmations,
+			Amount:        amount,
+			Height:        height,
 		})
 	}
 
@@ -257,24 +375,27 @@ func (h *XmrHandler) GetAddressTransaction(address CryptoAddress) (*CryptoTransa
 	}
 
 	sort.Slice(relevantTransactions, func(i, j int) bool {
-		return relevantTransactions[i].Time < relevantTransactions[j].Time
+		return relevantTransactions[i].Height < relevantTransactions[j].Height
 	})
 
-	newest := relevantTransactions[0]
+	first := relevantTransactions[0]
 
 	return &CryptoTransaction{
-		Txid:          newest.Txid,
-		Confirmations: newest.Confirmations,
-		Amount:        newest.Amount,
+		Txid:          first.Txid,
+		Confirmations: first.Confirmations,
+		Amount:        first.Amount,
 		Explorers:     XmrBlockchainExplorers,
 	}, nil
 }
 
-func (h *XmrHandler) GetTransactionDetails(txid string) (*CryptoTransaction, error) {
-	result, err := callWalletXmrRPC(h, "get_transfer_by_txid", map[string]interface{}{
+func (h *XmrHandler) GetTransactionDetails(ctx context.Context, txid string) (*CryptoTransaction, error) {
+	result, err := callWalletXmrRPC(ctx, h, "get_transfer_by_txid", map[string]interface{}{
 		"txid":          txid,
 		"account_index": 0,
 	})
+	if err != nil && strings.Contains(err.Error(), "Transaction not found") {
+		return &CryptoTransaction{Txid: txid, Status: TxNotFound, Explorers: XmrBlockchainExplorers}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -290,24 +411,29 @@ func (h *XmrHandler) GetTransactionDetails(txid string) (*CryptoTransaction, err
 		return nil, fmt.Errorf("unexpected response format from get_transfer_by_txid")
 	}
 
-	confirmations, _ := transfer["confirmations"].(float64)
-	amount, _ := transfer["amount"].(float64)
+	confirmations, _ := jsonInt64(transfer["confirmations"])
+	amount, _ := jsonAmount(transfer["amount"], 0)
+	status := confirmationStatus(confirmations)
+	if transferType, _ := transfer["type"].(string); transferType == "failed" {
+		status = TxConflicted
+	}
 
 	return &CryptoTransaction{
 		Txid:          txid,
-		Confirmations: int64(confirmations),
-		Amount:        amount / 1e12,
+		Confirmations: confirmations,
+		Amount:        amount,
 		Explorers:     XmrBlockchainExplorers,
+		Status:        status,
 	}, nil
 }
 
-func (h *XmrHandler) Send(address CryptoAddress, amount float64) ([]string, error) {
+func (h *XmrHandler) Send(ctx context.Context, address CryptoAddress, amount Amount) ([]string, error) {
 	h.sendMutex.Lock()
 	defer h.sendMutex.Unlock()
-	result, err := callWalletXmrRPC(h, "transfer", map[string]interface{}{
+	result, err := callWalletXmrRPC(ctx, h, "transfer", map[string]interface{}{
 		"destinations": []interface{}{
 			map[string]interface{}{
-				"amount":  amount * 1e12,
+				"amount":  amount.Big(),
 				"address": address.Address,
 			},
 		},
@@ -335,3 +461,40 @@ func (h *XmrHandler) Send(address CryptoAddress, amount float64) ([]string, erro
 	return []string{txid}, nil
 
 }
+
+func (h *XmrHandler) PaymentProof(ctx context.Context, txid string, address CryptoAddress) (*PaymentProof, error) {
+	result, err := callWalletXmrRPC(ctx, h, "get_tx_key", map[string]interface{}{"txid": txid})
+	if err != nil {
+		return nil, err
+	}
+	result, ok := result["result"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected response format from get_tx_key")
+	}
+	txKey, ok := result["tx_key"].(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response format from get_tx_key")
+	}
+
+	result, err = callWalletXmrRPC(ctx, h, "get_tx_proof", map[string]interface{}{
+		"txid":    txid,
+		"address": address.Address,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result, ok = result["result"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected response format from get_tx_proof")
+	}
+	signature, ok := result["signature"].(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response format from get_tx_proof")
+	}
+
+	return &PaymentProof{
+		TxKey:   txKey,
+		Proof:   signature,
+		Address: address.Address,
+	}, nil
+}
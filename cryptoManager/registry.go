@@ -0,0 +1,120 @@
+package cryptoManager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandlerFactory builds a handler from the raw "settings" object of its
+// entry in SupportedCryptos.json.
+type HandlerFactory func(settings json.RawMessage) (CryptoHandler, error)
+
+var (
+	factories      = make(map[string]HandlerFactory)
+	factoriesMutex sync.RWMutex
+)
+
+// RegisterHandler makes a handler type available to NewHandler. Chain
+// implementations call it from their init functions.
+func RegisterHandler(handlerType string, factory HandlerFactory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if _, exists := factories[handlerType]; exists {
+		panic("cryptoManager: handler type registered twice: " + handlerType)
+	}
+	factories[handlerType] = factory
+}
+
+func NewHandler(handlerType string, settings json.RawMessage) (CryptoHandler, error) {
+	factoriesMutex.RLock()
+	factory, ok := factories[handlerType]
+	factoriesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown handler type %q", handlerType)
+	}
+	return factory(settings)
+}
+
+// NodeSettings are the connection settings shared by the wallet RPC based
+// handlers.
+type NodeSettings struct {
+	Host     string `json:"host"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Wallet   string `json:"wallet"`
+	// TimeoutSeconds bounds every RPC call made by the handler.
+	TimeoutSeconds int `json:"timeoutSeconds"`
+	// Hosts are further nodes to fail over to, with the credentials of
+	// Host. UTXO handlers only fail over to nodes holding the same wallet
+	// as Host, one whose wallet does not own the issued deposit addresses
+	// is not used.
+	Hosts    []string       `json:"hosts"`
+	Failover EndpointPolicy `json:"failover"`
+}
+
+func (s *NodeSettings) resolve() error {
+	for i := range s.Hosts {
+		if err := ResolveSecrets(&s.Hosts[i]); err != nil {
+			return err
+		}
+	}
+	return ResolveSecrets(&s.Host, &s.User, &s.Password, &s.Wallet)
+}
+
+// ResolveSecret expands a settings value. "env:NAME" reads the environment
+// variable NAME, "file:PATH" reads the file at PATH with surrounding
+// whitespace trimmed, and anything else is used as is.
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return resolved, nil
+	case strings.HasPrefix(value, "file:"):
+		contents, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %v", err)
+		}
+		return strings.TrimSpace(string(contents)), nil
+	default:
+		return value, nil
+	}
+}
+
+// ResolveSecrets resolves each value in place.
+func ResolveSecrets(values ...*string) error {
+	for _, value := range values {
+		resolved, err := ResolveSecret(*value)
+		if err != nil {
+			return err
+		}
+		*value = resolved
+	}
+	return nil
+}
+
+const defaultCallTimeout = 10 * time.Second
+
+func callTimeout(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultCallTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func decodeSettings(raw json.RawMessage, settings interface{}) error {
+	if len(raw) == 0 {
+		return fmt.Errorf("handler settings missing")
+	}
+	if err := json.Unmarshal(raw, settings); err != nil {
+		return fmt.Errorf("invalid handler settings: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package cryptoManager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SimDeposit scripts a deposit every new address receives, AfterSeconds
+// after the address is handed out. Amount is in whole coins.
+type SimDeposit struct {
+	AfterSeconds int    `json:"afterSeconds"`
+	Amount       string `json:"amount"`
+}
+
+// SimSettings configure an in-memory chain for exercising orders without
+// nodes. A block is mined every BlockSeconds, 0 mines only on request.
+// FailureRates injects errors into handler methods by name
+// ("GenerateNewAddress", "Send", ...), a rate of 1 fails every call.
+type SimSettings struct {
+	Sign         string             `json:"sign"`
+	Precision    int                `json:"precision"`
+	Balance      string             `json:"balance"`
+	BlockSeconds int                `json:"blockSeconds"`
+	Deposits     []SimDeposit       `json:"deposits"`
+	FailureRates map[string]float64 `json:"failureRates"`
+}
+
+type simTransaction struct {
+	txid    string
+	address string
+	amount  Amount
+	// height is the block that includes the transaction, 0 while it waits
+	// in the mempool.
+	height int64
+	seen   time.Time
+}
+
+type simScheduled struct {
+	address string
+	amount  Amount
+	due     time.Time
+}
+
+// SimHandler is a simulated chain kept in memory. Deposits, blocks, reorgs
+// and failures are scripted in its settings or driven through its exported
+// methods.
+type SimHandler struct {
+	mutex        sync.Mutex
+	sign         string
+	precision    int
+	balance      Amount
+	blockTime    time.Duration
+	started      time.Time
+	mined        int64
+	deposits     []SimDeposit
+	scheduled    []simScheduled
+	transactions map[string]*simTransaction
+	order        []*simTransaction
+	dropped      map[string]*simTransaction
+	failureRates map[string]float64
+	failNext     map[string]int
+	addresses    int
+	// owned holds the addresses handed out, payments to them add to the
+	// balance.
+	owned map[string]bool
+}
+
+func init() {
+	RegisterHandler("simulated", func(raw json.RawMessage) (CryptoHandler, error) {
+		var settings SimSettings
+		if err := decodeSettings(raw, &settings); err != nil {
+			return nil, err
+		}
+		return NewSimHandler(settings)
+	})
+}
+
+func NewSimHandler(settings SimSettings) (*SimHandler, error) {
+	if settings.Precision <= 0 {
+		settings.Precision = 8
+	}
+	balance := NewAmount(0)
+	if settings.Balance != "" {
+		var err error
+		balance, err = ParseAmount(settings.Balance, settings.Precision)
+		if err != nil {
+			return nil, fmt.Errorf("invalid balance: %v", err)
+		}
+	}
+	for _, deposit := range settings.Deposits {
+		if _, err := ParseAmount(deposit.Amount, settings.Precision); err != nil {
+			return nil, fmt.Errorf("invalid deposit amount %s: %v", deposit.Amount, err)
+		}
+	}
+	return &SimHandler{
+		sign:         settings.Sign,
+		precision:    settings.Precision,
+		balance:      balance,
+		blockTime:    time.Duration(settings.BlockSeconds) * time.Second,
+		started:      time.Now(),
+		deposits:     settings.Deposits,
+		transactions: make(map[string]*simTransaction),
+		dropped:      make(map[string]*simTransaction),
+		failureRates: settings.FailureRates,
+		failNext:     make(map[string]int),
+		owned:        make(map[string]bool),
+	}, nil
+}
+
+func simID() string {
+	buffer := make([]byte, 32)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// Precision is the number of decimals amounts of the chain have.
+func (h *SimHandler) Precision() int {
+	return h.precision
+}
+
+func (h *SimHandler) height() int64 {
+	height := h.mined
+	if h.blockTime > 0 {
+		height += int64(time.Since(h.started) / h.blockTime)
+	}
+	return height
+}
+
+// advance moves due scripted deposits into the mempool and mempool
+// transactions into the current block.
+func (h *SimHandler) advance() {
+	now := time.Now()
+	remaining := h.scheduled[:0]
+	for _, scheduled := range h.scheduled {
+		if now.Before(scheduled.due) {
+			remaining = append(remaining, scheduled)
+			continue
+		}
+		h.addTransaction(scheduled.address, scheduled.amount)
+	}
+	h.scheduled = remaining
+
+	height := h.height()
+	for _, transaction := range h.order {
+		if transaction.height == 0 && height > 0 && h.includedAfter(transaction) {
+			transaction.height = height
+		}
+	}
+}
+
+// includedAfter tells whether a block was mined since the transaction was
+// seen. Without timed blocks every Mine call includes the mempool.
+func (h *SimHandler) includedAfter(transaction *simTransaction) bool {
+	if h.blockTime == 0 {
+		return false
+	}
+	return time.Since(transaction.seen) >= h.blockTime
+}
+
+func (h *SimHandler) addTransaction(address string, amount Amount) *simTransaction {
+	transaction := &simTransaction{
+		txid:    simID(),
+		address: address,
+		amount:  amount,
+		seen:    time.Now(),
+	}
+	h.transactions[transaction.txid] = transaction
+	h.order = append(h.order, transaction)
+	if h.owned[address] {
+		h.balance = h.balance.Add(amount)
+	}
+	return transaction
+}
+
+func (h *SimHandler) confirmations(transaction *simTransaction) int64 {
+	if transaction.height == 0 {
+		return 0
+	}
+	return h.height() - transaction.height + 1
+}
+
+// fail returns the injected error for method, if any.
+func (h *SimHandler) fail(method string) error {
+	if h.failNext[method] > 0 {
+		h.failNext[method]--
+		return fmt.Errorf("simulated %s failure", method)
+	}
+	rate := h.failureRates[method]
+	if rate <= 0 {
+		return nil
+	}
+	if mathrand.Float64() < rate {
+		return fmt.Errorf("simulated %s failure", method)
+	}
+	return nil
+}
+
+// Deposit puts a payment to address in the mempool and returns its txid.
+func (h *SimHandler) Deposit(address string, amount Amount) string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.addTransaction(address, amount).txid
+}
+
+// Mine mines blocks, the first of them includes the mempool.
+func (h *SimHandler) Mine(blocks int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if blocks <= 0 {
+		return
+	}
+	h.advance()
+	h.mined++
+	height := h.height()
+	for _, transaction := range h.order {
+		if transaction.height == 0 {
+			transaction.height = height
+		}
+	}
+	h.mined += int64(blocks - 1)
+}
+
+// Reorg drops the last depth blocks. Their transactions go back to the
+// mempool, or are forgotten entirely with drop, as after a double spend or
+// an eviction. Dropped transactions can be sent again with Rebroadcast.
+func (h *SimHandler) Reorg(depth int, drop bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	height := h.height()
+	h.mined -= int64(depth)
+	kept := h.order[:0]
+	for _, transaction := range h.order {
+		if transaction.height > height-int64(depth) {
+			if drop {
+				delete(h.transactions, transaction.txid)
+				h.dropped[transaction.txid] = transaction
+				if h.owned[transaction.address] {
+					h.balance = h.balance.Sub(transaction.amount)
+				}
+				continue
+			}
+			transaction.height = 0
+			transaction.seen = time.Now()
+		}
+		kept = append(kept, transaction)
+	}
+	h.order = kept
+}
+
+// FailNext makes the next count calls of method fail.
+func (h *SimHandler) FailNext(method string, count int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.failNext[method] += count
+}
+
+// SetBalance replaces the wallet balance, to exercise payouts beyond it.
+func (h *SimHandler) SetBalance(balance Amount) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.balance = balance
+}
+
+func (h *SimHandler) GenerateNewAddress(ctx context.Context) (CryptoAddress, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.fail("GenerateNewAddress"); err != nil {
+		return CryptoAddress{}, err
+	}
+	h.addresses++
+	address := fmt.Sprintf("sim%s%d%s", strings.ToLower(h.sign), h.addresses, simID()[:16])
+	h.owned[address] = true
+	for _, deposit := range h.deposits {
+		amount, _ := ParseAmount(deposit.Amount, h.precision)
+		h.scheduled = append(h.scheduled, simScheduled{
+			address: address,
+			amount:  amount,
+			due:     time.Now().Add(time.Duration(deposit.AfterSeconds) * time.Second),
+		})
+	}
+	return CryptoAddress{
+		Address:   address,
+		StartTime: time.Now().Unix(),
+		Index:     uint32(h.addresses),
+	}, nil
+}
+
+func (h *SimHandler) CheckBalance(ctx context.Context) (Amount, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.fail("CheckBalance"); err != nil {
+		return Amount{}, err
+	}
+	return h.balance, nil
+}
+
+func (h *SimHandler) GetAddressTransaction(ctx context.Context, address CryptoAddress) (*CryptoTransaction, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.fail("GetAddressTransaction"); err != nil {
+		return nil, err
+	}
+	h.advance()
+	for _, transaction := range h.order {
+		if transaction.address != address.Address {
+			continue
+		}
+		return h.cryptoTransaction(transaction), nil
+	}
+	return nil, nil
+}
+
+func (h *SimHandler) GetTransactionDetails(ctx context.Context, txid string) (*CryptoTransaction, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.fail("GetTransactionDetails"); err != nil {
+		return nil, err
+	}
+	h.advance()
+	transaction, ok := h.transactions[txid]
+	if !ok {
+		return &CryptoTransaction{Txid: txid, Status: TxNotFound}, nil
+	}
+	return h.cryptoTransaction(transaction), nil
+}
+
+func (h *SimHandler) cryptoTransaction(transaction *simTransaction) *CryptoTransaction {
+	confirmations := h.confirmations(transaction)
+	return &CryptoTransaction{
+		Txid:          transaction.txid,
+		Confirmations: confirmations,
+		Amount:        transaction.amount,
+		Status:        confirmationStatus(confirmations),
+	}
+}
+
+// Rebroadcast puts a transaction dropped by Reorg back in the mempool.
+func (h *SimHandler) Rebroadcast(ctx context.Context, txid string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.fail("Rebroadcast"); err != nil {
+		return err
+	}
+	if _, ok := h.transactions[txid]; ok {
+		return nil
+	}
+	transaction, ok := h.dropped[txid]
+	if !ok {
+		return fmt.Errorf("transaction %s not found", txid)
+	}
+	delete(h.dropped, txid)
+	transaction.height = 0
+	transaction.seen = time.Now()
+	h.transactions[txid] = transaction
+	h.order = append(h.order, transaction)
+	if h.owned[transaction.address] {
+		h.balance = h.balance.Add(transaction.amount)
+	}
+	return nil
+}
+
+func (h *SimHandler) Send(ctx context.Context, address CryptoAddress, amount Amount) ([]string, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.fail("Send"); err != nil {
+		return nil, err
+	}
+	if h.balance.Cmp(amount) < 0 {
+		return nil, fmt.Errorf("insufficient funds: available %s %s, required %s %s", h.balance.Format(h.precision), h.sign, amount.Format(h.precision), h.sign)
+	}
+	h.balance = h.balance.Sub(amount)
+	return []string{h.addTransaction(address.Address, amount).txid}, nil
+}
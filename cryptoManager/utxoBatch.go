@@ -0,0 +1,252 @@
+package cryptoManager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UtxoBatchPolicy enables batched payouts. Payouts are collected for
+// WindowSeconds, or until MaxOutputs are waiting, and sent together with
+// sendmany. A window of 0 sends every payout on its own.
+type UtxoBatchPolicy struct {
+	WindowSeconds int `json:"windowSeconds"`
+	MaxOutputs    int `json:"maxOutputs"`
+}
+
+type utxoPayout struct {
+	address string
+	amount  Amount
+	done    chan utxoPayoutResult
+}
+
+type utxoPayoutResult struct {
+	id  string
+	err error
+}
+
+type utxoBatch struct {
+	mutex   sync.Mutex
+	pending []*utxoPayout
+	timer   *time.Timer
+}
+
+// outputID names one output of a batched transaction as txid:vout.
+func outputID(txid string, vout int64) string {
+	return txid + ":" + strconv.FormatInt(vout, 10)
+}
+
+// splitOutputID splits an id returned by Send. Ids of unbatched payouts have
+// no output index, vout is -1 for them.
+func splitOutputID(id string) (string, int64) {
+	txid, vout, found := strings.Cut(id, ":")
+	if !found {
+		return id, -1
+	}
+	index, err := strconv.ParseInt(vout, 10, 64)
+	if err != nil {
+		return id, -1
+	}
+	return txid, index
+}
+
+// queuePayout adds a payout to the next batch and waits for it to be sent.
+func (h *UtxoHandler) queuePayout(ctx context.Context, address CryptoAddress, amount Amount) ([]string, error) {
+	payout := &utxoPayout{
+		address: address.Address,
+		amount:  amount,
+		done:    make(chan utxoPayoutResult, 1),
+	}
+
+	h.batch.mutex.Lock()
+	h.batch.pending = append(h.batch.pending, payout)
+	if h.batch.timer == nil {
+		h.batch.timer = time.AfterFunc(time.Duration(h.batchPolicy.WindowSeconds)*time.Second, h.flushBatch)
+	}
+	full := h.batchPolicy.MaxOutputs > 0 && len(h.batch.pending) >= h.batchPolicy.MaxOutputs
+	h.batch.mutex.Unlock()
+	if full {
+		go h.flushBatch()
+	}
+
+	select {
+	case result := <-payout.done:
+		if result.err != nil {
+			return nil, result.err
+		}
+		return []string{result.id}, nil
+	case <-ctx.Done():
+	}
+
+	h.batch.mutex.Lock()
+	for i, queued := range h.batch.pending {
+		if queued == payout {
+			h.batch.pending = append(h.batch.pending[:i], h.batch.pending[i+1:]...)
+			h.batch.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	h.batch.mutex.Unlock()
+	// Already part of a batch being sent, its result is still needed.
+	result := <-payout.done
+	if result.err != nil {
+		return nil, result.err
+	}
+	return []string{result.id}, nil
+}
+
+// flushBatch sends the waiting payouts. sendmany takes every address once,
+// a second payout to the same address waits for the next batch.
+func (h *UtxoHandler) flushBatch() {
+	h.batch.mutex.Lock()
+	if h.batch.timer != nil {
+		h.batch.timer.Stop()
+		h.batch.timer = nil
+	}
+	var batch, deferred []*utxoPayout
+	seen := make(map[string]bool)
+	for _, payout := range h.batch.pending {
+		if seen[payout.address] || (h.batchPolicy.MaxOutputs > 0 && len(batch) >= h.batchPolicy.MaxOutputs) {
+			deferred = append(deferred, payout)
+			continue
+		}
+		seen[payout.address] = true
+		batch = append(batch, payout)
+	}
+	h.batch.pending = deferred
+	if len(deferred) > 0 {
+		h.batch.timer = time.AfterFunc(time.Duration(h.batchPolicy.WindowSeconds)*time.Second, h.flushBatch)
+	}
+	h.batch.mutex.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	results := h.sendBatch(context.Background(), batch)
+	for i, payout := range batch {
+		payout.done <- results[i]
+	}
+}
+
+func (h *UtxoHandler) sendBatch(ctx context.Context, batch []*utxoPayout) []utxoPayoutResult {
+	results := make([]utxoPayoutResult, len(batch))
+	fail := func(err error) []utxoPayoutResult {
+		for i := range results {
+			results[i].err = err
+		}
+		return results
+	}
+
+	h.sendMutex.Lock()
+	defer h.sendMutex.Unlock()
+	balance, err := h.CheckBalance(ctx)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Payouts that do not fit the balance fail on their own, the rest are
+	// still sent.
+	amounts := make(map[string]interface{})
+	var subtractFrom []interface{}
+	var included []int
+	total := NewAmount(0)
+	for i, payout := range batch {
+		next := total.Add(payout.amount)
+		if balance.Cmp(next) < 0 {
+			results[i].err = fmt.Errorf("insufficient funds: available %s %s, required %s %s", balance.Sub(total).Format(h.precision), h.sign, payout.amount.Format(h.precision), h.sign)
+			continue
+		}
+		total = next
+		amounts[payout.address] = json.Number(payout.amount.Format(h.precision))
+		subtractFrom = append(subtractFrom, payout.address)
+		included = append(included, i)
+	}
+	if len(included) == 0 {
+		return results
+	}
+	if !h.fee.SubtractFeeFromAmount {
+		subtractFrom = []interface{}{}
+	}
+
+	params := []interface{}{"", amounts, 1, "", subtractFrom}
+	if h.fee.ConfTarget > 0 {
+		feeRate, capped, err := h.estimateFeeRate(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		if capped {
+			params = append(params, true, nil, nil, feeRate)
+		} else {
+			params = append(params, true, h.fee.ConfTarget, h.fee.EstimateMode)
+		}
+	}
+	result, err := h.rpcWalletCall(ctx, "sendmany", params)
+	if err != nil {
+		return fail(err)
+	}
+	txid, ok := result["result"].(string)
+	if !ok {
+		return fail(fmt.Errorf("invalid transaction response format"))
+	}
+
+	outputs, err := h.sendOutputs(ctx, txid)
+	if err != nil {
+		// The batch is broadcast, only the output indexes are unknown.
+		for _, i := range included {
+			results[i].id = txid
+		}
+		return results
+	}
+	for _, i := range included {
+		vout, ok := outputs[batch[i].address]
+		if !ok {
+			results[i].id = txid
+			continue
+		}
+		results[i].id = outputID(txid, vout)
+	}
+	return results
+}
+
+// sendOutputs maps the recipients of a wallet transaction to their output
+// indexes.
+func (h *UtxoHandler) sendOutputs(ctx context.Context, txid string) (map[string]int64, error) {
+	details, err := h.transactionDetails(ctx, txid)
+	if err != nil {
+		return nil, err
+	}
+	outputs := make(map[string]int64)
+	for _, detail := range details {
+		category, _ := detail["category"].(string)
+		address, _ := detail["address"].(string)
+		vout, ok := jsonInt64(detail["vout"])
+		if category != "send" || !ok {
+			continue
+		}
+		outputs[address] = vout
+	}
+	return outputs, nil
+}
+
+func (h *UtxoHandler) transactionDetails(ctx context.Context, txid string) ([]map[string]interface{}, error) {
+	result, err := h.rpcWalletCall(ctx, "gettransaction", []interface{}{txid})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve transaction: %v", err)
+	}
+	txData, ok := result["result"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid transaction response format")
+	}
+	rawDetails, _ := txData["details"].([]interface{})
+	var details []map[string]interface{}
+	for _, raw := range rawDetails {
+		if detail, ok := raw.(map[string]interface{}); ok {
+			details = append(details, detail)
+		}
+	}
+	return details, nil
+}
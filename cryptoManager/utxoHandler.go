@@ -0,0 +1,911 @@
+package cryptoManager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExplorerSettings describes a block explorer in SupportedCryptos.json. The
+// URL contains a {txid} placeholder.
+type ExplorerSettings struct {
+	Name string `json:"name"`
+	Icon string `json:"icon"`
+	URL  string `json:"url"`
+}
+
+func newExplorers(settings []ExplorerSettings) []*CryptoTransactionExplorer {
+	explorers := make([]*CryptoTransactionExplorer, 0, len(settings))
+	for _, explorer := range settings {
+		url := explorer.URL
+		explorers = append(explorers, &CryptoTransactionExplorer{
+			Name:     explorer.Name,
+			IconPath: explorer.Icon,
+			UrlResolver: func(txid string) string {
+				return strings.ReplaceAll(url, "{txid}", txid)
+			},
+		})
+	}
+	return explorers
+}
+
+// UtxoFeePolicy decides the fee rate of payouts. The rate is estimated for
+// ConfTarget blocks and capped at MaxSatPerVByte, payouts signal RBF and are
+// bumped after BumpAfterSeconds unconfirmed. Leave ConfTarget at 0 for nodes
+// whose sendtoaddress does not accept fee arguments (Dogecoin, Bitcoin Cash).
+type UtxoFeePolicy struct {
+	ConfTarget            int     `json:"confTarget"`
+	EstimateMode          string  `json:"estimateMode"`
+	SubtractFeeFromAmount bool    `json:"subtractFeeFromAmount"`
+	MaxSatPerVByte        float64 `json:"maxSatPerVByte"`
+	BumpAfterSeconds      int     `json:"bumpAfterSeconds"`
+}
+
+// UtxoAddressFormat describes the chain's addresses: the bech32 prefix of
+// segwit addresses, the prefix of Bitcoin Cash cashaddrs ("bitcoincash")
+// and the version bytes of base58check ones.
+type UtxoAddressFormat struct {
+	Hrp            string `json:"hrp"`
+	CashAddrPrefix string `json:"cashAddrPrefix"`
+	Base58Versions []int  `json:"base58Versions"`
+}
+
+// UtxoSettings configure a bitcoind compatible node. An empty wallet uses the
+// node's default wallet for nodes without multiwallet support.
+type UtxoSettings struct {
+	NodeSettings
+	Sign        string             `json:"sign"`
+	Precision   int                `json:"precision"`
+	AddressType string             `json:"addressType"`
+	Explorers   []ExplorerSettings `json:"explorers"`
+	Fee         UtxoFeePolicy      `json:"fee"`
+	Batch       UtxoBatchPolicy    `json:"batch"`
+	Format      UtxoAddressFormat  `json:"addressFormat"`
+	// ColdWallet is a watch-only wallet on the node holding the cold
+	// storage descriptors, refills are funded from it.
+	ColdWallet string `json:"coldWallet"`
+	// Signing "psbt" leaves payouts to an offline signer, for wallets whose
+	// keys are not on the node. Anything else signs with the node wallet.
+	Signing string `json:"signing"`
+}
+
+type UtxoHandler struct {
+	nodes       *endpointSet
+	user        string
+	pass        string
+	wallet      string
+	coldWallet  string
+	psbt        bool
+	sign        string
+	precision   int
+	addressType string
+	fee         UtxoFeePolicy
+	explorers   []*CryptoTransactionExplorer
+	client      *http.Client
+	sendMutex   sync.Mutex
+	// lastAddress is the last deposit address issued, a node is only failed
+	// over to when its wallet owns it.
+	lastAddress      string
+	lastAddressMutex sync.Mutex
+	batchPolicy      UtxoBatchPolicy
+	hrp              string
+	cashPrefix       string
+	versions         []byte
+	batch            utxoBatch
+	// replacements maps bumped transactions to their replacement, orders
+	// sharing a batched payout all ask to bump it.
+	replacements map[string]string
+	// callTimeout bounds each RPC call on top of the caller's context.
+	callTimeout time.Duration
+}
+
+func init() {
+	RegisterHandler("bitcoind", func(raw json.RawMessage) (CryptoHandler, error) {
+		var settings UtxoSettings
+		if err := decodeSettings(raw, &settings); err != nil {
+			return nil, err
+		}
+		return NewUtxoHandler(settings)
+	})
+}
+
+func NewUtxoHandler(settings UtxoSettings) (*UtxoHandler, error) {
+	if err := settings.resolve(); err != nil {
+		return nil, err
+	}
+	if settings.Precision <= 0 {
+		settings.Precision = 8
+	}
+	if settings.Fee.ConfTarget > 0 && settings.Fee.EstimateMode == "" {
+		settings.Fee.EstimateMode = "CONSERVATIVE"
+	}
+
+	handler := &UtxoHandler{
+		user:        settings.User,
+		pass:        settings.Password,
+		wallet:      settings.Wallet,
+		coldWallet:  settings.ColdWallet,
+		psbt:        settings.Signing == "psbt",
+		sign:        settings.Sign,
+		precision:   settings.Precision,
+		addressType: settings.AddressType,
+		fee:         settings.Fee,
+		batchPolicy: settings.Batch,
+		hrp:         settings.Format.Hrp,
+		cashPrefix:  settings.Format.CashAddrPrefix,
+		explorers:   newExplorers(settings.Explorers),
+		client:      &http.Client{},
+		callTimeout: callTimeout(settings.TimeoutSeconds),
+	}
+
+	handler.nodes = newEndpointSet(settings.Sign, hostList(settings.Host, settings.Hosts), nil, settings.Failover, handler.probeNode, handler.activateNode)
+
+	for _, version := range settings.Format.Base58Versions {
+		handler.versions = append(handler.versions, byte(version))
+	}
+
+	if handler.wallet == "" {
+		_, err := handler.rpcCall(context.Background(), "", "getwalletinfo", nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := handler.startWallet(context.Background()); err != nil {
+			return nil, err
+		}
+		return handler, nil
+	}
+
+	result, err := handler.rpcCall(context.Background(), "", "listwallets", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	wallets, ok := result["result"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected response format from listwallets")
+	}
+
+	walletLoaded := false
+	for _, w := range wallets {
+		if name, _ := w.(string); name == handler.wallet {
+			walletLoaded = true
+			break
+		}
+	}
+
+	if !walletLoaded {
+		_, err := handler.rpcCall(context.Background(), "", "loadwallet", []interface{}{handler.wallet})
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") || strings.Contains(err.Error(), "Wallet file verification failed") {
+				createParams := []interface{}{
+					handler.wallet, // wallet name
+					false,          // disable_private_keys
+					false,          // blank
+					"",             // passphrase
+					true,           // avoid_reuse
+				}
+				_, createErr := handler.rpcCall(context.Background(), "", "createwallet", createParams)
+				if createErr != nil {
+					return nil, fmt.Errorf("failed to create wallet: %v", createErr)
+				}
+			} else {
+				return nil, err
+			}
+		}
+	}
+
+	if err := handler.startWallet(context.Background()); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+// startWallet prepares the loaded wallet for the handler.
+func (h *UtxoHandler) startWallet(ctx context.Context) error {
+	if h.psbt {
+		// PSBTs prepared before a restart are gone, their inputs are
+		// released.
+		if _, err := h.rpcWalletCall(ctx, "lockunspent", []interface{}{true}); err != nil {
+			return fmt.Errorf("failed to unlock inputs: %v", err)
+		}
+	}
+	if len(h.nodes.endpoints) > 1 {
+		return h.loadLastAddress(ctx)
+	}
+	return nil
+}
+
+// loadLastAddress finds the newest address of the wallet, the one
+// activateNode checks other nodes with until a deposit address is issued.
+func (h *UtxoHandler) loadLastAddress(ctx context.Context) error {
+	result, err := h.rpcWalletCall(ctx, "listreceivedbyaddress", []interface{}{0, true})
+	if err != nil {
+		return err
+	}
+	addresses, _ := result["result"].([]interface{})
+	if len(addresses) == 0 {
+		return nil
+	}
+	last, _ := addresses[len(addresses)-1].(map[string]interface{})
+	address, _ := last["address"].(string)
+	h.lastAddressMutex.Lock()
+	h.lastAddress = address
+	h.lastAddressMutex.Unlock()
+	return nil
+}
+
+func (h *UtxoHandler) rpcCall(ctx context.Context, path, method string, params []interface{}) (map[string]interface{}, error) {
+	return h.rpcCallHost(ctx, h.nodes.Current(), path, method, params)
+}
+
+func (h *UtxoHandler) rpcCallHost(ctx context.Context, host, path, method string, params []interface{}) (map[string]interface{}, error) {
+	requestBody := map[string]interface{}{
+		"jsonrpc": "1.0",
+		"id":      "utxo-handler",
+		"method":  method,
+		"params":  params,
+	}
+	if params == nil {
+		requestBody["params"] = []interface{}{}
+	}
+	jsonBody, _ := json.Marshal(requestBody)
+
+	ctx, cancel := context.WithTimeout(ctx, h.callTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+host+path, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("request creation failed: %v", err)
+	}
+	req.SetBasicAuth(h.user, h.pass)
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		h.nodes.failed(host)
+		return nil, fmt.Errorf("RPC request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	if errResult := result["error"]; errResult != nil {
+		errorMap, _ := errResult.(map[string]interface{})
+		code, _ := jsonInt64(errorMap["code"])
+		message, _ := errorMap["message"].(string)
+		return nil, &utxoRPCError{code: code, message: message}
+	}
+
+	return result, nil
+}
+
+type utxoRPCError struct {
+	code    int64
+	message string
+}
+
+func (e *utxoRPCError) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.code, e.message)
+}
+
+// isUtxoNotFound tells whether the node answered that it does not know a
+// transaction (RPC_INVALID_ADDRESS_OR_KEY).
+func isUtxoNotFound(err error) bool {
+	var rpcError *utxoRPCError
+	return errors.As(err, &rpcError) && rpcError.code == -5
+}
+
+// probeNode reads the height and peer count of a node. A node still in its
+// initial block download is not used.
+func (h *UtxoHandler) probeNode(ctx context.Context, host string) (endpointStatus, error) {
+	result, err := h.rpcCallHost(ctx, host, "", "getblockchaininfo", nil)
+	if err != nil {
+		return endpointStatus{}, err
+	}
+	info, _ := result["result"].(map[string]interface{})
+	height, ok := jsonInt64(info["blocks"])
+	if !ok {
+		return endpointStatus{}, fmt.Errorf("unexpected response format from getblockchaininfo")
+	}
+	if syncing, _ := info["initialblockdownload"].(bool); syncing {
+		return endpointStatus{height: height}, fmt.Errorf("initial block download in progress")
+	}
+	status := endpointStatus{height: height, peers: -1}
+	result, err = h.rpcCallHost(ctx, host, "", "getconnectioncount", nil)
+	if err != nil {
+		return status, nil
+	}
+	if peers, ok := jsonInt64(result["result"]); ok {
+		status.peers = int(peers)
+	}
+	return status, nil
+}
+
+// activateNode loads the wallet on a node before it is used. Failover only
+// works between nodes holding the same wallet, e.g. imported from the same
+// descriptors, so the node has to own the last deposit address issued.
+// Otherwise deposits to it would go unseen there.
+func (h *UtxoHandler) activateNode(ctx context.Context, host string) error {
+	path := ""
+	if h.wallet != "" {
+		_, err := h.rpcCallHost(ctx, host, "", "loadwallet", []interface{}{h.wallet})
+		var rpcError *utxoRPCError
+		if err != nil && !(errors.As(err, &rpcError) && rpcError.code == -35) {
+			// -35 is RPC_WALLET_ALREADY_LOADED
+			return err
+		}
+		path = "/wallet/" + h.wallet
+	}
+	h.lastAddressMutex.Lock()
+	address := h.lastAddress
+	h.lastAddressMutex.Unlock()
+	if address == "" {
+		return nil
+	}
+	result, err := h.rpcCallHost(ctx, host, path, "getaddressinfo", []interface{}{address})
+	if err != nil {
+		return err
+	}
+	info, _ := result["result"].(map[string]interface{})
+	if mine, _ := info["ismine"].(bool); !mine {
+		return fmt.Errorf("wallet does not own deposit address %s, the node does not share the wallet", address)
+	}
+	return nil
+}
+
+func (h *UtxoHandler) Endpoints() []EndpointHealth {
+	return h.nodes.Endpoints()
+}
+
+func (h *UtxoHandler) rpcWalletCall(ctx context.Context, method string, params []interface{}) (map[string]interface{}, error) {
+	path := ""
+	if h.wallet != "" {
+		path = "/wallet/" + h.wallet
+	}
+	return h.rpcCall(ctx, path, method, params)
+}
+
+func (h *UtxoHandler) CheckBalance(ctx context.Context) (Amount, error) {
+	result, err := h.rpcWalletCall(ctx, "getbalance", []interface{}{"*", 1})
+	if err != nil {
+		return Amount{}, fmt.Errorf("failed to get balance: %v", err)
+	}
+
+	balance, ok := jsonAmount(result["result"], h.precision)
+	if !ok {
+		return Amount{}, fmt.Errorf("unexpected response format from getbalance")
+	}
+
+	return balance, nil
+}
+
+func (h *UtxoHandler) GenerateNewAddress(ctx context.Context) (CryptoAddress, error) {
+	params := []interface{}{""}
+	if h.addressType != "" {
+		params = append(params, h.addressType)
+	}
+	result, err := h.rpcWalletCall(ctx, "getnewaddress", params)
+	if err != nil {
+		return CryptoAddress{}, err
+	}
+
+	address, ok := result["result"].(string)
+	if !ok {
+		return CryptoAddress{}, fmt.Errorf("unexpected response format from getnewaddress")
+	}
+	h.lastAddressMutex.Lock()
+	h.lastAddress = address
+	h.lastAddressMutex.Unlock()
+
+	return CryptoAddress{
+		Address:   address,
+		StartTime: time.Now().Unix(),
+	}, nil
+}
+
+func (h *UtxoHandler) GetAddressTransaction(ctx context.Context, address CryptoAddress) (*CryptoTransaction, error) {
+	result, err := h.rpcWalletCall(ctx, "listtransactions", []interface{}{"*", 1000000, 0, true})
+	if err != nil {
+		return nil, err
+	}
+
+	rawTransactions, ok := result["result"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected response format from listtransactions")
+	}
+
+	type txInfo struct {
+		Txid          string
+		Confirmations int64
+		Amount        Amount
+		Time          int64
+	}
+
+	var relevantTransactions []txInfo
+
+	for _, txInterface := range rawTransactions {
+		txMap, ok := txInterface.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		category, _ := txMap["category"].(string)
+		txAddress, _ := txMap["address"].(string)
+		if category != "receive" || txAddress != address.Address {
+			continue
+		}
+
+		txTime, ok := jsonInt64(txMap["time"])
+		if !ok {
+			continue
+		}
+
+		if txTime < address.StartTime {
+			continue
+		}
+
+		confirmations, _ := jsonInt64(txMap["confirmations"])
+		amount, _ := jsonAmount(txMap["amount"], h.precision)
+		txid, _ := txMap["txid"].(string)
+		if confirmations < 0 {
+			// Double spent or reorganised into a conflict.
+			continue
+		}
+
+		relevantTransactions = append(relevantTransactions, txInfo{
+			Txid:          txid,
+			Confirmations: confirmations,
+			Amount:        amount,
+			Time:          txTime,
+		})
+	}
+
+	if len(relevantTransactions) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(relevantTransactions, func(i, j int) bool {
+		return relevantTransactions[i].Time < relevantTransactions[j].Time
+	})
+
+	newest := relevantTransactions[0]
+
+	return &CryptoTransaction{
+		Txid:          newest.Txid,
+		Confirmations: newest.Confirmations,
+		Amount:        newest.Amount,
+		Explorers:     h.explorers,
+	}, nil
+}
+
+func (h *UtxoHandler) GetTransactionDetails(ctx context.Context, id string) (*CryptoTransaction, error) {
+	txid, vout := splitOutputID(id)
+	result, err := h.rpcWalletCall(ctx, "gettransaction", []interface{}{txid})
+	if isUtxoNotFound(err) {
+		return &CryptoTransaction{Txid: txid, Status: TxNotFound, Explorers: h.explorers}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve transaction: %v", err)
+	}
+
+	txData, ok := result["result"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid transaction response format")
+	}
+
+	confirmations, _ := jsonInt64(txData["confirmations"])
+	amount, _ := jsonAmount(txData["amount"], h.precision)
+	transaction := &CryptoTransaction{
+		Txid:          txid,
+		Confirmations: confirmations,
+		Amount:        amount,
+		Explorers:     h.explorers,
+		Status:        confirmationStatus(confirmations),
+	}
+	if confirmations == 0 {
+		// The wallet keeps transactions the mempool has dropped.
+		_, err := h.rpcCall(ctx, "", "getmempoolentry", []interface{}{txid})
+		if isUtxoNotFound(err) {
+			transaction.Status = TxNotFound
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to check mempool: %v", err)
+		}
+	}
+	if vout < 0 {
+		return transaction, nil
+	}
+
+	// A batched payout is only the order's own output.
+	details, _ := txData["details"].([]interface{})
+	for _, raw := range details {
+		detail, _ := raw.(map[string]interface{})
+		category, _ := detail["category"].(string)
+		index, ok := jsonInt64(detail["vout"])
+		if category != "send" || !ok || index != vout {
+			continue
+		}
+		sent, _ := jsonAmount(detail["amount"], h.precision)
+		transaction.Amount = NewAmount(0).Sub(sent)
+		transaction.OutputIndex = &index
+		return transaction, nil
+	}
+	return nil, fmt.Errorf("output %d not found in %s", vout, txid)
+}
+
+func (h *UtxoHandler) Send(ctx context.Context, address CryptoAddress, amount Amount) ([]string, error) {
+	if h.psbt {
+		return nil, fmt.Errorf("%s payouts are signed offline, the node wallet cannot send", h.sign)
+	}
+	if h.batchPolicy.WindowSeconds > 0 {
+		return h.queuePayout(ctx, address, amount)
+	}
+	h.sendMutex.Lock()
+	defer h.sendMutex.Unlock()
+	balance, err := h.CheckBalance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if balance.Cmp(amount) < 0 {
+		return nil, fmt.Errorf("insufficient funds: available %s %s, required %s %s", balance.Format(h.precision), h.sign, amount.Format(h.precision), h.sign)
+	}
+
+	params := []interface{}{
+		address.Address,
+		json.Number(amount.Format(h.precision)),
+		"",
+		"",
+		h.fee.SubtractFeeFromAmount,
+	}
+	if h.fee.ConfTarget > 0 {
+		feeRate, capped, err := h.estimateFeeRate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if capped {
+			// sendtoaddress refuses conf_target together with fee_rate.
+			params = append(params, true, nil, nil, nil, feeRate)
+		} else {
+			params = append(params, true, h.fee.ConfTarget, h.fee.EstimateMode)
+		}
+	}
+	result, err := h.rpcWalletCall(ctx, "sendtoaddress", params)
+	if err != nil {
+		return nil, err
+	}
+
+	txid, ok := result["result"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid transaction response format")
+	}
+
+	return []string{txid}, nil
+}
+
+// estimateFeeRate asks the node for the policy's fee rate. When it is above
+// MaxSatPerVByte the capped rate is returned in sat/vB with capped set,
+// otherwise the node is left to apply its own estimate.
+func (h *UtxoHandler) estimateFeeRate(ctx context.Context) (json.Number, bool, error) {
+	if h.fee.MaxSatPerVByte <= 0 {
+		return "", false, nil
+	}
+	result, err := h.rpcCall(ctx, "", "estimatesmartfee", []interface{}{h.fee.ConfTarget, h.fee.EstimateMode})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to estimate fee: %v", err)
+	}
+	estimate, ok := result["result"].(map[string]interface{})
+	if !ok {
+		return "", false, fmt.Errorf("unexpected response format from estimatesmartfee")
+	}
+	perKvB, ok := estimate["feerate"].(json.Number)
+	if !ok {
+		// Not enough data for an estimate yet, pay the cap rather than
+		// the node's fallback fee.
+		return formatFeeRate(h.fee.MaxSatPerVByte), true, nil
+	}
+	rate, err := perKvB.Float64()
+	if err != nil {
+		return "", false, fmt.Errorf("invalid fee rate %s: %v", perKvB, err)
+	}
+	// BTC/kvB to sat/vB
+	if rate*1e5 > h.fee.MaxSatPerVByte {
+		return formatFeeRate(h.fee.MaxSatPerVByte), true, nil
+	}
+	return "", false, nil
+}
+
+func formatFeeRate(satPerVByte float64) json.Number {
+	return json.Number(strconv.FormatFloat(satPerVByte, 'f', 3, 64))
+}
+
+func (h *UtxoHandler) BumpAfter() time.Duration {
+	// Replacements would need another offline signature.
+	if h.fee.ConfTarget <= 0 || h.psbt {
+		return 0
+	}
+	return time.Duration(h.fee.BumpAfterSeconds) * time.Second
+}
+
+// BumpFee replaces an unconfirmed payout with one paying the current
+// estimate, within the policy's cap, and returns the replacement's id. A
+// batched payout is bumped once for all its orders.
+func (h *UtxoHandler) BumpFee(ctx context.Context, id string) (string, error) {
+	h.sendMutex.Lock()
+	defer h.sendMutex.Unlock()
+	txid, vout := splitOutputID(id)
+	if h.replacements == nil {
+		h.replacements = make(map[string]string)
+	}
+	replacement, ok := h.replacements[txid]
+	if !ok {
+		var err error
+		replacement, err = h.bumpTransaction(ctx, txid)
+		if err != nil {
+			return "", err
+		}
+		h.replacements[txid] = replacement
+	}
+	if vout < 0 {
+		return replacement, nil
+	}
+
+	// The replacement can order its outputs differently, the order's output
+	// is found again by its address.
+	details, err := h.transactionDetails(ctx, txid)
+	if err != nil {
+		return replacement, nil
+	}
+	outputs, err := h.sendOutputs(ctx, replacement)
+	if err != nil {
+		return replacement, nil
+	}
+	for _, detail := range details {
+		index, _ := jsonInt64(detail["vout"])
+		address, _ := detail["address"].(string)
+		if category, _ := detail["category"].(string); category != "send" || index != vout {
+			continue
+		}
+		if newIndex, ok := outputs[address]; ok {
+			return outputID(replacement, newIndex), nil
+		}
+	}
+	return replacement, nil
+}
+
+func (h *UtxoHandler) bumpTransaction(ctx context.Context, txid string) (string, error) {
+	feeRate, capped, err := h.estimateFeeRate(ctx)
+	if err != nil {
+		return "", err
+	}
+	options := map[string]interface{}{
+		"replaceable": true,
+	}
+	if capped {
+		options["fee_rate"] = feeRate
+	} else {
+		options["conf_target"] = h.fee.ConfTarget
+		options["estimate_mode"] = h.fee.EstimateMode
+	}
+	result, err := h.rpcWalletCall(ctx, "bumpfee", []interface{}{txid, options})
+	if err != nil {
+		return "", fmt.Errorf("failed to bump fee of %s: %v", txid, err)
+	}
+	bumped, ok := result["result"].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("unexpected response format from bumpfee")
+	}
+	replacement, ok := bumped["txid"].(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected response format from bumpfee")
+	}
+	return replacement, nil
+}
+
+// ValidateAddress accepts segwit addresses with the chain's prefix,
+// cashaddrs with its cashaddr prefix and base58check addresses with one of
+// its version bytes. Without a configured format every address is accepted.
+func (h *UtxoHandler) ValidateAddress(address string) error {
+	if h.hrp == "" && h.cashPrefix == "" && len(h.versions) == 0 {
+		return nil
+	}
+	if h.hrp != "" && strings.HasPrefix(strings.ToLower(address), h.hrp+"1") {
+		return validateSegwitAddress(address, h.hrp)
+	}
+	// Cashaddrs pay key hashes with q... and script hashes with p....
+	lower := strings.ToLower(address)
+	if h.cashPrefix != "" && (strings.Contains(lower, ":") || strings.HasPrefix(lower, "q") || strings.HasPrefix(lower, "p")) {
+		return validateCashAddress(address, h.cashPrefix)
+	}
+	if len(h.versions) == 0 {
+		return fmt.Errorf("address is not a %s address", h.sign)
+	}
+	return validateBase58CheckAddress(address, h.versions)
+}
+
+// Rebroadcast sends a wallet transaction to the network again.
+func (h *UtxoHandler) Rebroadcast(ctx context.Context, id string) error {
+	txid, _ := splitOutputID(id)
+	result, err := h.rpcWalletCall(ctx, "gettransaction", []interface{}{txid})
+	if err != nil {
+		return fmt.Errorf("failed to retrieve transaction: %v", err)
+	}
+	txData, _ := result["result"].(map[string]interface{})
+	raw, ok := txData["hex"].(string)
+	if !ok {
+		return fmt.Errorf("invalid transaction response format")
+	}
+	if _, err := h.rpcCall(ctx, "", "sendrawtransaction", []interface{}{raw}); err != nil {
+		return fmt.Errorf("failed to rebroadcast %s: %v", txid, err)
+	}
+	return nil
+}
+
+// BuildRefill funds a PSBT paying amount from the cold wallet to a new
+// address of the hot wallet, change goes back to cold. The PSBT is unsigned,
+// the cold wallet holds no keys.
+func (h *UtxoHandler) BuildRefill(ctx context.Context, cold string, amount Amount) (string, error) {
+	if h.coldWallet == "" {
+		return "", fmt.Errorf("no cold wallet configured for %s", h.sign)
+	}
+	address, err := h.GenerateNewAddress(ctx)
+	if err != nil {
+		return "", err
+	}
+	outputs := []interface{}{map[string]interface{}{address.Address: json.Number(amount.Format(h.precision))}}
+	options := map[string]interface{}{
+		"changeAddress": cold,
+		"replaceable":   true,
+	}
+	if h.fee.ConfTarget > 0 {
+		options["conf_target"] = h.fee.ConfTarget
+		options["estimate_mode"] = h.fee.EstimateMode
+	}
+	result, err := h.rpcCall(ctx, "/wallet/"+h.coldWallet, "walletcreatefundedpsbt", []interface{}{[]interface{}{}, outputs, 0, options})
+	if err != nil {
+		return "", fmt.Errorf("failed to create PSBT: %v", err)
+	}
+	psbtData, _ := result["result"].(map[string]interface{})
+	psbt, ok := psbtData["psbt"].(string)
+	if !ok {
+		return "", fmt.Errorf("invalid PSBT response format")
+	}
+	return psbt, nil
+}
+
+func (h *UtxoHandler) OfflineSigning() bool {
+	return h.psbt
+}
+
+// PreparePayout funds a PSBT paying amount to address from the wallet. Its
+// inputs are locked so later payouts do not spend them before it is signed.
+func (h *UtxoHandler) PreparePayout(ctx context.Context, address CryptoAddress, amount Amount) (string, error) {
+	h.sendMutex.Lock()
+	defer h.sendMutex.Unlock()
+	balance, err := h.CheckBalance(ctx)
+	if err != nil {
+		return "", err
+	}
+	if balance.Cmp(amount) < 0 {
+		return "", fmt.Errorf("insufficient funds: available %s %s, required %s %s", balance.Format(h.precision), h.sign, amount.Format(h.precision), h.sign)
+	}
+
+	outputs := []interface{}{map[string]interface{}{address.Address: json.Number(amount.Format(h.precision))}}
+	options := map[string]interface{}{
+		"lockUnspents": true,
+		"replaceable":  true,
+	}
+	if h.fee.SubtractFeeFromAmount {
+		options["subtractFeeFromOutputs"] = []interface{}{0}
+	}
+	if h.fee.ConfTarget > 0 {
+		feeRate, capped, err := h.estimateFeeRate(ctx)
+		if err != nil {
+			return "", err
+		}
+		if capped {
+			options["fee_rate"] = feeRate
+		} else {
+			options["conf_target"] = h.fee.ConfTarget
+			options["estimate_mode"] = h.fee.EstimateMode
+		}
+	}
+	result, err := h.rpcWalletCall(ctx, "walletcreatefundedpsbt", []interface{}{[]interface{}{}, outputs, 0, options})
+	if err != nil {
+		return "", fmt.Errorf("failed to create PSBT: %v", err)
+	}
+	psbtData, _ := result["result"].(map[string]interface{})
+	psbt, ok := psbtData["psbt"].(string)
+	if !ok {
+		return "", fmt.Errorf("invalid PSBT response format")
+	}
+	return psbt, nil
+}
+
+// ReleasePayout unlocks the inputs PreparePayout locked for unsigned.
+func (h *UtxoHandler) ReleasePayout(ctx context.Context, unsigned string) error {
+	result, err := h.rpcCall(ctx, "", "decodepsbt", []interface{}{unsigned})
+	if err != nil {
+		return fmt.Errorf("invalid PSBT: %v", err)
+	}
+	decoded, _ := result["result"].(map[string]interface{})
+	tx, _ := decoded["tx"].(map[string]interface{})
+	vin, _ := tx["vin"].([]interface{})
+	var outputs []interface{}
+	for _, input := range vin {
+		input, _ := input.(map[string]interface{})
+		outputs = append(outputs, map[string]interface{}{"txid": input["txid"], "vout": input["vout"]})
+	}
+	if len(outputs) == 0 {
+		return nil
+	}
+	_, err = h.rpcWalletCall(ctx, "lockunspent", []interface{}{true, outputs})
+	if err != nil {
+		return fmt.Errorf("failed to unlock inputs: %v", err)
+	}
+	return nil
+}
+
+func (h *UtxoHandler) psbtTxid(ctx context.Context, psbt string) (string, error) {
+	result, err := h.rpcCall(ctx, "", "decodepsbt", []interface{}{psbt})
+	if err != nil {
+		return "", fmt.Errorf("invalid PSBT: %v", err)
+	}
+	decoded, _ := result["result"].(map[string]interface{})
+	tx, _ := decoded["tx"].(map[string]interface{})
+	txid, ok := tx["txid"].(string)
+	if !ok {
+		return "", fmt.Errorf("invalid PSBT response format")
+	}
+	return txid, nil
+}
+
+// FinalizePayout broadcasts signed, which must be unsigned with the
+// signatures added, and returns its txid.
+func (h *UtxoHandler) FinalizePayout(ctx context.Context, unsigned, signed string) ([]string, error) {
+	expected, err := h.psbtTxid(ctx, unsigned)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := h.psbtTxid(ctx, signed)
+	if err != nil {
+		return nil, err
+	}
+	if actual != expected {
+		return nil, fmt.Errorf("signed PSBT spends or pays differently than the exported one")
+	}
+
+	result, err := h.rpcCall(ctx, "", "finalizepsbt", []interface{}{signed})
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize PSBT: %v", err)
+	}
+	finalized, _ := result["result"].(map[string]interface{})
+	if complete, _ := finalized["complete"].(bool); !complete {
+		return nil, fmt.Errorf("PSBT is not fully signed")
+	}
+	raw, ok := finalized["hex"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid PSBT response format")
+	}
+	result, err = h.rpcCall(ctx, "", "sendrawtransaction", []interface{}{raw})
+	if err != nil {
+		return nil, fmt.Errorf("failed to broadcast: %v", err)
+	}
+	txid, ok := result["result"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid transaction response format")
+	}
+	return []string{txid}, nil
+}
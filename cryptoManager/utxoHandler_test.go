@@ -0,0 +1,317 @@
+package cryptoManager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type rpcRequest struct {
+	Path   string
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+// fakeBitcoind answers JSON-RPC calls from canned results by method.
+// Methods without a result answer with the error in errors, or with
+// RPC_METHOD_NOT_FOUND.
+type fakeBitcoind struct {
+	mutex   sync.Mutex
+	results map[string]interface{}
+	errors  map[string]map[string]interface{}
+	calls   []rpcRequest
+}
+
+func newFakeBitcoind(t *testing.T) (*fakeBitcoind, *httptest.Server) {
+	node := &fakeBitcoind{
+		results: map[string]interface{}{"getwalletinfo": map[string]interface{}{"walletname": ""}},
+		errors:  make(map[string]map[string]interface{}),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var request rpcRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&request); err != nil {
+			t.Errorf("invalid request: %v", err)
+			return
+		}
+		request.Path = r.URL.Path
+		node.mutex.Lock()
+		node.calls = append(node.calls, request)
+		result, ok := node.results[request.Method]
+		rpcError := node.errors[request.Method]
+		node.mutex.Unlock()
+		response := map[string]interface{}{"id": "utxo-handler", "result": result, "error": nil}
+		if !ok {
+			if rpcError == nil {
+				rpcError = map[string]interface{}{"code": -32601, "message": "Method not found"}
+			}
+			response["result"] = nil
+			response["error"] = rpcError
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return node, server
+}
+
+func (n *fakeBitcoind) set(method string, result interface{}) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.errors, method)
+	n.results[method] = result
+}
+
+func (n *fakeBitcoind) fail(method string, code int, message string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.results, method)
+	n.errors[method] = map[string]interface{}{"code": code, "message": message}
+}
+
+func (n *fakeBitcoind) lastCall(method string) *rpcRequest {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for i := len(n.calls) - 1; i >= 0; i-- {
+		if n.calls[i].Method == method {
+			return &n.calls[i]
+		}
+	}
+	return nil
+}
+
+func newTestUtxoHandler(t *testing.T, server *httptest.Server, settings UtxoSettings) *UtxoHandler {
+	settings.Host = strings.TrimPrefix(server.URL, "http://")
+	settings.User = "user"
+	settings.Password = "pass"
+	settings.Sign = "BTC"
+	handler, err := NewUtxoHandler(settings)
+	if err != nil {
+		t.Fatalf("NewUtxoHandler: %v", err)
+	}
+	return handler
+}
+
+func TestUtxoWalletSetup(t *testing.T) {
+	node, server := newFakeBitcoind(t)
+	node.set("listwallets", []interface{}{})
+	node.fail("loadwallet", -18, "Wallet file not found")
+	node.set("createwallet", map[string]interface{}{"name": "exchange"})
+	newTestUtxoHandler(t, server, UtxoSettings{NodeSettings: NodeSettings{Wallet: "exchange"}})
+	if call := node.lastCall("createwallet"); call == nil || call.Params[0] != "exchange" {
+		t.Fatalf("wallet not created: %+v", call)
+	}
+
+	node.fail("loadwallet", -4, "Wallet already being loaded")
+	_, err := NewUtxoHandler(UtxoSettings{NodeSettings: NodeSettings{
+		Host: strings.TrimPrefix(server.URL, "http://"), User: "user", Password: "pass", Wallet: "exchange",
+	}})
+	if err == nil || !strings.Contains(err.Error(), "already being loaded") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestUtxoGenerateNewAddress(t *testing.T) {
+	node, server := newFakeBitcoind(t)
+	handler := newTestUtxoHandler(t, server, UtxoSettings{AddressType: "bech32"})
+	node.set("getnewaddress", "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4")
+
+	address, err := handler.GenerateNewAddress(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.Address != "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4" || address.StartTime == 0 {
+		t.Fatalf("unexpected address %+v", address)
+	}
+	if call := node.lastCall("getnewaddress"); len(call.Params) != 2 || call.Params[1] != "bech32" {
+		t.Fatalf("address type not passed: %+v", call.Params)
+	}
+
+	node.fail("getnewaddress", -12, "Keypool ran out")
+	if _, err := handler.GenerateNewAddress(context.Background()); err == nil || !strings.Contains(err.Error(), "Keypool ran out") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestUtxoWalletPath(t *testing.T) {
+	node, server := newFakeBitcoind(t)
+	node.set("listwallets", []interface{}{"exchange"})
+	handler := newTestUtxoHandler(t, server, UtxoSettings{NodeSettings: NodeSettings{Wallet: "exchange"}})
+	node.set("getbalance", json.Number("1.5"))
+	balance, err := handler.CheckBalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.String() != "150000000" {
+		t.Fatalf("balance %s", balance)
+	}
+	if call := node.lastCall("getbalance"); call.Path != "/wallet/exchange" {
+		t.Fatalf("wallet call sent to %q", call.Path)
+	}
+}
+
+func TestUtxoGetTransactionDetails(t *testing.T) {
+	node, server := newFakeBitcoind(t)
+	handler := newTestUtxoHandler(t, server, UtxoSettings{})
+	ctx := context.Background()
+
+	node.set("gettransaction", map[string]interface{}{"confirmations": 3, "amount": json.Number("0.015")})
+	transaction, err := handler.GetTransactionDetails(ctx, "aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction.Status != TxConfirmed || transaction.Confirmations != 3 || transaction.Amount.String() != "1500000" {
+		t.Fatalf("unexpected transaction %+v", transaction)
+	}
+
+	// Unconfirmed and still in the mempool.
+	node.set("gettransaction", map[string]interface{}{"confirmations": 0, "amount": json.Number("0.015")})
+	node.set("getmempoolentry", map[string]interface{}{})
+	if transaction, err = handler.GetTransactionDetails(ctx, "aa"); err != nil || transaction.Status != TxPending {
+		t.Fatalf("unexpected transaction %+v, %v", transaction, err)
+	}
+
+	// Unconfirmed and dropped from the mempool.
+	node.fail("getmempoolentry", -5, "Transaction not in mempool")
+	if transaction, err = handler.GetTransactionDetails(ctx, "aa"); err != nil || transaction.Status != TxNotFound {
+		t.Fatalf("unexpected transaction %+v, %v", transaction, err)
+	}
+
+	// Conflicting with a confirmed transaction.
+	node.set("gettransaction", map[string]interface{}{"confirmations": -2, "amount": json.Number("0.015")})
+	if transaction, err = handler.GetTransactionDetails(ctx, "aa"); err != nil || transaction.Status != TxConflicted {
+		t.Fatalf("unexpected transaction %+v, %v", transaction, err)
+	}
+
+	node.fail("gettransaction", -5, "Invalid or non-wallet transaction id")
+	if transaction, err = handler.GetTransactionDetails(ctx, "aa"); err != nil || transaction.Status != TxNotFound {
+		t.Fatalf("unexpected transaction %+v, %v", transaction, err)
+	}
+
+	node.fail("gettransaction", -28, "Loading wallet")
+	if _, err = handler.GetTransactionDetails(ctx, "aa"); err == nil {
+		t.Fatal("RPC error not returned")
+	}
+
+	// A batched payout is the order's own output.
+	node.set("gettransaction", map[string]interface{}{
+		"confirmations": 1,
+		"amount":        json.Number("-0.3"),
+		"details": []interface{}{
+			map[string]interface{}{"category": "send", "vout": 0, "amount": json.Number("-0.1")},
+			map[string]interface{}{"category": "send", "vout": 1, "amount": json.Number("-0.2")},
+		},
+	})
+	if transaction, err = handler.GetTransactionDetails(ctx, "aa:1"); err != nil {
+		t.Fatal(err)
+	}
+	if transaction.Txid != "aa" || transaction.Amount.String() != "20000000" || *transaction.OutputIndex != 1 {
+		t.Fatalf("unexpected transaction %+v", transaction)
+	}
+	if _, err = handler.GetTransactionDetails(ctx, "aa:2"); err == nil {
+		t.Fatal("missing output not reported")
+	}
+}
+
+func TestUtxoSend(t *testing.T) {
+	node, server := newFakeBitcoind(t)
+	handler := newTestUtxoHandler(t, server, UtxoSettings{})
+	ctx := context.Background()
+	address := CryptoAddress{Address: "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"}
+
+	node.set("getbalance", json.Number("1"))
+	node.set("sendtoaddress", "bb")
+	txids, err := handler.Send(ctx, address, NewAmount(25000000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txids) != 1 || txids[0] != "bb" {
+		t.Fatalf("unexpected txids %v", txids)
+	}
+	call := node.lastCall("sendtoaddress")
+	if call.Params[0] != address.Address || call.Params[1] != json.Number("0.25000000") {
+		t.Fatalf("unexpected sendtoaddress params %v", call.Params)
+	}
+
+	node.set("getbalance", json.Number("0.1"))
+	if _, err := handler.Send(ctx, address, NewAmount(25000000)); err == nil || !strings.Contains(err.Error(), "insufficient funds") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	node.set("getbalance", json.Number("1"))
+	node.fail("sendtoaddress", -6, "Insufficient funds")
+	if _, err := handler.Send(ctx, address, NewAmount(25000000)); err == nil || !strings.Contains(err.Error(), "-6") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	server.Close()
+	if _, err := handler.Send(ctx, address, NewAmount(25000000)); err == nil || !strings.Contains(err.Error(), "RPC request failed") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestUtxoSendFeeCap(t *testing.T) {
+	node, server := newFakeBitcoind(t)
+	handler := newTestUtxoHandler(t, server, UtxoSettings{Fee: UtxoFeePolicy{ConfTarget: 6, MaxSatPerVByte: 20}})
+	ctx := context.Background()
+	address := CryptoAddress{Address: "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"}
+	node.set("getbalance", json.Number("1"))
+	node.set("sendtoaddress", "bb")
+
+	// 0.0005 BTC/kvB is 50 sat/vB, above the cap.
+	node.set("estimatesmartfee", map[string]interface{}{"feerate": json.Number("0.0005")})
+	if _, err := handler.Send(ctx, address, NewAmount(1000)); err != nil {
+		t.Fatal(err)
+	}
+	if params := node.lastCall("sendtoaddress").Params; len(params) != 10 || params[9] != json.Number("20.000") {
+		t.Fatalf("fee cap not applied: %v", params)
+	}
+
+	node.set("estimatesmartfee", map[string]interface{}{"feerate": json.Number("0.0001")})
+	if _, err := handler.Send(ctx, address, NewAmount(1000)); err != nil {
+		t.Fatal(err)
+	}
+	if params := node.lastCall("sendtoaddress").Params; len(params) != 8 || params[6] != json.Number("6") {
+		t.Fatalf("node estimate not used: %v", params)
+	}
+}
+
+func TestUtxoGetAddressTransaction(t *testing.T) {
+	node, server := newFakeBitcoind(t)
+	handler := newTestUtxoHandler(t, server, UtxoSettings{})
+	ctx := context.Background()
+	address := CryptoAddress{Address: "bc1qdeposit", StartTime: 100}
+
+	node.set("listtransactions", []interface{}{
+		map[string]interface{}{"category": "receive", "address": "bc1qother", "txid": "t0", "amount": json.Number("1"), "time": 200, "confirmations": 1},
+		map[string]interface{}{"category": "receive", "address": "bc1qdeposit", "txid": "t1", "amount": json.Number("0.5"), "time": 50, "confirmations": 9},
+		map[string]interface{}{"category": "receive", "address": "bc1qdeposit", "txid": "t2", "amount": json.Number("0.2"), "time": 150, "confirmations": -1},
+		map[string]interface{}{"category": "receive", "address": "bc1qdeposit", "txid": "t3", "amount": json.Number("0.3"), "time": 160, "confirmations": 0},
+	})
+	transaction, err := handler.GetAddressTransaction(ctx, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction == nil || transaction.Txid != "t3" || transaction.Amount.String() != "30000000" {
+		t.Fatalf("unexpected transaction %+v", transaction)
+	}
+
+	node.set("listtransactions", []interface{}{})
+	if transaction, err = handler.GetAddressTransaction(ctx, address); err != nil || transaction != nil {
+		t.Fatalf("unexpected transaction %+v, %v", transaction, err)
+	}
+
+	node.fail("listtransactions", -18, "Requested wallet does not exist or is not loaded")
+	if _, err = handler.GetAddressTransaction(ctx, address); err == nil {
+		t.Fatal("RPC error not returned")
+	}
+}
@@ -14,6 +14,7 @@ type LogType string
 const (
 	LogTypeActivity LogType = "ACTIVITY"
 	LogTypeError    LogType = "ERROR"
+	LogTypeAlert    LogType = "ALERT"
 )
 
 var (
@@ -66,7 +67,7 @@ func Log(logType LogType, message string) {
 		if activityLog != nil {
 			activityLog.Println(logLine)
 		}
-	case LogTypeError:
+	case LogTypeError, LogTypeAlert:
 		if errorLog != nil {
 			errorLog.Println(logLine)
 			log.Println(logLine)
@@ -85,3 +86,9 @@ func LogError(format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
 	Log(LogTypeError, message)
 }
+
+// LogAlert reports a condition an operator has to look at.
+func LogAlert(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	Log(LogTypeAlert, message)
+}
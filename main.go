@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/base64"
@@ -8,7 +9,9 @@ import (
 	"github.com/skip2/go-qrcode"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"teProj/cryptoManager"
@@ -17,6 +20,10 @@ import (
 
 var isUnderMaintenance = false
 
+// appContext is cancelled on shutdown and is the parent of every order and
+// background worker.
+var appContext, shutdownApp = context.WithCancel(context.Background())
+
 type RateDisplay struct {
 	From string
 	To   string
@@ -31,17 +38,37 @@ type ConversionResult struct {
 	Fee            float64
 	AmountAfterFee string
 	RatePerUnit    string
+	QuoteToken     string
+	QuoteExpires   int64
+	Fiat           *FiatValuation
 }
 
-func formatCryptoValue(amount float64, currency int) string {
-	var digitCount int64 = 8
+func assetPrecision(currency int) int {
 	for _, crypto := range config.SupportedCryptos {
-		if crypto.InternalAssetID == int(currency) {
-			digitCount = int64(crypto.Precision)
-			break
+		if crypto.InternalAssetID == currency {
+			return crypto.Precision
 		}
 	}
-	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%."+strconv.FormatInt(digitCount, 10)+"f", amount), "0"), ".")
+	return 8
+}
+
+func formatCryptoValue(amount cryptoManager.Amount, currency int) string {
+	formatted := amount.Format(assetPrecision(currency))
+	if !strings.Contains(formatted, ".") {
+		return formatted
+	}
+	return strings.TrimRight(strings.TrimRight(formatted, "0"), ".")
+}
+
+// formatRate formats an approximate value such as an exchange rate with the
+// precision of the currency it is expressed in.
+func formatRate(rate float64, currency int) string {
+	digitCount := int64(assetPrecision(currency))
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%."+strconv.FormatInt(digitCount, 10)+"f", rate), "0"), ".")
+}
+
+func parseCryptoValue(value string, currency int) (cryptoManager.Amount, error) {
+	return cryptoManager.ParseAmount(value, assetPrecision(currency))
 }
 
 func GenerateQRCodeDataURL(input string) template.URL {
@@ -81,12 +108,17 @@ func mainPage(w http.ResponseWriter, r *http.Request) {
 	action := r.URL.Query().Get("action")
 	fromID, _ := strconv.Atoi(r.URL.Query().Get("fromId"))
 	toID, _ := strconv.Atoi(r.URL.Query().Get("toId"))
-	amount, _ := strconv.ParseFloat(r.URL.Query().Get("amount"), 64)
+	amount, amountErr := parseCryptoValue(r.URL.Query().Get("amount"), fromID)
 	address := r.URL.Query().Get("address")
 	refundAddress := r.URL.Query().Get("addressRefund")
+	quoteToken := r.URL.Query().Get("quote")
+	fiatCode := r.URL.Query().Get("fiat")
+	if !r.URL.Query().Has("fiat") {
+		fiatCode = config.DefaultFiat
+	}
 	var amountString string
 	if action == "calc" || action == "exec" {
-		amountString = strconv.FormatFloat(amount, 'f', -1, 64)
+		amountString = formatCryptoValue(amount, fromID)
 	} else {
 		amountString = ""
 	}
@@ -110,10 +142,10 @@ func mainPage(w http.ResponseWriter, r *http.Request) {
 		if crypto == nil {
 			continue
 		}
-		balance, err := handler.CheckBalance()
+		balance, err := handler.CheckBalance(r.Context())
 		if err != nil {
 			log.Printf("Error getting balance for %s: %v", crypto.AssetName, err)
-			balance = 0
+			balance = cryptoManager.Amount{}
 		}
 		iconPath := fmt.Sprintf("/asset_cache/%d.png", crypto.InternalAssetID)
 		reserves = append(reserves, ReserveDisplay{
@@ -130,10 +162,12 @@ func mainPage(w http.ResponseWriter, r *http.Request) {
 		Error             string
 		FormFrom          int
 		FormTo            int
-		FormAmount        float64
+		FormAmount        cryptoManager.Amount
 		FormAmountString  string
 		FormAddress       string
 		FormRefundAddress string
+		FormFiat          string
+		FiatCodes         []string
 		Action            string
 		SelectedCrypto    *CryptoCurrency
 		Reserves          []ReserveDisplay
@@ -145,6 +179,8 @@ func mainPage(w http.ResponseWriter, r *http.Request) {
 		FormAmountString:  amountString,
 		FormAddress:       address,
 		FormRefundAddress: refundAddress,
+		FormFiat:          fiatCode,
+		FiatCodes:         FiatCodes(),
 		Action:            action,
 		Reserves:          reserves,
 	}
@@ -157,6 +193,9 @@ func mainPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, fee := range config.Routes {
+		if !store.RouteAvailable(fee.Pair.IDFrom, fee.Pair.IDTo) {
+			continue
+		}
 		rate, err := ConvertWithoutFee(store, fee.Pair.IDFrom, fee.Pair.IDTo, 1)
 		if err == nil {
 			data.Rates = append(data.Rates, RateDisplay{
@@ -167,21 +206,31 @@ func mainPage(w http.ResponseWriter, r *http.Request) {
 			})
 		}
 	}
-	if action != "" && fromID > 0 && toID > 0 {
-		if action == "calc" && amount > 0 {
-			if _, ok := store.conversionFees[fmt.Sprintf("%d-%d", fromID, toID)]; !ok {
+	if amountErr != nil && (action == "calc" || action == "exec") && r.URL.Query().Get("amount") != "" {
+		data.Error = fmt.Sprintf("Invalid amount: %v", amountErr)
+	} else if action != "" && fromID > 0 && toID > 0 {
+		if action == "calc" && amount.Sign() > 0 {
+			if !store.RouteAvailable(fromID, toID) {
 				data.Error = "Route unavailable"
 			} else {
-				rate, err := Convert(store, fromID, toID, amount)
+				quote, token, err := IssueQuote(store, fromID, toID, amount)
+				var rate cryptoManager.Amount
+				if err == nil {
+					rate, err = quote.Apply(store, amount)
+				}
 				if err == nil {
-					fee, _ := store.GetFee(fromID, toID)
 					data.Conversion = &ConversionResult{
 						FromAsset:      store.assetNames[fromID],
 						ToAsset:        store.assetNames[toID],
-						Rate:           formatCryptoValue(rate/(1-fee), toID),
-						Fee:            fee,
+						Rate:           formatRate(amount.Float64(assetPrecision(fromID))*quote.Rate, toID),
+						Fee:            quote.Fee,
 						AmountAfterFee: formatCryptoValue(rate, toID),
-						RatePerUnit:    formatCryptoValue((rate/(1-fee))/amount, toID),
+						RatePerUnit:    formatRate(quote.Rate, toID),
+						QuoteToken:     token,
+						QuoteExpires:   quote.Expires,
+					}
+					if IsKnownFiat(fiatCode) {
+						data.Conversion.Fiat, _ = ValueInFiat(store, fromID, toID, amount, rate, quote.Fee, fiatCode)
 					}
 				} else {
 					data.Error = "Conversion failed"
@@ -193,33 +242,11 @@ func mainPage(w http.ResponseWriter, r *http.Request) {
 			} else {
 				rate, err := Convert(store, fromID, toID, amount)
 				if err == nil {
-					orderID, err := MakeSession(fromID, toID, amount, rate, address, refundAddress)
+					orderID, err := MakeSession(r.Context(), fromID, toID, amount, rate, address, refundAddress, quoteToken, fiatCode)
 					if err != nil {
 						data.Error = fmt.Sprintf("Exchange failed: %v", err)
 					} else {
-						go func() {
-							sessionsMutex.Lock()
-							orderSession := Sessions[orderID]
-							sessionsMutex.Unlock()
-							err := ExchangeBackend(orderSession)
-							if err != nil {
-								sessionsMutex.Lock()
-								session := Sessions[orderID]
-								sessionsMutex.Unlock()
-								//Careful here
-								if session.FromTransaction.Txid != "nil" {
-									send, err := session.FromCurrency.Send(cryptoManager.CryptoAddress{
-										Address:   session.RefundAddress,
-										StartTime: 0,
-									}, session.FromTransaction.Amount)
-									if err != nil {
-										LogError("Refund failed with error: %s, %#v", err.Error(), *session)
-									} else {
-										LogActivity("Refund succeeded [%v], %#v", send, *session)
-									}
-								}
-							}
-						}()
+						StartOrder(orderID)
 						http.Redirect(w, r, "/order?orderID="+orderID, http.StatusSeeOther)
 						return
 					}
@@ -231,8 +258,10 @@ func mainPage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	tmpl := template.Must(template.New("index.html").Funcs(template.FuncMap{
-		"multiply":     func(a, b float64) float64 { return a * b },
-		"formatCrypto": formatCryptoValue,
+		"multiply":              func(a, b float64) float64 { return a * b },
+		"formatCrypto":          formatCryptoValue,
+		"formatRate":            formatRate,
+		"formatExpirationTimer": FormatExpirationTime,
 	}).ParseFiles("templates/index.html"))
 	tmpl.Execute(w, data)
 }
@@ -240,6 +269,7 @@ func mainPage(w http.ResponseWriter, r *http.Request) {
 var orderFunctions = template.FuncMap{
 	"multiply":              func(a, b float64) float64 { return a * b },
 	"formatCrypto":          formatCryptoValue,
+	"formatRate":            formatRate,
 	"generateQrCode":        GenerateQRCodeDataURL,
 	"formatExpirationTimer": FormatExpirationTime,
 	"calc":                  func(a int64, b int) float64 { return (float64(a) / float64(b)) * 100 },
@@ -251,9 +281,11 @@ var orderTemplates = map[string]string{
 	"AWAITING INPUT":     "awaiting_input.html",
 	"CONFIRMING INPUT":   "confirming_input.html",
 	"EXCHANGING":         "exchanging.html",
+	"AWAITING SIGNATURE": "awaiting_signature.html",
 	"CONFIRMING OUTPUT":  "confirming_output.html",
 	"SUCCESS":            "success.html",
 	"TRANSLATION FAILED": "transaction_failed.html",
+	"AWAITING OPERATOR":  "awaiting_operator.html",
 }
 
 func orderPage(w http.ResponseWriter, r *http.Request) {
@@ -296,7 +328,14 @@ func run() {
 		log.Fatal("Failed to initialize logger:", err)
 		return
 	}
-	config, err = loadConfig("SupportedCryptos.json")
+	cryptoManager.EndpointSwitched = func(handler, from, to, reason string) {
+		LogAlert("%s handler switched from node %s to %s: %s", handler, from, to, reason)
+	}
+	configFile := os.Getenv("EXCHANGE_CONFIG")
+	if configFile == "" {
+		configFile = "SupportedCryptos.json"
+	}
+	config, err = loadConfig(configFile)
 	if err != nil {
 		log.Fatal("Failed to load config:", err)
 		return
@@ -307,10 +346,11 @@ func run() {
 	}
 
 	store = NewPriceStore(config)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
-	go ConnectWebSocket(ctx)
+	go StartPriceFeed(appContext)
+	go RunCrossRateChecker(appContext)
+	go RunSweeper(appContext)
+	go RunReserveManager(appContext)
 
 	mux := http.NewServeMux()
 
@@ -322,9 +362,76 @@ func run() {
 
 	mux.HandleFunc("/", mainPage)
 	mux.HandleFunc("/order", orderPage)
+	mux.HandleFunc("/api/quote", quoteAPI)
+	mux.HandleFunc("/api/order", orderAPI)
 	//mux.HandleFunc("/test", testPage)
 	fmt.Println("Server started at port 80")
 	go http.ListenAndServe(":80", mux)
+	go serveOperatorAPI()
+}
+
+// serveOperatorAPI serves the operator API apart from the public pages, the
+// bearer token is only accepted over TLS or from the machine itself.
+func serveOperatorAPI() {
+	if config.Operator.Token == "" {
+		return
+	}
+	listen := config.Operator.Listen
+	if listen == "" {
+		listen = defaultOperatorListen
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/operator/payout", operatorPayoutAPI)
+	tls := config.Operator.CertFile != "" && config.Operator.KeyFile != ""
+	if !tls && !isLoopback(listen) {
+		LogError("Operator API disabled: %s is not a loopback address and no TLS certificate is configured", listen)
+		return
+	}
+	fmt.Println("Operator API started at", listen)
+	var err error
+	if tls {
+		err = http.ListenAndServeTLS(listen, config.Operator.CertFile, config.Operator.KeyFile, mux)
+	} else {
+		err = http.ListenAndServe(listen, mux)
+	}
+	LogError("Operator API stopped: %s", err.Error())
+}
+
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// printNodes shows the last health check of the nodes of handlers with
+// failover.
+func printNodes() {
+	for _, crypto := range config.SupportedCryptos {
+		reporter, ok := handlers[int64(crypto.InternalAssetID)].(cryptoManager.EndpointReporter)
+		if !ok {
+			continue
+		}
+		fmt.Println(crypto.AssetName)
+		for _, node := range reporter.Endpoints() {
+			marker := " "
+			if node.Current {
+				marker = "*"
+			}
+			state := "healthy"
+			if node.Problem != "" {
+				state = node.Problem
+			} else if node.Latency == 0 {
+				state = "not checked"
+			}
+			fmt.Printf(" %s %s height %d, peers %d, latency %v, %s\n", marker, node.Endpoint, node.Height, node.Peers, node.Latency.Round(time.Millisecond), state)
+		}
+	}
 }
 
 func waitForAllOrdersToComplete() {
@@ -336,7 +443,7 @@ func waitForAllOrdersToComplete() {
 		sessionsMutex.Lock()
 		for _, session := range Sessions {
 			switch session.Status {
-			case "TRANSLATION FAILED", "SUCCESS":
+			case "TRANSLATION FAILED", "SUCCESS", "AWAITING OPERATOR":
 				// Terminal state, no action needed
 				continue
 			default:
@@ -354,19 +461,87 @@ func waitForAllOrdersToComplete() {
 
 func main() {
 	run()
-	for {
-		var command string
-		fmt.Scanln(&command)
-		switch command {
+	scanner := bufio.NewScanner(os.Stdin)
+	// Signed PSBTs are pasted on one line.
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
 		case "maintain":
 			isUnderMaintenance = true
+			fmt.Printf("Cancelled %d unfunded orders\n", CancelUnfundedOrders())
 			waitForAllOrdersToComplete()
 			fmt.Println("All orders are done you may edit environment")
 		case "resume":
 			isUnderMaintenance = false
+		case "cancel":
+			if len(fields) != 2 {
+				fmt.Println("Usage: cancel <orderID>")
+				continue
+			}
+			if err := CancelOrder(fields[1]); err != nil {
+				fmt.Println("Cancel failed:", err)
+			} else {
+				fmt.Println("Order cancelled")
+			}
+		case "sim":
+			simulateCommand(fields[1:])
+		case "sweep":
+			SweepAll(appContext)
+			fmt.Println("Sweep finished")
+		case "exportpsbt":
+			if len(fields) != 2 {
+				fmt.Println("Usage: exportpsbt <orderID>")
+				continue
+			}
+			psbt, err := ExportPayout(fields[1])
+			if err != nil {
+				fmt.Println("Export failed:", err)
+			} else {
+				fmt.Println(psbt)
+			}
+		case "importpsbt":
+			if len(fields) != 3 {
+				fmt.Println("Usage: importpsbt <orderID> <signed PSBT>")
+				continue
+			}
+			txids, err := ImportSignedPayout(fields[1], fields[2])
+			if err != nil {
+				fmt.Println("Import failed:", err)
+			} else {
+				fmt.Printf("Payout broadcast [%v]\n", txids)
+			}
+		case "importsweep":
+			if len(fields) != 3 {
+				fmt.Println("Usage: importsweep <assetID> <signed PSBT>")
+				continue
+			}
+			assetID, err := strconv.Atoi(fields[1])
+			if err != nil {
+				fmt.Println("Invalid asset ID:", fields[1])
+				continue
+			}
+			txids, err := ImportSignedSweep(assetID, fields[2])
+			if err != nil {
+				fmt.Println("Import failed:", err)
+			} else {
+				fmt.Printf("Sweep broadcast [%v]\n", txids)
+			}
+		case "nodes":
+			printNodes()
+		case "reserves":
+			printReserves(CheckReserves(appContext))
+		case "shutdown":
+			isUnderMaintenance = true
+			shutdownApp()
+			orders.Wait()
+			fmt.Println("All orders stopped, shutting down")
+			os.Exit(0)
 		default:
 			continue
 		}
-
 	}
 }